@@ -0,0 +1,49 @@
+// Package blobstore keeps the receipt files. Files are addressed by keys
+// which are plain file names, e.g. the content hash with an extension.
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("Blob not found")
+	ErrInvalidKey = errors.New("Invalid blob key")
+)
+
+// Blob is an open blob which streams its content as it is read, so
+// serving a range of a large file doesn't load all of it. ModTime is
+// zero when the backend doesn't tell it.
+type Blob struct {
+	io.ReadSeekCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore is where the receipt files are archived. Put replaces an
+// existing blob, Delete of a missing blob is not an error and List
+// returns the keys starting with prefix in lexical order. The caller
+// closes the blobs returned by Get.
+type BlobStore interface {
+	Put(ctx context.Context, key string, content []byte) error
+	Get(ctx context.Context, key string) (*Blob, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// validKey keeps keys usable as file names on every backend
+func validKey(key string) error {
+	if key == "" ||
+		key == "." ||
+		key == ".." ||
+		strings.ContainsAny(key, "/\\") ||
+		strings.HasPrefix(key, ".") {
+		return ErrInvalidKey
+	}
+	return nil
+}
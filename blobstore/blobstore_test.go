@@ -0,0 +1,126 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readBlob reads the blob from offset on
+func readBlob(ctx context.Context, store BlobStore, key string, offset int64) ([]byte, *Blob, error) {
+	blob, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer blob.Close()
+	if _, err := blob.Seek(offset, io.SeekStart); err != nil {
+		return nil, blob, err
+	}
+	content, err := ioutil.ReadAll(blob)
+	return content, blob, err
+}
+
+// testBlobStore runs the same checks against every implementation
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	blobs := map[string][]byte{
+		"abc.jpg": {0, 1, 0, 1},
+		"abd.pdf": []byte("%PDF-1.4"),
+		"def.png": {},
+	}
+	for key, content := range blobs {
+		if err := store.Put(ctx, key, content); err != nil {
+			t.Fatalf("Put(%s) error = %v", key, err)
+		}
+	}
+	// Replacing keeps the latest
+	blobs["abc.jpg"] = []byte{2, 3}
+	if err := store.Put(ctx, "abc.jpg", blobs["abc.jpg"]); err != nil {
+		t.Fatalf("Put(abc.jpg) again error = %v", err)
+	}
+
+	for key, want := range blobs {
+		got, blob, err := readBlob(ctx, store, key, 0)
+		if err != nil || string(got) != string(want) || blob.Size != int64(len(want)) {
+			t.Errorf("Get(%s) = %v, %v, want %v", key, got, err, want)
+		}
+		if exists, err := store.Exists(ctx, key); !exists || err != nil {
+			t.Errorf("Exists(%s) = %v, %v, want true", key, exists, err)
+		}
+	}
+
+	// Reading from the middle, like a Range request does
+	if got, _, err := readBlob(ctx, store, "abd.pdf", 5); err != nil || string(got) != "1.4" {
+		t.Errorf("Get(abd.pdf) from 5 = %q, %v, want %q", got, err, "1.4")
+	}
+	// Reading again after seeking back
+	if blob, err := store.Get(ctx, "abd.pdf"); err == nil {
+		head := make([]byte, 4)
+		io.ReadFull(blob, head)
+		blob.Seek(1, io.SeekStart)
+		rest, err := ioutil.ReadAll(blob)
+		if err != nil || string(head)+string(rest) != "%PDFPDF-1.4" {
+			t.Errorf("Get(abd.pdf) seeked back = %q, %q, %v", head, rest, err)
+		}
+		blob.Close()
+	}
+
+	listTests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{"abc.jpg", "abd.pdf", "def.png"}},
+		{"ab", []string{"abc.jpg", "abd.pdf"}},
+		{"x", []string{}},
+	}
+	for _, tt := range listTests {
+		got, err := store.List(ctx, tt.prefix)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("List(%q) = %v, %v, want %v", tt.prefix, got, err, tt.want)
+		}
+	}
+
+	if err := store.Delete(ctx, "abc.jpg"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if err := store.Delete(ctx, "abc.jpg"); err != nil {
+		t.Errorf("Delete() of deleted blob error = %v, want nil", err)
+	}
+	if _, err := store.Get(ctx, "abc.jpg"); err != ErrNotFound {
+		t.Errorf("Get() of deleted blob error = %v, want %v", err, ErrNotFound)
+	}
+	if exists, err := store.Exists(ctx, "abc.jpg"); exists || err != nil {
+		t.Errorf("Exists() of deleted blob = %v, %v, want false", exists, err)
+	}
+
+	for _, key := range []string{"", "..", "../receipts.db", "img/abc.jpg", ".upload-1"} {
+		if err := store.Put(ctx, key, []byte{1}); err != ErrInvalidKey {
+			t.Errorf("Put(%q) error = %v, want %v", key, err, ErrInvalidKey)
+		}
+		if _, err := store.Get(ctx, key); err != ErrInvalidKey {
+			t.Errorf("Get(%q) error = %v, want %v", key, err, ErrInvalidKey)
+		}
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testBlobStore(t, NewLocalStore(dir))
+
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("LocalStore left %d files, want 2", len(entries))
+	}
+}
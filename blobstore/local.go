@@ -0,0 +1,124 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LocalStore keeps the blobs as files in Dir
+type LocalStore struct {
+	Dir string
+}
+
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{Dir: dir}
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Dir, key), nil
+}
+
+// Put writes the file under a temporary name first, so a half written
+// file is never seen under the key.
+func (s *LocalStore) Put(ctx context.Context, key string, content []byte) error {
+	finalPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(s.Dir, ".upload-*")
+	if err != nil {
+		log.Printf("ERROR: creating temporary file failed: %v", err)
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	_, err = tmpFile.Write(content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, finalPath)
+	}
+	if err != nil {
+		log.Printf("ERROR: writing file %s: %v", finalPath, err)
+		if rmErr := os.Remove(tmpPath); rmErr != nil && !os.IsNotExist(rmErr) {
+			log.Printf("ERROR: removing temporary file %s failed: %v",
+				tmpPath,
+				rmErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (*Blob, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Blob{ReadSeekCloser: f, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (s *LocalStore) Exists(ctx context.Context, key string) (bool, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List leaves out temporary files of unfinished writes
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]string, error) {
+	entries, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || validKey(name) != nil || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
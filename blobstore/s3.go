@@ -0,0 +1,443 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Error responses are short, anything longer isn't read
+const maxS3ErrorSize int64 = 64 * 1024
+
+// S3Store keeps the blobs in a bucket of an S3 compatible service such
+// as AWS S3 or MinIO. Buckets are addressed in the path style, e.g.
+// http://localhost:9000/receipts/abc.jpg, which every such service
+// understands.
+type S3Store struct {
+	Endpoint  *url.URL
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+	// now is replaced in tests to sign with a fixed time
+	now func() time.Time
+}
+
+func NewS3Store(
+	endpoint string,
+	region string,
+	bucket string,
+	accessKey string,
+	secretKey string) (*S3Store, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, errors.New("Missing S3 bucket")
+	}
+	if region == "" {
+		// What MinIO and most other S3 compatible services expect
+		region = "us-east-1"
+	}
+	return &S3Store{
+		Endpoint:  u,
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    &http.Client{Timeout: time.Minute},
+		now:       time.Now,
+	}, nil
+}
+
+// s3Error is the body of a failed S3 request
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type listBucketResult struct {
+	Keys                  []string `xml:"Contents>Key"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+func (s *S3Store) do(
+	ctx context.Context,
+	method string,
+	key string,
+	query url.Values,
+	body []byte) (*http.Response, error) {
+	req, err := s.newRequest(ctx, method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	return s.send(req, body)
+}
+
+func (s *S3Store) newRequest(
+	ctx context.Context,
+	method string,
+	key string,
+	query url.Values,
+	body []byte) (*http.Request, error) {
+	u := *s.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	// Sent exactly as signed
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+}
+
+// send signs the request once all its headers are set
+func (s *S3Store) send(req *http.Request, body []byte) (*http.Response, error) {
+	signV4(req, body, s.AccessKey, s.SecretKey, s.Region, s.now())
+	return s.Client.Do(req)
+}
+
+// errorOf turns an unexpected response into an error
+func errorOf(method string, key string, resp *http.Response) error {
+	var s3Err s3Error
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxS3ErrorSize))
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("S3 %s %s failed: %s: %s %s",
+			method,
+			key,
+			resp.Status,
+			s3Err.Code,
+			s3Err.Message)
+	}
+	return fmt.Errorf("S3 %s %s failed: %s", method, key, resp.Status)
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, content []byte) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, "PUT", key, nil, content)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errorOf("PUT", key, resp)
+	}
+	return nil
+}
+
+// Get starts reading the object, the response body is read as the blob
+// is. Seeking elsewhere fetches the rest with a ranged GET.
+func (s *S3Store) Get(ctx context.Context, key string) (*Blob, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, "GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, errorOf("GET", key, resp)
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 GET %s response has no length", key)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	object := &s3Object{
+		ctx:   ctx,
+		store: s,
+		key:   key,
+		size:  resp.ContentLength,
+		body:  resp.Body,
+	}
+	return &Blob{ReadSeekCloser: object, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// s3Object reads an object from offset on. body is the open response
+// reading from bodyOffset, if any.
+type s3Object struct {
+	ctx        context.Context
+	store      *S3Store
+	key        string
+	size       int64
+	offset     int64
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil || o.bodyOffset != o.offset {
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	o.bodyOffset += int64(n)
+	if err == io.EOF && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// open replaces the body with one reading from the current offset
+func (o *s3Object) open() error {
+	o.Close()
+	req, err := o.store.newRequest(o.ctx, "GET", o.key, nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", o.offset))
+	resp, err := o.store.send(req, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return errorOf("GET", o.key, resp)
+	}
+	o.body = resp.Body
+	o.bodyOffset = o.offset
+	return nil
+}
+
+// Seek only moves the offset, the next Read fetches from there
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative position %d", offset)
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+func (s *S3Store) Exists(ctx context.Context, key string) (bool, error) {
+	if err := validKey(key); err != nil {
+		return false, err
+	}
+	resp, err := s.do(ctx, "HEAD", key, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	// HEAD responses have no body to tell more
+	return false, fmt.Errorf("S3 HEAD %s failed: %s", key, resp.Status)
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, "DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return errorOf("DELETE", key, resp)
+}
+
+// List pages through ListObjectsV2 results, which S3 returns at most
+// a thousand at a time.
+func (s *S3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, "GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := errorOf("GET", "?list-type=2", resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("S3 list response malformed: %v", err)
+		}
+
+		keys = append(keys, result.Keys...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// signV4 adds AWS Signature Version 4 headers to the request. Besides
+// the host, the Range, Content-Type, Content-MD5 and X-Amz-* headers are
+// signed.
+func signV4(
+	req *http.Request,
+	payload []byte,
+	accessKey string,
+	secretKey string,
+	region string,
+	now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") ||
+			name == "range" ||
+			name == "content-type" ||
+			name == "content-md5" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSha256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey,
+		scope,
+		signedHeaders,
+		signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode escapes everything but the unreserved characters the way
+// AWS expects, slashes only when asked to.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery sorts the parameters by name, which is also how the
+// query is sent.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := []string{}
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,295 @@
+// Package config gathers the settings of the server from a TOML or YAML
+// file, RECEIPTS_* environment variables and command-line flags.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the server. Relative paths are relative
+// to DataDir, which the server makes its working directory.
+type Config struct {
+	DataDir string `toml:"data_dir" yaml:"data_dir"`
+	Listen  string `toml:"listen" yaml:"listen"`
+	// How long requests in flight may take to complete on shutdown
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout" yaml:"shutdown_timeout"`
+	LogFile         string        `toml:"log_file" yaml:"log_file"`
+	UploadDir       string        `toml:"upload_dir" yaml:"upload_dir"`
+	ThumbnailDir    string        `toml:"thumbnail_dir" yaml:"thumbnail_dir"`
+	MaxFileSize     int64         `toml:"max_file_size" yaml:"max_file_size"`
+	MaxPdfPages     int           `toml:"max_pdf_pages" yaml:"max_pdf_pages"`
+	// Width times height of the largest accepted image, checked before
+	// decoding it
+	MaxImagePixels    int64    `toml:"max_image_pixels" yaml:"max_image_pixels"`
+	AllowedExtensions []string `toml:"allowed_extensions" yaml:"allowed_extensions"`
+	// Bounding boxes of the generated thumbnails in pixels
+	ThumbnailSizes []int `toml:"thumbnail_sizes" yaml:"thumbnail_sizes"`
+	// Use the time a photo was taken when the upload has no date tag
+	CaptureDate bool `toml:"capture_date" yaml:"capture_date"`
+
+	Database DatabaseConfig `toml:"database" yaml:"database"`
+	Storage  StorageConfig  `toml:"storage" yaml:"storage"`
+	Notify   NotifyConfig   `toml:"notify" yaml:"notify"`
+	Ocr      OcrConfig      `toml:"ocr" yaml:"ocr"`
+}
+
+type DatabaseConfig struct {
+	Path string `toml:"path" yaml:"path"`
+	// How long a write waits for another one to finish
+	BusyTimeout time.Duration `toml:"busy_timeout" yaml:"busy_timeout"`
+}
+
+// StorageConfig tells where the receipt files are kept, "local" being
+// UploadDir and "s3" a bucket of an S3 compatible service.
+type StorageConfig struct {
+	Backend string   `toml:"backend" yaml:"backend"`
+	S3      S3Config `toml:"s3" yaml:"s3"`
+}
+
+type S3Config struct {
+	Endpoint  string `toml:"endpoint" yaml:"endpoint"`
+	Region    string `toml:"region" yaml:"region"`
+	Bucket    string `toml:"bucket" yaml:"bucket"`
+	AccessKey string `toml:"access_key" yaml:"access_key"`
+	SecretKey string `toml:"secret_key" yaml:"secret_key"`
+}
+
+// NotifyConfig sends expiry reminders by e-mail to the owner of each
+// receipt when SmtpAddr is set and otherwise appends them into LogFile.
+type NotifyConfig struct {
+	LeadDays     []int  `toml:"lead_days" yaml:"lead_days"`
+	LogFile      string `toml:"log_file" yaml:"log_file"`
+	SmtpAddr     string `toml:"smtp_addr" yaml:"smtp_addr"`
+	SmtpUser     string `toml:"smtp_user" yaml:"smtp_user"`
+	SmtpPassword string `toml:"smtp_password" yaml:"smtp_password"`
+	SmtpFrom     string `toml:"smtp_from" yaml:"smtp_from"`
+}
+
+type OcrConfig struct {
+	Tesseract string `toml:"tesseract" yaml:"tesseract"`
+	Languages string `toml:"languages" yaml:"languages"`
+	Workers   int    `toml:"workers" yaml:"workers"`
+	// Details read from receipts less confident than this are ignored
+	MinConfidence float64 `toml:"min_confidence" yaml:"min_confidence"`
+}
+
+// File types the uploads are checked against by their content
+var supportedExtensions = map[string]bool{
+	"gif":  true,
+	"jpg":  true,
+	"jpeg": true,
+	"pdf":  true,
+	"png":  true,
+	"tiff": true,
+}
+
+func Default() *Config {
+	return &Config{
+		Listen:            ":8081",
+		ShutdownTimeout:   30 * time.Second,
+		LogFile:           "receipts-api.log",
+		UploadDir:         "img",
+		ThumbnailDir:      "thumbs",
+		MaxFileSize:       16 * 1024 * 1024,
+		MaxPdfPages:       50,
+		MaxImagePixels:    50000000,
+		AllowedExtensions: []string{"gif", "jpg", "jpeg", "pdf", "png", "tiff"},
+		ThumbnailSizes:    []int{200, 800},
+		CaptureDate:       true,
+		Database: DatabaseConfig{
+			Path:        "receipts.db",
+			BusyTimeout: 5 * time.Second,
+		},
+		Storage: StorageConfig{Backend: "local"},
+		Notify: NotifyConfig{
+			LeadDays: []int{30, 7},
+			LogFile:  "notifications.log",
+		},
+		Ocr: OcrConfig{
+			Tesseract:     "tesseract",
+			Languages:     "eng",
+			Workers:       2,
+			MinConfidence: 0.5,
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, the configuration
+// file, the environment and the command-line flags, each overriding the
+// ones before. The file is given with -config or RECEIPTS_CONFIG. The
+// flags are added into fs, which may have flags of its own, and for
+// compatibility the data directory may also be the first argument.
+func Load(fs *flag.FlagSet, args []string, getenv func(string) string) (*Config, error) {
+	cfg := Default()
+	configPath := fs.String("config", getenv("RECEIPTS_CONFIG"),
+		"configuration file, TOML or YAML")
+	type flagValue struct {
+		s     setting
+		value string
+	}
+	flagValues := []flagValue{}
+	for _, s := range cfg.settings() {
+		if s.flag == "" {
+			continue
+		}
+		s := s
+		fs.Func(s.flag, s.usage+" ("+s.env+")", func(value string) error {
+			// Applied only after the file and the environment
+			flagValues = append(flagValues, flagValue{s, value})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range cfg.settings() {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(value); err != nil {
+				return nil, fmt.Errorf("Invalid %s %q: %v", s.env, value, err)
+			}
+		}
+	}
+	// Parsing stops at the first argument, flags after it would be lost
+	if fs.NArg() > 1 {
+		return nil, fmt.Errorf("Flags must come before the data directory, got %q",
+			fs.Args()[1:])
+	}
+	if fs.NArg() > 0 {
+		cfg.DataDir = fs.Arg(0)
+	}
+	for _, f := range flagValues {
+		if err := f.s.set(f.value); err != nil {
+			return nil, fmt.Errorf("Invalid -%s %q: %v", f.s.flag, f.value, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile reads the file by its extension, unknown keys being errors
+// so that typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		meta, err := toml.DecodeFile(path, c)
+		if err != nil {
+			return fmt.Errorf("Reading %s failed: %v", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("Unknown setting %s in %s", undecoded[0], path)
+		}
+	case ".yaml", ".yml":
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Reading %s failed: %v", path, err)
+		}
+		defer f.Close()
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil {
+			return fmt.Errorf("Reading %s failed: %v", path, err)
+		}
+	default:
+		return fmt.Errorf("Unknown configuration file type %s, use .toml or .yaml", path)
+	}
+	return nil
+}
+
+// Validate checks the settings once so that the rest of the server can
+// rely on them.
+func (c *Config) Validate() error {
+	if c.DataDir == "" {
+		return errors.New("Data directory missing, set data_dir, RECEIPTS_DATA_DIR or -data-dir")
+	}
+	if stat, err := os.Stat(c.DataDir); err != nil || !stat.IsDir() {
+		return fmt.Errorf("Cannot open data directory %s", c.DataDir)
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("Invalid listen address %q: %v", c.Listen, err)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("Invalid shutdown_timeout %v", c.ShutdownTimeout)
+	}
+	for name, value := range map[string]string{
+		"log_file":      c.LogFile,
+		"upload_dir":    c.UploadDir,
+		"thumbnail_dir": c.ThumbnailDir,
+		"database.path": c.Database.Path,
+	} {
+		if value == "" {
+			return fmt.Errorf("Missing %s", name)
+		}
+	}
+	if c.MaxFileSize <= 0 {
+		return fmt.Errorf("Invalid max_file_size %d", c.MaxFileSize)
+	}
+	if c.MaxPdfPages <= 0 {
+		return fmt.Errorf("Invalid max_pdf_pages %d", c.MaxPdfPages)
+	}
+	if c.MaxImagePixels <= 0 {
+		return fmt.Errorf("Invalid max_image_pixels %d", c.MaxImagePixels)
+	}
+	if len(c.AllowedExtensions) == 0 {
+		return errors.New("No allowed_extensions")
+	}
+	for i, ext := range c.AllowedExtensions {
+		ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+		if !supportedExtensions[ext] {
+			return fmt.Errorf("Unsupported extension %q in allowed_extensions", ext)
+		}
+		c.AllowedExtensions[i] = ext
+	}
+	if len(c.ThumbnailSizes) == 0 {
+		return errors.New("No thumbnail_sizes")
+	}
+	for _, size := range c.ThumbnailSizes {
+		if size <= 0 {
+			return fmt.Errorf("Invalid size %d in thumbnail_sizes", size)
+		}
+	}
+	if c.Database.BusyTimeout < 0 {
+		return fmt.Errorf("Invalid database.busy_timeout %v", c.Database.BusyTimeout)
+	}
+
+	switch c.Storage.Backend {
+	case "local":
+	case "s3":
+		if c.Storage.S3.Endpoint == "" || c.Storage.S3.Bucket == "" {
+			return errors.New("S3 storage needs storage.s3.endpoint and storage.s3.bucket")
+		}
+	default:
+		return fmt.Errorf("Unknown storage.backend %q, use local or s3", c.Storage.Backend)
+	}
+
+	for _, days := range c.Notify.LeadDays {
+		if days < 0 {
+			return fmt.Errorf("Invalid days %d in notify.lead_days", days)
+		}
+	}
+	if c.Ocr.Workers <= 0 {
+		return fmt.Errorf("Invalid ocr.workers %d", c.Ocr.Workers)
+	}
+	if c.Ocr.MinConfidence < 0 || c.Ocr.MinConfidence > 1 {
+		return fmt.Errorf("Invalid ocr.min_confidence %v, use 0 to 1", c.Ocr.MinConfidence)
+	}
+	return nil
+}
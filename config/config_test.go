@@ -0,0 +1,202 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testToml = `
+listen = ":9000"
+shutdown_timeout = "1m"
+max_file_size = 1048576
+allowed_extensions = ["jpg", "PDF"]
+
+[database]
+busy_timeout = "10s"
+
+[storage]
+backend = "s3"
+
+[storage.s3]
+endpoint = "http://localhost:9000"
+bucket = "receipts"
+
+[notify]
+lead_days = [14]
+`
+
+const testYaml = `
+listen: ":9000"
+shutdown_timeout: 1m
+max_file_size: 1048576
+allowed_extensions: [jpg, PDF]
+database:
+  busy_timeout: 10s
+storage:
+  backend: s3
+  s3:
+    endpoint: http://localhost:9000
+    bucket: receipts
+notify:
+  lead_days: [14]
+`
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Writing %s failed: %v", path, err)
+	}
+	return path
+}
+
+func envOf(env map[string]string) func(string) string {
+	return func(name string) string {
+		return env[name]
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tomlPath := writeFile(t, dir, "receipts.toml", testToml)
+	yamlPath := writeFile(t, dir, "receipts.yaml", testYaml)
+
+	// What both files set on top of the defaults
+	fromFile := Default()
+	fromFile.DataDir = dir
+	fromFile.Listen = ":9000"
+	fromFile.ShutdownTimeout = time.Minute
+	fromFile.MaxFileSize = 1048576
+	fromFile.AllowedExtensions = []string{"jpg", "pdf"}
+	fromFile.Database.BusyTimeout = 10 * time.Second
+	fromFile.Storage.Backend = "s3"
+	fromFile.Storage.S3.Endpoint = "http://localhost:9000"
+	fromFile.Storage.S3.Bucket = "receipts"
+	fromFile.Notify.LeadDays = []int{14}
+
+	defaults := Default()
+	defaults.DataDir = dir
+
+	overridden := *fromFile
+	overridden.Listen = ":9001"
+	overridden.Notify.LeadDays = []int{30, 1}
+	overridden.Ocr.Languages = "fin+eng"
+
+	flagged := overridden
+	flagged.Listen = ":9002"
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want *Config
+	}{
+		{
+			"Defaults with data directory as an argument",
+			[]string{dir},
+			nil,
+			defaults,
+		},
+		{
+			"TOML file",
+			[]string{"-config", tomlPath, dir},
+			nil,
+			fromFile,
+		},
+		{
+			"YAML file from the environment",
+			[]string{"-data-dir", dir},
+			map[string]string{"RECEIPTS_CONFIG": yamlPath},
+			fromFile,
+		},
+		{
+			"Environment overrides the file",
+			[]string{"-config", tomlPath},
+			map[string]string{
+				"RECEIPTS_DATA_DIR":         dir,
+				"RECEIPTS_LISTEN":           ":9001",
+				"RECEIPTS_NOTIFY_LEAD_DAYS": "30, 1",
+				"RECEIPTS_OCR_LANG":         "fin+eng",
+			},
+			&overridden,
+		},
+		{
+			"Flags override the environment",
+			[]string{"-config", tomlPath, "-listen", ":9002", dir},
+			map[string]string{
+				"RECEIPTS_LISTEN":           ":9001",
+				"RECEIPTS_NOTIFY_LEAD_DAYS": "30,1",
+				"RECEIPTS_OCR_LANG":         "fin+eng",
+			},
+			&flagged,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			got, err := Load(fs, tt.args, envOf(tt.env))
+			if err != nil {
+				t.Fatalf("%s: Load() error = %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: Load() = %+v, want %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	typoPath := writeFile(t, dir, "typo.toml", `listne = ":9000"`)
+	yamlTypoPath := writeFile(t, dir, "typo.yml", `listne: ":9000"`)
+	iniPath := writeFile(t, dir, "receipts.ini", `listen = :9000`)
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		wantErr string
+	}{
+		{"Missing data directory", nil, nil, "Data directory missing"},
+		{"Flag after data directory", []string{dir, "-listen", ":9000"}, nil, "Flags must come before the data directory"},
+		{"Data directory not found", []string{filepath.Join(dir, "missing")}, nil, "Cannot open data directory"},
+		{"Unknown TOML key", []string{"-config", typoPath, dir}, nil, "Unknown setting listne"},
+		{"Unknown YAML key", []string{"-config", yamlTypoPath, dir}, nil, "listne"},
+		{"Unknown file type", []string{"-config", iniPath, dir}, nil, "Unknown configuration file type"},
+		{"Missing file", []string{"-config", filepath.Join(dir, "x.toml"), dir}, nil, "Reading"},
+		{"Malformed number", []string{dir}, map[string]string{"RECEIPTS_MAX_FILE_SIZE": "16M"}, "Invalid RECEIPTS_MAX_FILE_SIZE"},
+		{"Malformed flag", []string{"-max-file-size", "big", dir}, nil, "Invalid -max-file-size"},
+		{"Listen without port", []string{"-listen", "localhost", dir}, nil, "Invalid listen address"},
+		{"Negative shutdown timeout", []string{"-shutdown-timeout", "-1s", dir}, nil, "Invalid shutdown_timeout"},
+		{"Negative file size", []string{"-max-file-size", "-1", dir}, nil, "Invalid max_file_size"},
+		{"No image pixels", []string{dir}, map[string]string{"RECEIPTS_MAX_IMAGE_PIXELS": "0"}, "Invalid max_image_pixels"},
+		{"Unsupported extension", []string{dir}, map[string]string{"RECEIPTS_ALLOWED_EXTENSIONS": "jpg,exe"}, `Unsupported extension "exe"`},
+		{"No thumbnail sizes", []string{dir}, map[string]string{"RECEIPTS_THUMBNAIL_SIZES": "0"}, "Invalid size 0"},
+		{"Unknown storage", []string{"-storage", "ftp", dir}, nil, "Unknown storage.backend"},
+		{"S3 without bucket", []string{"-storage", "s3", dir}, nil, "S3 storage needs"},
+		{"Confidence out of range", []string{dir}, map[string]string{"RECEIPTS_OCR_MIN_CONFIDENCE": "2"}, "ocr.min_confidence"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(ioutil.Discard)
+			_, err := Load(fs, tt.args, envOf(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: Load() error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
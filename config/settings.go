@@ -0,0 +1,138 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting can be given as an environment variable and, for the most
+// common ones, as a flag too
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(value string) error
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"RECEIPTS_DATA_DIR", "data-dir", "directory of the database and receipts", stringVar(&c.DataDir)},
+		{"RECEIPTS_LISTEN", "listen", "address to listen on, e.g. :8081", stringVar(&c.Listen)},
+		{"RECEIPTS_SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long requests may take to complete on shutdown", durationVar(&c.ShutdownTimeout)},
+		{"RECEIPTS_LOG_FILE", "log-file", "log file", stringVar(&c.LogFile)},
+		{"RECEIPTS_UPLOAD_DIR", "upload-dir", "directory of the receipt files", stringVar(&c.UploadDir)},
+		{"RECEIPTS_THUMBNAIL_DIR", "thumbnail-dir", "directory of the cached thumbnails", stringVar(&c.ThumbnailDir)},
+		{"RECEIPTS_MAX_FILE_SIZE", "max-file-size", "largest accepted upload in bytes", int64Var(&c.MaxFileSize)},
+		{"RECEIPTS_MAX_PDF_PAGES", "", "", intVar(&c.MaxPdfPages)},
+		{"RECEIPTS_MAX_IMAGE_PIXELS", "", "", int64Var(&c.MaxImagePixels)},
+		{"RECEIPTS_ALLOWED_EXTENSIONS", "", "", stringListVar(&c.AllowedExtensions)},
+		{"RECEIPTS_THUMBNAIL_SIZES", "", "", intListVar(&c.ThumbnailSizes)},
+		{"RECEIPTS_CAPTURE_DATE", "", "", boolVar(&c.CaptureDate)},
+		{"RECEIPTS_DATABASE", "database", "SQLite database file", stringVar(&c.Database.Path)},
+		{"RECEIPTS_DB_BUSY_TIMEOUT", "", "", durationVar(&c.Database.BusyTimeout)},
+		{"RECEIPTS_STORAGE", "storage", "where receipt files are kept, local or s3", stringVar(&c.Storage.Backend)},
+		{"RECEIPTS_S3_ENDPOINT", "", "", stringVar(&c.Storage.S3.Endpoint)},
+		{"RECEIPTS_S3_REGION", "", "", stringVar(&c.Storage.S3.Region)},
+		{"RECEIPTS_S3_BUCKET", "", "", stringVar(&c.Storage.S3.Bucket)},
+		{"RECEIPTS_S3_ACCESS_KEY", "", "", stringVar(&c.Storage.S3.AccessKey)},
+		{"RECEIPTS_S3_SECRET_KEY", "", "", stringVar(&c.Storage.S3.SecretKey)},
+		{"RECEIPTS_NOTIFY_LEAD_DAYS", "", "", intListVar(&c.Notify.LeadDays)},
+		{"RECEIPTS_NOTIFY_LOG_FILE", "", "", stringVar(&c.Notify.LogFile)},
+		{"RECEIPTS_SMTP_ADDR", "", "", stringVar(&c.Notify.SmtpAddr)},
+		{"RECEIPTS_SMTP_USER", "", "", stringVar(&c.Notify.SmtpUser)},
+		{"RECEIPTS_SMTP_PASSWORD", "", "", stringVar(&c.Notify.SmtpPassword)},
+		{"RECEIPTS_SMTP_FROM", "", "", stringVar(&c.Notify.SmtpFrom)},
+		{"RECEIPTS_TESSERACT", "", "", stringVar(&c.Ocr.Tesseract)},
+		{"RECEIPTS_OCR_LANG", "", "", stringVar(&c.Ocr.Languages)},
+		{"RECEIPTS_OCR_WORKERS", "", "", intVar(&c.Ocr.Workers)},
+		{"RECEIPTS_OCR_MIN_CONFIDENCE", "", "", floatVar(&c.Ocr.MinConfidence)},
+	}
+}
+
+func stringVar(p *string) func(string) error {
+	return func(value string) error {
+		*p = value
+		return nil
+	}
+}
+
+func intVar(p *int) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err == nil {
+			*p = parsed
+		}
+		return err
+	}
+}
+
+func int64Var(p *int64) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			*p = parsed
+		}
+		return err
+	}
+}
+
+func floatVar(p *float64) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			*p = parsed
+		}
+		return err
+	}
+}
+
+func boolVar(p *bool) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err == nil {
+			*p = parsed
+		}
+		return err
+	}
+}
+
+func durationVar(p *time.Duration) func(string) error {
+	return func(value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err == nil {
+			*p = parsed
+		}
+		return err
+	}
+}
+
+// stringListVar splits comma separated values, e.g. "jpg,png"
+func stringListVar(p *[]string) func(string) error {
+	return func(value string) error {
+		list := []string{}
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		*p = list
+		return nil
+	}
+}
+
+// intListVar splits comma separated numbers, e.g. "30,7"
+func intListVar(p *[]int) func(string) error {
+	return func(value string) error {
+		list := []int{}
+		for _, s := range strings.Split(value, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			list = append(list, n)
+		}
+		*p = list
+		return nil
+	}
+}
@@ -0,0 +1,218 @@
+package dbengine
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	SCOPE_READ  string = "read"
+	SCOPE_WRITE string = "write"
+	// Admin tokens may do everything, including managing tokens
+	SCOPE_ADMIN string = "admin"
+
+	// Prefix of the tokens so that they are easy to spot, e.g. in logs
+	API_TOKEN_PREFIX string = "rt_"
+)
+
+var (
+	ErrTokenNotFound = errors.New("Token not found")
+	ErrInvalidToken  = errors.New("Invalid or revoked token")
+)
+
+var validScopes = map[string]bool{
+	SCOPE_READ:  true,
+	SCOPE_WRITE: true,
+	SCOPE_ADMIN: true,
+}
+
+// ApiToken lets the requests in as the user it belongs to
+type ApiToken struct {
+	Id        int64      `json:"id"`
+	UserId    int64      `json:"user_id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// HasScope tells whether the token grants scope
+func (t *ApiToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == SCOPE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseScopes validates comma or space separated scopes, e.g. "read,write"
+func ParseScopes(value string) ([]string, error) {
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, scope := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		if !validScopes[scope] {
+			return nil, fmt.Errorf("Unknown scope %q, use read, write or admin", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("Missing scopes")
+	}
+	return scopes, nil
+}
+
+// hashToken is enough on its own since the tokens are random rather
+// than chosen by people.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateApiToken returns the new token of the user, which can't be
+// recovered later since only its hash is stored.
+func (s *Store) CreateApiToken(
+	ctx context.Context,
+	userId int64,
+	name string,
+	scopes []string) (string, *ApiToken, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", nil, err
+	}
+	token := API_TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(random)
+	apiToken := &ApiToken{
+		UserId:    userId,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+
+	res, err := s.db.ExecContext(ctx, `
+INSERT INTO api_token(
+	user_id,
+	name,
+	token_hash,
+	scopes,
+	created_at
+) VALUES (
+	:user_id,
+	:name,
+	:token_hash,
+	:scopes,
+	:created_at);`,
+		sql.Named("user_id", userId),
+		sql.Named("name", name),
+		sql.Named("token_hash", hashToken(token)),
+		sql.Named("scopes", strings.Join(scopes, " ")),
+		sql.Named("created_at", formatTimestamp(apiToken.CreatedAt)),
+	)
+	if err != nil {
+		log.Printf("ERROR: inserting API token failed: %v", err)
+		return "", nil, err
+	}
+	if apiToken.Id, err = res.LastInsertId(); err != nil {
+		log.Printf("ERROR: failed to get last inserted id: %v", err)
+		return "", nil, err
+	}
+	return token, apiToken, nil
+}
+
+const apiTokenSelectSql = `SELECT
+	id,
+	IFNULL(user_id, 0),
+	name,
+	scopes,
+	created_at,
+	revoked_at
+FROM api_token
+`
+
+func scanApiToken(row interface{ Scan(...interface{}) error }) (*ApiToken, error) {
+	var t ApiToken
+	var scopes string
+	var revokedAt sql.NullTime
+	if err := row.Scan(&t.Id, &t.UserId, &t.Name, &scopes, &t.CreatedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	t.Scopes = strings.Fields(scopes)
+	if revokedAt.Valid {
+		t.RevokedAt = &revokedAt.Time
+	}
+	return &t, nil
+}
+
+// Authenticate returns the token unless it is unknown or revoked
+func (s *Store) Authenticate(ctx context.Context, token string) (*ApiToken, error) {
+	apiToken, err := scanApiToken(s.db.QueryRowContext(ctx,
+		apiTokenSelectSql+"WHERE token_hash = ? AND revoked_at IS NULL;",
+		hashToken(token)))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		log.Printf("ERROR: querying API token failed: %v", err)
+		return nil, err
+	}
+	return apiToken, nil
+}
+
+// ListApiTokens returns all tokens of the user, revoked ones included,
+// oldest first
+func (s *Store) ListApiTokens(ctx context.Context, userId int64) ([]ApiToken, error) {
+	rows, err := s.db.QueryContext(ctx,
+		apiTokenSelectSql+"WHERE user_id = ? ORDER BY id;",
+		userId)
+	if err != nil {
+		log.Printf("ERROR: querying API tokens failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]ApiToken, 0)
+	for rows.Next() {
+		apiToken, err := scanApiToken(rows)
+		if err != nil {
+			log.Printf("ERROR: failed to scan API token: %v", err)
+			return nil, err
+		}
+		tokens = append(tokens, *apiToken)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeApiToken keeps the token around so that it can still be listed.
+// Tokens already revoked or of other users are reported as not found.
+func (s *Store) RevokeApiToken(ctx context.Context, userId int64, tokenId int64) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE api_token SET revoked_at = ?
+WHERE id = ? AND user_id = ? AND revoked_at IS NULL;`,
+		formatTimestamp(time.Now()),
+		tokenId,
+		userId)
+	if err != nil {
+		log.Printf("ERROR: revoking API token %d failed: %v", tokenId, err)
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestApiTokens(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+
+	token, created, err := store.CreateApiToken(ctx, testUserId, "scanner", []string{SCOPE_WRITE})
+	if err != nil {
+		t.Fatalf("CreateApiToken() error = %v", err)
+	}
+	if !strings.HasPrefix(token, API_TOKEN_PREFIX) || len(token) < 40 {
+		t.Errorf("CreateApiToken() token = %q, want a long random token", token)
+	}
+	var storedHash string
+	memDb.QueryRow("SELECT token_hash FROM api_token;").Scan(&storedHash)
+	if storedHash == token || strings.Contains(storedHash, token) {
+		t.Errorf("CreateApiToken() stored the token in plain text")
+	}
+
+	got, err := store.Authenticate(ctx, token)
+	if err != nil || !reflect.DeepEqual(got, created) {
+		t.Errorf("Authenticate() = %v, %v, want %v", got, err, created)
+	}
+	if _, err := store.Authenticate(ctx, token+"x"); err != ErrInvalidToken {
+		t.Errorf("Authenticate() with wrong token error = %v, want %v", err, ErrInvalidToken)
+	}
+
+	if err := store.RevokeApiToken(ctx, testUserId, created.Id); err != nil {
+		t.Errorf("RevokeApiToken() error = %v", err)
+	}
+	if _, err := store.Authenticate(ctx, token); err != ErrInvalidToken {
+		t.Errorf("Authenticate() with revoked token error = %v, want %v", err, ErrInvalidToken)
+	}
+	if err := store.RevokeApiToken(ctx, testUserId, created.Id); err != ErrTokenNotFound {
+		t.Errorf("RevokeApiToken() twice error = %v, want %v", err, ErrTokenNotFound)
+	}
+
+	tokens, err := store.ListApiTokens(ctx, testUserId)
+	if err != nil || len(tokens) != 1 || tokens[0].RevokedAt == nil {
+		t.Errorf("ListApiTokens() = %v, %v, want the revoked token", tokens, err)
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"Single", "read", []string{"read"}, false},
+		{"Comma separated", "read,write", []string{"read", "write"}, false},
+		{"Space separated with duplicate", "admin read admin", []string{"admin", "read"}, false},
+		{"Unknown", "read,delete", nil, true},
+		{"Empty", " , ", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseScopes(tt.value)
+			if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: ParseScopes() = %v, %v, want %v, wantErr %v",
+					tt.name,
+					got,
+					err,
+					tt.want,
+					tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApiTokenHasScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{"Granted", []string{SCOPE_READ}, SCOPE_READ, true},
+		{"Write doesn't include read", []string{SCOPE_WRITE}, SCOPE_READ, false},
+		{"Admin includes everything", []string{SCOPE_ADMIN}, SCOPE_WRITE, true},
+		{"No scopes", nil, SCOPE_READ, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := &ApiToken{Scopes: tt.scopes}
+			if got := token.HasScope(tt.scope); got != tt.want {
+				t.Errorf("%s: HasScope() = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// ExtractedField is a receipt detail read from the OCR text or the
+// metadata of the upload. Value is in the same form as the receipt
+// column, e.g. amount in minor units.
+type ExtractedField struct {
+	Field      string  `json:"-"`
+	Value      string  `json:"value"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Receipt columns which can be filled in without the user
+var extractableFields = map[string]bool{
+	"purchase_date": true,
+	"amount":        true,
+	"currency":      true,
+	"vendor":        true,
+}
+
+// The amount the user has given was read in the default currency's
+// minor units, another currency would change its value.
+const amountNotGivenSql = `
+	AND (amount IS NULL OR EXISTS (
+		SELECT 1 FROM extracted_field
+		WHERE receipt_id = :receipt_id AND field = 'amount'))`
+
+// fillExtractedFields sets the fields the receipt is still missing and
+// records where the values came from. Values the user has given are
+// never overwritten and values extracted earlier only by more confident
+// ones. Currency is only filled in next to an extracted amount.
+func fillExtractedFields(
+	ctx context.Context,
+	db dbtx,
+	receiptId int64,
+	fields []ExtractedField) error {
+	for _, f := range fields {
+		if !extractableFields[f.Field] {
+			log.Printf("ERROR: field %q can't be extracted", f.Field)
+			continue
+		}
+		extraCondition := ""
+		if f.Field == "currency" {
+			extraCondition = amountNotGivenSql
+		}
+		// Column name comes from the allowed fields above
+		res, err := db.ExecContext(ctx, "UPDATE receipt SET "+f.Field+` = :value
+WHERE id = :receipt_id AND (
+	IFNULL(`+f.Field+`, '') = ''
+	OR EXISTS (
+		SELECT 1 FROM extracted_field
+		WHERE receipt_id = :receipt_id
+			AND field = :field
+			AND confidence < :confidence))`+extraCondition+";",
+			sql.Named("value", f.Value),
+			sql.Named("receipt_id", receiptId),
+			sql.Named("field", f.Field),
+			sql.Named("confidence", f.Confidence),
+		)
+		if err != nil {
+			log.Printf("ERROR: filling %s of receipt %d failed: %v",
+				f.Field,
+				receiptId,
+				err)
+			return err
+		}
+		if updated, _ := res.RowsAffected(); updated == 0 {
+			continue
+		}
+		if err := recordExtractedField(ctx, db, receiptId, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordExtractedField marks the value of the receipt column as one
+// which wasn't given by the user.
+func recordExtractedField(
+	ctx context.Context,
+	db dbtx,
+	receiptId int64,
+	f ExtractedField) error {
+	_, err := db.ExecContext(ctx, `
+INSERT OR REPLACE INTO extracted_field(
+	receipt_id,
+	field,
+	value,
+	confidence
+) VALUES (
+	:receipt_id,
+	:field,
+	:value,
+	:confidence);`,
+		sql.Named("receipt_id", receiptId),
+		sql.Named("field", f.Field),
+		sql.Named("value", f.Value),
+		sql.Named("confidence", f.Confidence),
+	)
+	if err != nil {
+		log.Printf("ERROR: recording extracted %s of receipt %d failed: %v",
+			f.Field,
+			receiptId,
+			err)
+		return err
+	}
+	return nil
+}
+
+// GetExtractedFields returns the details of the receipt which weren't
+// given by the user keyed by the field name. Receipts the user can't see
+// have none.
+func (s *Store) GetExtractedFields(
+	ctx context.Context,
+	userId int64,
+	receiptId int64) (map[string]ExtractedField, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT field, value, confidence
+FROM extracted_field
+WHERE receipt_id = ? AND receipt_id IN (`+visibleReceiptIds("?")+");",
+		receiptId,
+		userId,
+		userId,
+		userId)
+	if err != nil {
+		log.Printf("ERROR: querying extracted fields of receipt %d failed: %v",
+			receiptId,
+			err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := map[string]ExtractedField{}
+	for rows.Next() {
+		var f ExtractedField
+		if err := rows.Scan(&f.Field, &f.Value, &f.Confidence); err != nil {
+			log.Printf("ERROR: failed to scan extracted field: %v", err)
+			return nil, err
+		}
+		fields[f.Field] = f
+	}
+	return fields, rows.Err()
+}
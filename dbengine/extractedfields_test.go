@@ -0,0 +1,179 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"receiptstracker-api/blobstore"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestCompleteOcrJobFillsMissingFields(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+	populateReceipts(memDb)
+
+	fields := []ExtractedField{
+		{Field: "purchase_date", Value: "2019-05-14", Confidence: 0.9},
+		{Field: "amount", Value: "99900", Confidence: 0.6},
+		{Field: "currency", Value: "USD", Confidence: 0.6},
+		{Field: "vendor", Value: "Shop Oy", Confidence: 0.7},
+		{Field: "filename", Value: "evil.jpg", Confidence: 1},
+	}
+	for _, receiptId := range []int64{1, 2} {
+		if err := store.CompleteOcrJob(ctx, receiptId, "text", fields); err != nil {
+			t.Fatalf("CompleteOcrJob() error = %v", err)
+		}
+	}
+
+	extractedAmount := int64(99900)
+	tests := []struct {
+		name          string
+		receiptId     int64
+		wantReceipt   Receipt
+		wantExtracted map[string]ExtractedField
+	}{
+		{
+			"User given values are kept",
+			1,
+			Receipt{1, testUserId, "a.jpg", "", 0, "2019-05-15", "2021-05-15",
+				[]string{"computershop", "laptop"}, laptopDetails()},
+			map[string]ExtractedField{},
+		},
+		{
+			"Missing values are filled",
+			2,
+			Receipt{2, testUserId, "b.png", "", 0, "2019-05-14", "", []string{},
+				PurchaseDetails{&extractedAmount, "USD", "Shop Oy", ""}},
+			map[string]ExtractedField{
+				"purchase_date": fields[0],
+				"amount":        fields[1],
+				"currency":      fields[2],
+				"vendor":        fields[3],
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.GetReceipt(ctx, testUserId, tt.receiptId)
+			if err != nil {
+				t.Fatalf("%s: GetReceipt() error = %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(*got, tt.wantReceipt) {
+				t.Errorf("%s: GetReceipt() = %v, want %v",
+					tt.name,
+					*got,
+					tt.wantReceipt)
+			}
+			extracted, err := store.GetExtractedFields(ctx, testUserId, tt.receiptId)
+			if err != nil {
+				t.Fatalf("%s: GetExtractedFields() error = %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(extracted, tt.wantExtracted) {
+				t.Errorf("%s: GetExtractedFields() = %v, want %v",
+					tt.name,
+					extracted,
+					tt.wantExtracted)
+			}
+		})
+	}
+
+	// Amount given without a currency is kept in the default currency
+	memDb.Exec("UPDATE receipt SET amount = 1250 WHERE id = 3;")
+	yen := []ExtractedField{
+		{Field: "amount", Value: "1250", Confidence: 0.9},
+		{Field: "currency", Value: "JPY", Confidence: 0.9},
+	}
+	if err := store.CompleteOcrJob(ctx, 3, "text", yen); err != nil {
+		t.Fatalf("CompleteOcrJob() error = %v", err)
+	}
+	got, _ := store.GetReceipt(ctx, testUserId, 3)
+	if got.Currency != "" || got.Amount == nil || *got.Amount != 1250 {
+		t.Errorf("GetReceipt() = %v, want 1250 without currency", *got)
+	}
+	if extracted, _ := store.GetExtractedFields(ctx, testUserId, 3); len(extracted) != 0 {
+		t.Errorf("GetExtractedFields() = %v, want none", extracted)
+	}
+
+	// Date set by the user is no longer an extracted one
+	userDate := "2019-05-13"
+	if err := store.UpdateReceipt(ctx, testUserId, 2, ReceiptUpdate{PurchaseDate: &userDate}); err != nil {
+		t.Fatalf("UpdateReceipt() error = %v", err)
+	}
+	extracted, _ := store.GetExtractedFields(ctx, testUserId, 2)
+	if _, found := extracted["purchase_date"]; found {
+		t.Errorf("GetExtractedFields() = %v, want no purchase_date", extracted)
+	}
+}
+
+func TestMoreConfidentExtractionReplacesStored(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+	storeDir, err := ioutil.TempDir("", "receipts")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+
+	// Date of taking the photo
+	captured := ExtractedField{Field: "purchase_date", Value: "2019-05-20", Confidence: 0.5}
+	receiptId, err := store.StoreReceipt(ctx, testUserId, blobstore.NewLocalStore(storeDir), NewReceipt{
+		Filename:     "abc.jpg",
+		MimeType:     "image/jpeg",
+		PageCount:    1,
+		PurchaseDate: captured.Value,
+		Content:      []byte{0, 1, 0, 1},
+		Extracted:    []ExtractedField{captured},
+	})
+	if err != nil {
+		t.Fatalf("StoreReceipt() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		field    ExtractedField
+		wantDate string
+	}{
+		{"Less confident is ignored",
+			ExtractedField{Field: "purchase_date", Value: "2019-05-01", Confidence: 0.4},
+			"2019-05-20"},
+		{"More confident replaces",
+			ExtractedField{Field: "purchase_date", Value: "2019-05-14", Confidence: 0.9},
+			"2019-05-14"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fillExtractedFields(ctx, memDb, receiptId, []ExtractedField{tt.field})
+			if err != nil {
+				t.Fatalf("%s: fillExtractedFields() error = %v", tt.name, err)
+			}
+			got, _ := store.GetReceipt(ctx, testUserId, receiptId)
+			extracted, _ := store.GetExtractedFields(ctx, testUserId, receiptId)
+			if got.PurchaseDate != tt.wantDate ||
+				extracted["purchase_date"].Value != tt.wantDate {
+				t.Errorf("%s: purchase date = %s, extracted %v, want %s",
+					tt.name,
+					got.PurchaseDate,
+					extracted["purchase_date"],
+					tt.wantDate)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Migration files are named NNNN_description.sql and applied in the
+// order of their version numbers. Applied migrations must never be
+// edited, add a new one instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationNamePat = regexp.MustCompile(`^([0-9]+)_([a-z0-9_]+)\.sql$`)
+
+var errAlreadyApplied = errors.New("Migration already applied")
+
+const schemaVersionSql = `CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        name VARCHAR NOT NULL,
+        applied_at DATETIME NOT NULL
+);
+`
+
+type Migration struct {
+	Version int
+	Name    string
+	Sql     string
+}
+
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	paths, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(paths))
+	versions := make(map[int]string, len(paths))
+	for _, p := range paths {
+		matches := migrationNamePat.FindStringSubmatch(path.Base(p))
+		if matches == nil {
+			return nil, fmt.Errorf("malformed migration file name %s", p)
+		}
+		version, err := strconv.Atoi(matches[1])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("malformed migration version in %s", p)
+		}
+		if other, found := versions[version]; found {
+			return nil, fmt.Errorf("migrations %s and %s share version %d",
+				other,
+				p,
+				version)
+		}
+		versions[version] = p
+
+		content, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    matches[2],
+			Sql:     string(content),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// SchemaVersion returns the version of the latest applied migration,
+// zero for an empty database.
+func SchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	return schemaVersion(ctx, db)
+}
+
+func schemaVersion(ctx context.Context, db dbtx) (int, error) {
+	var tables int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master
+	WHERE type = 'table' AND name = 'schema_version';`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRowContext(ctx,
+		"SELECT IFNULL(MAX(version), 0) FROM schema_version;").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Migrate applies the embedded migrations newer than the database's
+// schema version and returns them. Each migration is applied in its own
+// transaction. In dry run mode all pending migrations are run inside one
+// transaction which is then rolled back, so they are validated without
+// touching the database.
+func Migrate(ctx context.Context, db *sql.DB, dryRun bool) ([]Migration, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	return migrate(ctx, db, migrations, dryRun)
+}
+
+func migrate(
+	ctx context.Context,
+	db *sql.DB,
+	migrations []Migration,
+	dryRun bool) ([]Migration, error) {
+	var dryRunTx *sql.Tx
+	if dryRun {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		dryRunTx = tx
+	}
+
+	applied := []Migration{}
+	for _, m := range migrations {
+		tx := dryRunTx
+		if tx == nil {
+			newTx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return applied, err
+			}
+			tx = newTx
+		}
+
+		err := applyMigration(ctx, tx, m)
+		if err == errAlreadyApplied {
+			if !dryRun {
+				tx.Rollback()
+			}
+			continue
+		}
+		if err == nil && !dryRun {
+			err = tx.Commit()
+		}
+		if err != nil {
+			if !dryRun {
+				tx.Rollback()
+			}
+			return applied, fmt.Errorf("migration %04d_%s failed: %v",
+				m.Version,
+				m.Name,
+				err)
+		}
+
+		applied = append(applied, m)
+		if dryRun {
+			log.Printf("Dry run: migration %04d_%s would be applied",
+				m.Version,
+				m.Name)
+		} else {
+			log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+		}
+	}
+	return applied, nil
+}
+
+func applyMigration(ctx context.Context, tx *sql.Tx, m Migration) error {
+	version, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if m.Version <= version {
+		return errAlreadyApplied
+	}
+
+	if _, err := tx.ExecContext(ctx, schemaVersionSql); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, m.Sql); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO schema_version(
+	version,
+	name,
+	applied_at
+) VALUES (
+	:version,
+	:name,
+	:applied_at);`,
+		sql.Named("version", m.Version),
+		sql.Named("name", m.Name),
+		sql.Named("applied_at", formatTimestamp(time.Now())),
+	)
+	return err
+}
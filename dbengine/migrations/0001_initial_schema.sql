@@ -0,0 +1,21 @@
+-- Databases created before migrations existed already have these tables
+CREATE TABLE IF NOT EXISTS receipt (
+        id INTEGER PRIMARY KEY,
+        filename VARCHAR NOT NULL,
+        purchase_date DATE,
+        expiry_date DATE,
+        ocr_text VARCHAR,
+        UNIQUE (filename)
+);
+CREATE TABLE IF NOT EXISTS tag (
+        id INTEGER PRIMARY KEY,
+        tag VARCHAR,
+        UNIQUE (tag)
+);
+CREATE TABLE IF NOT EXISTS receipt_tag_association (
+        id INTEGER PRIMARY KEY,
+        receipt_id INTEGER,
+        tag_id INTEGER,
+        FOREIGN KEY(receipt_id) REFERENCES receipt (id),
+        FOREIGN KEY(tag_id) REFERENCES tag (id)
+);
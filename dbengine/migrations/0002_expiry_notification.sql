@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS expiry_notification (
+        id INTEGER PRIMARY KEY,
+        receipt_id INTEGER NOT NULL,
+        lead_days INTEGER NOT NULL,
+        sent_at DATETIME NOT NULL,
+        FOREIGN KEY(receipt_id) REFERENCES receipt (id),
+        UNIQUE (receipt_id, lead_days)
+);
@@ -0,0 +1,5 @@
+-- Amount is stored in the currency's minor units, e.g. cents
+ALTER TABLE receipt ADD COLUMN amount INTEGER;
+ALTER TABLE receipt ADD COLUMN currency VARCHAR;
+ALTER TABLE receipt ADD COLUMN vendor VARCHAR;
+ALTER TABLE receipt ADD COLUMN payment_method VARCHAR;
@@ -0,0 +1,16 @@
+-- Status is one of pending, processing, done or failed
+CREATE TABLE ocr_job (
+        receipt_id INTEGER PRIMARY KEY,
+        status VARCHAR NOT NULL,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        error VARCHAR,
+        run_after DATETIME NOT NULL,
+        updated_at DATETIME NOT NULL,
+        FOREIGN KEY(receipt_id) REFERENCES receipt (id)
+);
+CREATE INDEX ocr_job_status_idx ON ocr_job (status, run_after);
+
+-- Receipts uploaded before OCR existed
+INSERT INTO ocr_job (receipt_id, status, run_after, updated_at)
+SELECT id, 'pending', datetime('now'), datetime('now')
+FROM receipt WHERE ocr_text IS NULL;
@@ -0,0 +1,9 @@
+-- Receipt details filled in from the OCR text instead of the user
+CREATE TABLE extracted_field (
+        receipt_id INTEGER NOT NULL,
+        field VARCHAR NOT NULL,
+        value VARCHAR NOT NULL,
+        confidence REAL NOT NULL,
+        PRIMARY KEY (receipt_id, field),
+        FOREIGN KEY(receipt_id) REFERENCES receipt (id)
+);
@@ -0,0 +1,9 @@
+-- Type detected from the content, older uploads trusted their extension
+ALTER TABLE receipt ADD COLUMN mime_type VARCHAR;
+UPDATE receipt SET mime_type = CASE lower(substr(filename, instr(filename, '.') + 1))
+        WHEN 'gif' THEN 'image/gif'
+        WHEN 'jpg' THEN 'image/jpeg'
+        WHEN 'jpeg' THEN 'image/jpeg'
+        WHEN 'png' THEN 'image/png'
+        WHEN 'tiff' THEN 'image/tiff'
+END;
@@ -0,0 +1,3 @@
+-- PDF receipts can have several pages, images always have one
+ALTER TABLE receipt ADD COLUMN page_count INTEGER;
+UPDATE receipt SET page_count = 1;
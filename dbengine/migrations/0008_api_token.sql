@@ -0,0 +1,10 @@
+-- Only a hash of each token is kept, the token itself is shown once.
+-- Scopes are space separated, e.g. "read write".
+CREATE TABLE api_token (
+        id INTEGER PRIMARY KEY,
+        name VARCHAR NOT NULL,
+        token_hash VARCHAR NOT NULL UNIQUE,
+        scopes VARCHAR NOT NULL,
+        created_at DATETIME NOT NULL,
+        revoked_at DATETIME
+);
@@ -0,0 +1,103 @@
+-- Receipts, tags and tokens from before users existed belong to the
+-- first user, which is created only when there is something to own
+CREATE TABLE user (
+        id INTEGER PRIMARY KEY,
+        name VARCHAR NOT NULL UNIQUE,
+        created_at DATETIME NOT NULL
+);
+INSERT INTO user (id, name, created_at)
+SELECT 1, 'owner', datetime('now')
+WHERE EXISTS (SELECT 1 FROM receipt)
+        OR EXISTS (SELECT 1 FROM tag)
+        OR EXISTS (SELECT 1 FROM api_token);
+
+-- The search triggers refer to the tables rebuilt below, the server
+-- creates them again and reindexes on start
+DROP TRIGGER IF EXISTS receipt_search_insert;
+DROP TRIGGER IF EXISTS receipt_search_update;
+DROP TRIGGER IF EXISTS receipt_search_delete;
+DROP TRIGGER IF EXISTS receipt_search_tag_insert;
+DROP TRIGGER IF EXISTS receipt_search_tag_delete;
+DROP TRIGGER IF EXISTS receipt_search_tag_rename;
+
+-- Filenames, i.e. hashes of the content, are unique per owner so that
+-- the same file can be uploaded by several users
+CREATE TABLE receipt_new (
+        id INTEGER PRIMARY KEY,
+        owner_id INTEGER NOT NULL,
+        filename VARCHAR NOT NULL,
+        mime_type VARCHAR,
+        page_count INTEGER,
+        purchase_date DATE,
+        expiry_date DATE,
+        ocr_text VARCHAR,
+        amount INTEGER,
+        currency VARCHAR,
+        vendor VARCHAR,
+        payment_method VARCHAR,
+        FOREIGN KEY(owner_id) REFERENCES user (id),
+        UNIQUE (owner_id, filename)
+);
+INSERT INTO receipt_new (
+        id,
+        owner_id,
+        filename,
+        mime_type,
+        page_count,
+        purchase_date,
+        expiry_date,
+        ocr_text,
+        amount,
+        currency,
+        vendor,
+        payment_method)
+SELECT
+        id,
+        1,
+        filename,
+        mime_type,
+        page_count,
+        purchase_date,
+        expiry_date,
+        ocr_text,
+        amount,
+        currency,
+        vendor,
+        payment_method
+FROM receipt;
+DROP TABLE receipt;
+ALTER TABLE receipt_new RENAME TO receipt;
+
+-- Each user has tags of their own
+CREATE TABLE tag_new (
+        id INTEGER PRIMARY KEY,
+        owner_id INTEGER NOT NULL,
+        tag VARCHAR,
+        FOREIGN KEY(owner_id) REFERENCES user (id),
+        UNIQUE (owner_id, tag)
+);
+INSERT INTO tag_new (id, owner_id, tag) SELECT id, 1, tag FROM tag;
+DROP TABLE tag;
+ALTER TABLE tag_new RENAME TO tag;
+
+ALTER TABLE api_token ADD COLUMN user_id INTEGER REFERENCES user (id);
+UPDATE api_token SET user_id = 1;
+
+-- Receipts shared with other users than the owner, either one by one or
+-- all the receipts having a tag
+CREATE TABLE receipt_share (
+        receipt_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        PRIMARY KEY (receipt_id, user_id),
+        FOREIGN KEY(receipt_id) REFERENCES receipt (id),
+        FOREIGN KEY(user_id) REFERENCES user (id)
+);
+CREATE INDEX receipt_share_user_idx ON receipt_share (user_id);
+CREATE TABLE tag_share (
+        tag_id INTEGER NOT NULL,
+        user_id INTEGER NOT NULL,
+        PRIMARY KEY (tag_id, user_id),
+        FOREIGN KEY(tag_id) REFERENCES tag (id),
+        FOREIGN KEY(user_id) REFERENCES user (id)
+);
+CREATE INDEX tag_share_user_idx ON tag_share (user_id);
@@ -0,0 +1,3 @@
+-- Expiry reminders are sent to the owner of each receipt, empty until
+-- the address is set.
+ALTER TABLE user ADD COLUMN email VARCHAR NOT NULL DEFAULT '';
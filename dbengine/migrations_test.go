@@ -0,0 +1,233 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"receiptstracker-api/config"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func migrationVersions(migrations []Migration) []int {
+	versions := make([]int, 0)
+	for _, m := range migrations {
+		versions = append(versions, m.Version)
+	}
+	return versions
+}
+
+func TestMigrate(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	all, err := loadMigrations(migrationFiles)
+	if err != nil || len(all) == 0 {
+		t.Fatalf("loadMigrations() = %v, %v", all, err)
+	}
+	latest := all[len(all)-1].Version
+
+	// Dry run reports everything but leaves the database untouched
+	pending, err := Migrate(ctx, memDb, true)
+	if err != nil || len(pending) != len(all) {
+		t.Errorf("Migrate() dry run = %v, %v, want %v",
+			migrationVersions(pending),
+			err,
+			migrationVersions(all))
+	}
+	var tables int
+	memDb.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table';").Scan(&tables)
+	if tables != 0 {
+		t.Errorf("Migrate() dry run created %d tables", tables)
+	}
+
+	applied, err := Migrate(ctx, memDb, false)
+	if err != nil || len(applied) != len(all) {
+		t.Errorf("Migrate() = %v, %v, want %v",
+			migrationVersions(applied),
+			err,
+			migrationVersions(all))
+	}
+	if version, _ := SchemaVersion(ctx, memDb); version != latest {
+		t.Errorf("SchemaVersion() = %d, want %d", version, latest)
+	}
+
+	// Nothing left to do
+	applied, err = Migrate(ctx, memDb, false)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("Migrate() second run = %v, %v, want none",
+			migrationVersions(applied),
+			err)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	// Schema as created by CreateSchema before migrations existed
+	_, err := memDb.Exec(`CREATE TABLE receipt (
+        id INTEGER PRIMARY KEY,
+        filename VARCHAR NOT NULL,
+        purchase_date DATE,
+        expiry_date DATE,
+        ocr_text VARCHAR,
+        UNIQUE (filename)
+);
+CREATE TABLE tag (
+        id INTEGER PRIMARY KEY,
+        tag VARCHAR,
+        UNIQUE (tag)
+);
+CREATE TABLE receipt_tag_association (
+        id INTEGER PRIMARY KEY,
+        receipt_id INTEGER,
+        tag_id INTEGER
+);
+INSERT INTO receipt (filename, purchase_date, expiry_date)
+	VALUES ('a.jpg', '2019-05-15', '2021-05-15');`)
+	if err != nil {
+		log.Fatalf("Unexpected error on legacy schema: %v", err)
+	}
+
+	if _, err := Migrate(ctx, memDb, false); err != nil {
+		t.Fatalf("Migrate() on legacy database error = %v", err)
+	}
+	var filename, owner string
+	memDb.QueryRow(`SELECT r.filename, u.name FROM receipt r
+	JOIN user u ON u.id = r.owner_id WHERE r.id = 1;`).Scan(&filename, &owner)
+	if filename != "a.jpg" {
+		t.Errorf("Migrate() lost existing receipts")
+	}
+	if owner != "owner" {
+		t.Errorf("Migrate() gave existing receipts to %q, want the first user", owner)
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	migrations := []Migration{
+		{1, "first", "CREATE TABLE first (id INTEGER PRIMARY KEY);"},
+		{2, "broken", "CREATE TABLE second (id INTEGER PRIMARY KEY); NOT SQL;"},
+		{3, "third", "CREATE TABLE third (id INTEGER PRIMARY KEY);"},
+	}
+	applied, err := migrate(ctx, memDb, migrations, false)
+	if err == nil {
+		t.Errorf("migrate() succeeded with a broken migration")
+	}
+	if len(applied) != 1 || applied[0].Version != 1 {
+		t.Errorf("migrate() applied %v, want [1]", migrationVersions(applied))
+	}
+	if version, _ := SchemaVersion(ctx, memDb); version != 1 {
+		t.Errorf("SchemaVersion() = %d, want 1", version)
+	}
+	var tables int
+	memDb.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+	WHERE type = 'table' AND name IN ('second', 'third');`).Scan(&tables)
+	if tables != 0 {
+		t.Errorf("migrate() left %d tables of failed migrations", tables)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		want    []int
+		wantErr bool
+	}{
+		{
+			"Ordered by version",
+			fstest.MapFS{
+				"migrations/0010_later.sql":  {Data: []byte("SELECT 1;")},
+				"migrations/0002_second.sql": {Data: []byte("SELECT 1;")},
+				"migrations/0001_first.sql":  {Data: []byte("SELECT 1;")},
+			},
+			[]int{1, 2, 10},
+			false,
+		},
+		{
+			"Malformed name",
+			fstest.MapFS{
+				"migrations/first.sql": {Data: []byte("SELECT 1;")},
+			},
+			nil,
+			true,
+		},
+		{
+			"Duplicate version",
+			fstest.MapFS{
+				"migrations/0001_first.sql": {Data: []byte("SELECT 1;")},
+				"migrations/1_other.sql":    {Data: []byte("SELECT 1;")},
+			},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadMigrations(tt.fsys)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: loadMigrations() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			versions := migrationVersions(got)
+			if !reflect.DeepEqual(versions, tt.want) {
+				t.Errorf("%s: loadMigrations() = %v, want %v",
+					tt.name,
+					versions,
+					tt.want)
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbengine")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := Open(config.DatabaseConfig{
+		Path:        filepath.Join(dir, "receipts.db"),
+		BusyTimeout: 3 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer store.Close()
+
+	var timeout int
+	store.db.QueryRow("PRAGMA busy_timeout;").Scan(&timeout)
+	if timeout != 3000 {
+		t.Errorf("Open() busy_timeout = %d, want 3000", timeout)
+	}
+	if version, _ := SchemaVersion(context.Background(), store.db); version == 0 {
+		t.Errorf("Open() left schema version at 0")
+	}
+}
@@ -0,0 +1,65 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// GetExpiringReceipts returns the receipts of the owner expiring within
+// leadDays from today which haven't yet got a reminder with the same or a shorter lead
+// time. Checking the shorter lead times too keeps a late started server
+// from sending the 30 day reminder after the 7 day one.
+func (s *Store) GetExpiringReceipts(
+	ctx context.Context,
+	ownerId int64,
+	today time.Time,
+	leadDays int) ([]Receipt, error) {
+	rows, err := s.db.QueryContext(ctx, receiptSelectSql+`WHERE
+	r.owner_id = ?
+	AND r.expiry_date <> ''
+	AND r.expiry_date >= ?
+	AND r.expiry_date <= ?
+	AND r.id NOT IN (
+		SELECT receipt_id FROM expiry_notification WHERE lead_days <= ?)
+GROUP BY r.id ORDER BY r.expiry_date, r.id;`,
+		ownerId,
+		today.Format("2006-01-02"),
+		today.AddDate(0, 0, leadDays).Format("2006-01-02"),
+		leadDays)
+	if err != nil {
+		log.Printf("ERROR: querying expiring receipts failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanReceipts(rows)
+}
+
+func (s *Store) MarkNotificationSent(
+	ctx context.Context,
+	receiptId int64,
+	leadDays int,
+	sentAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT OR IGNORE INTO expiry_notification(
+	receipt_id,
+	lead_days,
+	sent_at
+) VALUES (
+	:receipt_id,
+	:lead_days,
+	:sent_at);`,
+		sql.Named("receipt_id", receiptId),
+		sql.Named("lead_days", leadDays),
+		sql.Named("sent_at", formatTimestamp(sentAt)),
+	)
+	if err != nil {
+		log.Printf("ERROR: marking notification sent for receipt %d failed: %v",
+			receiptId,
+			err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+const (
+	OCR_PENDING    string = "pending"
+	OCR_PROCESSING string = "processing"
+	OCR_DONE       string = "done"
+	OCR_FAILED     string = "failed"
+)
+
+// OcrJob is a receipt file waiting for text recognition
+type OcrJob struct {
+	ReceiptId int64
+	OwnerId   int64
+	Filename  string
+	Attempts  int
+}
+
+func insertOcrJob(ctx context.Context, db dbtx, receiptId int64) error {
+	now := formatTimestamp(time.Now())
+	_, err := db.ExecContext(ctx, `
+INSERT OR REPLACE INTO ocr_job(
+	receipt_id,
+	status,
+	attempts,
+	run_after,
+	updated_at
+) VALUES (
+	:receipt_id,
+	:status,
+	0,
+	:now,
+	:now);`,
+		sql.Named("receipt_id", receiptId),
+		sql.Named("status", OCR_PENDING),
+		sql.Named("now", now),
+	)
+	if err != nil {
+		log.Printf("ERROR: inserting OCR job for receipt %d failed: %v",
+			receiptId,
+			err)
+		return err
+	}
+	return nil
+}
+
+// ResetInterruptedOcrJobs puts jobs which were being processed when
+// the server stopped back into the queue.
+func (s *Store) ResetInterruptedOcrJobs(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE ocr_job SET status = ?, updated_at = ? WHERE status = ?;",
+		OCR_PENDING,
+		formatTimestamp(time.Now()),
+		OCR_PROCESSING)
+	if err != nil {
+		log.Printf("ERROR: resetting interrupted OCR jobs failed: %v", err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ClaimOcrJobs marks at most limit pending jobs due by now as being
+// processed and returns them. With pdfOnly the jobs of images are left
+// pending, e.g. while there is no OCR engine for them.
+func (s *Store) ClaimOcrJobs(
+	ctx context.Context,
+	now time.Time,
+	limit int,
+	pdfOnly bool) ([]OcrJob, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("ERROR: beginning transaction failed: %v", err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT j.receipt_id, r.owner_id, r.filename, j.attempts
+FROM ocr_job j
+JOIN receipt r ON r.id = j.receipt_id
+WHERE j.status = ? AND j.run_after <= ?
+	AND (? = 0 OR lower(r.filename) LIKE '%.pdf')
+ORDER BY j.run_after, j.receipt_id
+LIMIT ?;`,
+		OCR_PENDING,
+		formatTimestamp(now),
+		pdfOnly,
+		limit)
+	if err != nil {
+		log.Printf("ERROR: querying pending OCR jobs failed: %v", err)
+		return nil, err
+	}
+	jobs := make([]OcrJob, 0)
+	for rows.Next() {
+		var job OcrJob
+		if err := rows.Scan(&job.ReceiptId, &job.OwnerId, &job.Filename, &job.Attempts); err != nil {
+			rows.Close()
+			log.Printf("ERROR: failed to scan OCR job: %v", err)
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		_, err := tx.ExecContext(ctx,
+			"UPDATE ocr_job SET status = ?, updated_at = ? WHERE receipt_id = ?;",
+			OCR_PROCESSING,
+			formatTimestamp(now),
+			job.ReceiptId)
+		if err != nil {
+			log.Printf("ERROR: claiming OCR job %d failed: %v",
+				job.ReceiptId,
+				err)
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("ERROR: committing claimed OCR jobs failed: %v", err)
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// CompleteOcrJob stores the recognised text into the receipt together
+// with the details extracted from it.
+func (s *Store) CompleteOcrJob(
+	ctx context.Context,
+	receiptId int64,
+	text string,
+	fields []ExtractedField) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("ERROR: beginning transaction failed: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE receipt SET ocr_text = ? WHERE id = ?;",
+		text,
+		receiptId)
+	if err != nil {
+		log.Printf("ERROR: storing OCR text of receipt %d failed: %v",
+			receiptId,
+			err)
+		return err
+	}
+	if err := fillExtractedFields(ctx, tx, receiptId, fields); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE ocr_job SET
+	status = ?,
+	attempts = attempts + 1,
+	error = NULL,
+	updated_at = ?
+WHERE receipt_id = ?;`,
+		OCR_DONE,
+		formatTimestamp(time.Now()),
+		receiptId)
+	if err != nil {
+		log.Printf("ERROR: completing OCR job %d failed: %v", receiptId, err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// FailOcrJob puts the job back into the queue to be retried after
+// retryAt, or gives up on it once maxAttempts has been reached.
+func (s *Store) FailOcrJob(
+	ctx context.Context,
+	receiptId int64,
+	jobErr error,
+	retryAt time.Time,
+	maxAttempts int) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE ocr_job SET
+	status = CASE WHEN attempts + 1 >= :max_attempts THEN :failed ELSE :pending END,
+	attempts = attempts + 1,
+	error = :error,
+	run_after = :run_after,
+	updated_at = :now
+WHERE receipt_id = :receipt_id;`,
+		sql.Named("max_attempts", maxAttempts),
+		sql.Named("failed", OCR_FAILED),
+		sql.Named("pending", OCR_PENDING),
+		sql.Named("error", jobErr.Error()),
+		sql.Named("run_after", formatTimestamp(retryAt)),
+		sql.Named("now", formatTimestamp(time.Now())),
+		sql.Named("receipt_id", receiptId),
+	)
+	if err != nil {
+		log.Printf("ERROR: marking OCR job %d failed: %v", receiptId, err)
+		return err
+	}
+	return nil
+}
+
+// GetOcrJobStatus returns sql.ErrNoRows when the receipt has no job
+func (s *Store) GetOcrJobStatus(ctx context.Context, receiptId int64) (string, error) {
+	var status string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT status FROM ocr_job WHERE receipt_id = ?;",
+		receiptId).Scan(&status)
+	return status, err
+}
@@ -0,0 +1,116 @@
+package dbengine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ReceiptFilter narrows down receipt listings. The zero value matches
+// every receipt the user can see.
+type ReceiptFilter struct {
+	// Tags the receipt must have. With MatchAllTags every tag is
+	// required, otherwise any one of them is enough.
+	Tags         []string
+	MatchAllTags bool
+	// ExcludedTags rule out receipts having any of these.
+	ExcludedTags []string
+	// Dates are in YYYY-MM-DD format. After bounds are inclusive and
+	// before bounds exclusive so consecutive ranges don't overlap.
+	PurchasedAfter  string
+	PurchasedBefore string
+	ExpiresAfter    string
+	ExpiresBefore   string
+	// Expired compares expiry date against the current date when set.
+	// Receipts without expiry date never match.
+	Expired *bool
+	// HasAmount leaves out receipts without a known amount
+	HasAmount bool
+}
+
+// inClause builds "(?,?,...)" for the given tags in the same way as
+// getTagsIds does.
+func inClause(tags []string) (string, []interface{}) {
+	rawSql := "("
+	values := []interface{}{}
+
+	for _, tag := range tags {
+		rawSql += "?,"
+		values = append(values, tag)
+	}
+	// Remove comma postfix
+	rawSql = rawSql[0 : len(rawSql)-1]
+	rawSql += ")"
+	return rawSql, values
+}
+
+// receiptIdsByTagsSql matches only the user's own tags and the ones
+// shared with them, the same name of another user being another tag.
+// The user ID comes twice before the tags.
+const receiptIdsByTagsSql = `SELECT fa.receipt_id
+	FROM receipt_tag_association fa
+	JOIN tag ft ON ft.id = fa.tag_id
+	WHERE (ft.owner_id = ?
+		OR ft.id IN (SELECT tag_id FROM tag_share WHERE user_id = ?))
+	AND ft.tag IN `
+
+// whereSql returns the WHERE clause matching the filter among the
+// receipts visible to the user with the values for its placeholders.
+func (f ReceiptFilter) whereSql(userId int64) (string, []interface{}) {
+	conditions := []string{"r.id IN (" + visibleReceiptIds("?") + ")"}
+	values := []interface{}{userId, userId, userId}
+
+	if len(f.Tags) > 0 {
+		tagsIn, tagValues := inClause(f.Tags)
+		condition := "r.id IN (" + receiptIdsByTagsSql + tagsIn
+		if f.MatchAllTags {
+			condition += " GROUP BY fa.receipt_id HAVING COUNT(DISTINCT ft.id) = ?"
+			tagValues = append(tagValues, len(f.Tags))
+		}
+		conditions = append(conditions, condition+")")
+		values = append(values, userId, userId)
+		values = append(values, tagValues...)
+	}
+	if len(f.ExcludedTags) > 0 {
+		tagsIn, tagValues := inClause(f.ExcludedTags)
+		conditions = append(conditions,
+			"r.id NOT IN ("+receiptIdsByTagsSql+tagsIn+")")
+		values = append(values, userId, userId)
+		values = append(values, tagValues...)
+	}
+
+	dateConditions := []struct {
+		column   string
+		operator string
+		value    string
+	}{
+		{"r.purchase_date", ">=", f.PurchasedAfter},
+		{"r.purchase_date", "<", f.PurchasedBefore},
+		{"r.expiry_date", ">=", f.ExpiresAfter},
+		{"r.expiry_date", "<", f.ExpiresBefore},
+	}
+	for _, dc := range dateConditions {
+		if dc.value == "" {
+			continue
+		}
+		// Receipts without dates are stored with empty strings
+		conditions = append(conditions, fmt.Sprintf("(%s %s ? AND %s <> '')",
+			dc.column,
+			dc.operator,
+			dc.column))
+		values = append(values, dc.value)
+	}
+	if f.Expired != nil {
+		condition := "r.expiry_date >= date('now', 'localtime')"
+		if *f.Expired {
+			condition = "r.expiry_date < date('now', 'localtime')"
+		}
+		conditions = append(conditions,
+			"("+condition+" AND r.expiry_date <> '')")
+	}
+
+	if f.HasAmount {
+		conditions = append(conditions, "r.amount IS NOT NULL")
+	}
+
+	return "WHERE " + strings.Join(conditions, " AND ") + "\n", values
+}
@@ -0,0 +1,414 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"receiptstracker-api/blobstore"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrReceiptNotFound = errors.New("Receipt not found")
+	ErrReceiptExists   = errors.New("Receipt already archived")
+)
+
+// PurchaseDetails tells what was paid and where. Amount is in the
+// currency's minor units, e.g. cents, and nil when unknown.
+type PurchaseDetails struct {
+	Amount        *int64 `json:"amount,omitempty"`
+	Currency      string `json:"currency,omitempty"`
+	Vendor        string `json:"vendor,omitempty"`
+	PaymentMethod string `json:"payment_method,omitempty"`
+}
+
+// Receipt is a row of the receipt table together with its tags. The
+// tags are the owner's, who may be another user than the one reading.
+type Receipt struct {
+	Id           int64    `json:"id"`
+	OwnerId      int64    `json:"owner_id"`
+	Filename     string   `json:"filename"`
+	MimeType     string   `json:"mime_type,omitempty"`
+	PageCount    int      `json:"page_count,omitempty"`
+	PurchaseDate string   `json:"purchase_date,omitempty"`
+	ExpiryDate   string   `json:"expiry_date,omitempty"`
+	Tags         []string `json:"tags"`
+	PurchaseDetails
+}
+
+// Tags are joined with a space since NormaliseTags never lets
+// whitespace through into a single tag.
+const receiptColumnsSql = `
+	r.id,
+	r.owner_id,
+	r.filename,
+	IFNULL(r.mime_type, ''),
+	IFNULL(r.page_count, 0),
+	IFNULL(r.purchase_date, ''),
+	IFNULL(r.expiry_date, ''),
+	IFNULL(GROUP_CONCAT(t.tag, ' '), ''),
+	r.amount,
+	IFNULL(r.currency, ''),
+	IFNULL(r.vendor, ''),
+	IFNULL(r.payment_method, '')`
+
+const receiptTagJoinSql = `
+LEFT JOIN receipt_tag_association rta ON rta.receipt_id = r.id
+LEFT JOIN tag t ON t.id = rta.tag_id
+`
+
+const receiptSelectSql = "SELECT" + receiptColumnsSql + `
+FROM receipt r` + receiptTagJoinSql
+
+func scanReceipts(rows *sql.Rows) ([]Receipt, error) {
+	receipts := make([]Receipt, 0)
+	for rows.Next() {
+		receipt, err := scanReceiptRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("ERROR: iterating receipt rows failed: %v", err)
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// scanReceiptRow scans the columns of receiptSelectSql followed by
+// the extra columns the query has selected.
+func scanReceiptRow(rows *sql.Rows, extra ...interface{}) (Receipt, error) {
+	var receipt Receipt
+	var tags string
+	var amount sql.NullInt64
+	dest := []interface{}{
+		&receipt.Id,
+		&receipt.OwnerId,
+		&receipt.Filename,
+		&receipt.MimeType,
+		&receipt.PageCount,
+		&receipt.PurchaseDate,
+		&receipt.ExpiryDate,
+		&tags,
+		&amount,
+		&receipt.Currency,
+		&receipt.Vendor,
+		&receipt.PaymentMethod,
+	}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		log.Printf("ERROR: failed to scan receipt row: %v", err)
+		return receipt, err
+	}
+	receipt.Tags = splitTags(tags)
+	if amount.Valid {
+		receipt.Amount = &amount.Int64
+	}
+	return receipt, nil
+}
+
+func splitTags(tags string) []string {
+	splitted := strings.Fields(tags)
+	sort.Strings(splitted)
+	return splitted
+}
+
+// GetReceipts returns the receipts visible to the user matching the
+// filter ordered from the newest to the oldest.
+func (s *Store) GetReceipts(
+	ctx context.Context,
+	userId int64,
+	filter ReceiptFilter,
+	limit int,
+	offset int) ([]Receipt, error) {
+	whereSql, values := filter.whereSql(userId)
+	values = append(values, limit, offset)
+
+	rows, err := s.db.QueryContext(ctx,
+		receiptSelectSql+whereSql+
+			"GROUP BY r.id ORDER BY r.id DESC LIMIT ? OFFSET ?;",
+		values...)
+	if err != nil {
+		log.Printf("ERROR: querying receipts failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanReceipts(rows)
+}
+
+func (s *Store) CountReceipts(
+	ctx context.Context,
+	userId int64,
+	filter ReceiptFilter) (int64, error) {
+	whereSql, values := filter.whereSql(userId)
+
+	var count int64
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM receipt r "+whereSql+";",
+		values...).Scan(&count)
+	if err != nil {
+		log.Printf("ERROR: counting receipts failed: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
+
+// GetReceipt returns ErrReceiptNotFound when there is no receipt
+// with the given ID visible to the user.
+func (s *Store) GetReceipt(
+	ctx context.Context,
+	userId int64,
+	receiptId int64) (*Receipt, error) {
+	rows, err := s.db.QueryContext(ctx,
+		receiptSelectSql+"WHERE r.id = ? AND r.id IN ("+visibleReceiptIds("?")+`)
+GROUP BY r.id;`,
+		receiptId,
+		userId,
+		userId,
+		userId)
+	if err != nil {
+		log.Printf("ERROR: querying receipt %d failed: %v", receiptId, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipts, err := scanReceipts(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(receipts) == 0 {
+		return nil, ErrReceiptNotFound
+	}
+	return &receipts[0], nil
+}
+
+// DeleteReceipt removes the user's receipt with its tag associations,
+// shares, sent notifications and tags no other receipt uses anymore.
+// The file is removed from the store after the transaction has been
+// committed unless a receipt of another user still has it, both under
+// the lock of the file so that the same file isn't stored meanwhile.
+// Filename of the removed file is returned, empty when the file was
+// kept. A file left behind by a failed removal is merely logged since
+// uploading the same receipt again would reuse it.
+func (s *Store) DeleteReceipt(
+	ctx context.Context,
+	userId int64,
+	store blobstore.BlobStore,
+	receiptId int64) (string, error) {
+	// Files of receipts never change, so the lock can be taken before
+	// the transaction
+	filename, err := s.receiptFilename(ctx, userId, receiptId)
+	if err != nil {
+		return "", err
+	}
+	unlock := s.files.lock(filename)
+	defer unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("ERROR: beginning transaction failed: %v", err)
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Receipt may have been deleted before the lock was taken
+	if err := checkOwner(ctx, tx, userId, receiptId); err != nil {
+		return "", err
+	}
+	deletes := []string{
+		"DELETE FROM receipt_tag_association WHERE receipt_id = ?;",
+		"DELETE FROM receipt_share WHERE receipt_id = ?;",
+		"DELETE FROM expiry_notification WHERE receipt_id = ?;",
+		"DELETE FROM ocr_job WHERE receipt_id = ?;",
+		"DELETE FROM extracted_field WHERE receipt_id = ?;",
+		"DELETE FROM receipt WHERE id = ?;",
+	}
+	for _, rawSql := range deletes {
+		if _, err := tx.ExecContext(ctx, rawSql, receiptId); err != nil {
+			log.Printf("ERROR: deleting receipt %d failed: %v", receiptId, err)
+			return "", err
+		}
+	}
+	if err := deleteOrphanedTags(ctx, tx); err != nil {
+		return "", err
+	}
+	fileUsers, err := countFileReceipts(ctx, tx, filename)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("ERROR: committing receipt %d deletion failed: %v",
+			receiptId,
+			err)
+		return "", err
+	}
+	if fileUsers > 0 {
+		return "", nil
+	}
+	// Request may have been cancelled, the file must go regardless
+	if err := store.Delete(context.Background(), filename); err != nil {
+		log.Printf("ERROR: removing file %s of deleted receipt %d failed: %v",
+			filename,
+			receiptId,
+			err)
+	}
+	return filename, nil
+}
+
+// receiptFilename returns the file of the user's own receipt
+func (s *Store) receiptFilename(
+	ctx context.Context,
+	userId int64,
+	receiptId int64) (string, error) {
+	if err := checkOwner(ctx, s.db, userId, receiptId); err != nil {
+		return "", err
+	}
+	var filename string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT filename FROM receipt WHERE id = ?;",
+		receiptId).Scan(&filename)
+	if err == sql.ErrNoRows {
+		return "", ErrReceiptNotFound
+	}
+	if err != nil {
+		log.Printf("ERROR: querying receipt %d failed: %v", receiptId, err)
+		return "", err
+	}
+	return filename, nil
+}
+
+// ReceiptUpdate describes changes to a receipt. Nil dates are left
+// untouched and empty strings clear them.
+type ReceiptUpdate struct {
+	PurchaseDate *string
+	ExpiryDate   *string
+	AddTags      []string
+	RemoveTags   []string
+}
+
+// UpdateReceipt applies the update to an existing receipt of the user in
+// a single transaction. Tags the receipt already has are not associated
+// again.
+func (s *Store) UpdateReceipt(
+	ctx context.Context,
+	userId int64,
+	receiptId int64,
+	update ReceiptUpdate) error {
+	if err := checkOwner(ctx, s.db, userId, receiptId); err != nil {
+		return err
+	}
+	receipt, err := s.GetReceipt(ctx, userId, receiptId)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("ERROR: beginning transaction failed: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if update.PurchaseDate != nil || update.ExpiryDate != nil {
+		purchaseDate := receipt.PurchaseDate
+		if update.PurchaseDate != nil {
+			purchaseDate = *update.PurchaseDate
+		}
+		expiryDate := receipt.ExpiryDate
+		if update.ExpiryDate != nil {
+			expiryDate = *update.ExpiryDate
+		}
+		_, err := tx.ExecContext(ctx, `
+UPDATE receipt SET
+	purchase_date = :purchase_date,
+	expiry_date = :expiry_date
+WHERE id = :id;`,
+			sql.Named("purchase_date", purchaseDate),
+			sql.Named("expiry_date", expiryDate),
+			sql.Named("id", receiptId),
+		)
+		if err != nil {
+			log.Printf("ERROR: updating dates of receipt %d failed: %v",
+				receiptId,
+				err)
+			return err
+		}
+	}
+	if update.PurchaseDate != nil {
+		// The user has now given the date
+		_, err := tx.ExecContext(ctx,
+			"DELETE FROM extracted_field WHERE receipt_id = ? AND field = 'purchase_date';",
+			receiptId)
+		if err != nil {
+			log.Printf("ERROR: removing extracted date of receipt %d failed: %v",
+				receiptId,
+				err)
+			return err
+		}
+	}
+
+	existingTags := make(map[string]bool, len(receipt.Tags))
+	for _, tag := range receipt.Tags {
+		existingTags[tag] = true
+	}
+	newTags := []string{}
+	for _, tag := range update.AddTags {
+		if !existingTags[tag] {
+			newTags = append(newTags, tag)
+		}
+	}
+	if err := insertTags(ctx, tx, userId, newTags); err != nil {
+		return err
+	}
+	if _, err := insertReceiptTagAssociation(ctx, tx, userId, receiptId, newTags); err != nil {
+		return err
+	}
+
+	if len(update.RemoveTags) > 0 {
+		tagsIn, values := inClause(update.RemoveTags)
+		values = append([]interface{}{receiptId, userId}, values...)
+		_, err := tx.ExecContext(ctx, `
+DELETE FROM receipt_tag_association WHERE receipt_id = ? AND tag_id IN (
+	SELECT id FROM tag WHERE owner_id = ? AND tag IN `+tagsIn+`);`,
+			values...)
+		if err != nil {
+			log.Printf("ERROR: removing tags of receipt %d failed: %v",
+				receiptId,
+				err)
+			return err
+		}
+		if err := deleteOrphanedTags(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("ERROR: committing update of receipt %d failed: %v",
+			receiptId,
+			err)
+		return err
+	}
+	return nil
+}
+
+// deleteOrphanedTags removes tags no receipt uses anymore together with
+// their shares, so a tag added again later isn't shared by accident.
+func deleteOrphanedTags(ctx context.Context, db dbtx) error {
+	const orphanedSql = `SELECT id FROM tag WHERE id NOT IN (
+	SELECT tag_id FROM receipt_tag_association WHERE tag_id IS NOT NULL)`
+	deletes := []string{
+		"DELETE FROM tag_share WHERE tag_id IN (" + orphanedSql + ");",
+		"DELETE FROM tag WHERE id IN (" + orphanedSql + ");",
+	}
+	for _, rawSql := range deletes {
+		if _, err := db.ExecContext(ctx, rawSql); err != nil {
+			log.Printf("ERROR: deleting orphaned tags failed: %v", err)
+			return err
+		}
+	}
+	return nil
+}
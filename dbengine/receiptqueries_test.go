@@ -0,0 +1,475 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"receiptstracker-api/blobstore"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The receipts and tags of the fixtures belong to this user
+const testUserId int64 = 1
+
+func populateReceipts(db *sql.DB) {
+	_, err := db.Exec(`
+INSERT INTO receipt (owner_id, filename, purchase_date, expiry_date, amount, currency, vendor, payment_method) VALUES
+	(1, 'a.jpg', '2019-05-15', '2021-05-15', 129900, 'EUR', 'Computer Shop', 'card');
+INSERT INTO receipt (owner_id, filename, purchase_date, expiry_date) VALUES
+	(1, 'b.png', '', ''),
+	(1, 'c.gif', '2020-01-02', NULL);
+INSERT INTO tag (owner_id, tag) VALUES (1, 'computershop'), (1, 'laptop'), (1, 'food');
+INSERT INTO receipt_tag_association (receipt_id, tag_id) VALUES
+	(1, 2), (1, 1), (3, 3);`)
+	if err != nil {
+		log.Fatalf("Unexpected error on SQL INSERT: %v", err)
+	}
+}
+
+func laptopDetails() PurchaseDetails {
+	amount := int64(129900)
+	return PurchaseDetails{&amount, "EUR", "Computer Shop", "card"}
+}
+
+func TestGetReceipts(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+	populateReceipts(memDb)
+
+	type args struct {
+		ctx    context.Context
+		limit  int
+		offset int
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    []Receipt
+		wantErr bool
+	}{
+		{
+			"All receipts newest first",
+			args{ctx, 10, 0},
+			[]Receipt{
+				{3, testUserId, "c.gif", "", 0, "2020-01-02", "", []string{"food"}, PurchaseDetails{}},
+				{2, testUserId, "b.png", "", 0, "", "", []string{}, PurchaseDetails{}},
+				{1, testUserId, "a.jpg", "", 0, "2019-05-15", "2021-05-15",
+					[]string{"computershop", "laptop"}, laptopDetails()},
+			},
+			false,
+		},
+		{
+			"Second page",
+			args{ctx, 2, 2},
+			[]Receipt{
+				{1, testUserId, "a.jpg", "", 0, "2019-05-15", "2021-05-15",
+					[]string{"computershop", "laptop"}, laptopDetails()},
+			},
+			false,
+		},
+		{
+			"Past the end",
+			args{ctx, 2, 10},
+			[]Receipt{},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.GetReceipts(tt.args.ctx, testUserId, ReceiptFilter{}, tt.args.limit, tt.args.offset)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: GetReceipts() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: GetReceipts() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+
+	count, err := store.CountReceipts(ctx, testUserId, ReceiptFilter{})
+	if err != nil || count != 3 {
+		t.Errorf("CountReceipts() = %d, %v, want 3", count, err)
+	}
+}
+
+func TestGetReceiptsFiltered(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+	populateReceipts(memDb)
+	_, err := memDb.Exec(`INSERT INTO receipt (owner_id, filename, purchase_date, expiry_date)
+	VALUES (1, 'd.jpg', '2020-06-01', '2999-01-01');`)
+	if err != nil {
+		log.Fatalf("Unexpected error on SQL INSERT: %v", err)
+	}
+	expired := true
+	notExpired := false
+
+	tests := []struct {
+		name    string
+		filter  ReceiptFilter
+		wantIds []int64
+	}{
+		{
+			"All tags required",
+			ReceiptFilter{
+				Tags:         []string{"laptop", "computershop"},
+				MatchAllTags: true,
+			},
+			[]int64{1},
+		},
+		{
+			"All tags required but one is missing",
+			ReceiptFilter{
+				Tags:         []string{"laptop", "food"},
+				MatchAllTags: true,
+			},
+			[]int64{},
+		},
+		{
+			"Any tag",
+			ReceiptFilter{Tags: []string{"laptop", "food"}},
+			[]int64{3, 1},
+		},
+		{
+			"Any tag but excluded",
+			ReceiptFilter{
+				Tags:         []string{"laptop", "food"},
+				ExcludedTags: []string{"computershop"},
+			},
+			[]int64{3},
+		},
+		{
+			"Only excluded",
+			ReceiptFilter{ExcludedTags: []string{"food"}},
+			[]int64{4, 2, 1},
+		},
+		{
+			"Purchased in 2020",
+			ReceiptFilter{
+				PurchasedAfter:  "2020-01-01",
+				PurchasedBefore: "2021-01-01",
+			},
+			[]int64{4, 3},
+		},
+		{
+			"Purchase date upper bound is exclusive",
+			ReceiptFilter{PurchasedBefore: "2020-01-02"},
+			[]int64{1},
+		},
+		{
+			"Expires before",
+			ReceiptFilter{ExpiresBefore: "2030-01-01"},
+			[]int64{1},
+		},
+		{
+			"Expires after",
+			ReceiptFilter{ExpiresAfter: "2021-05-15"},
+			[]int64{4, 1},
+		},
+		{
+			"Expired",
+			ReceiptFilter{Expired: &expired},
+			[]int64{1},
+		},
+		{
+			"Not expired",
+			ReceiptFilter{Expired: &notExpired},
+			[]int64{4},
+		},
+		{
+			"Tags and dates combined",
+			ReceiptFilter{
+				Tags:           []string{"laptop"},
+				PurchasedAfter: "2020-01-01",
+			},
+			[]int64{},
+		},
+		{
+			"SQL in a tag is just a tag",
+			ReceiptFilter{Tags: []string{"') OR 1=1 --"}},
+			[]int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.GetReceipts(ctx, testUserId, tt.filter, 10, 0)
+			if err != nil {
+				t.Errorf("%s: GetReceipts() error = %v", tt.name, err)
+				return
+			}
+			gotIds := make([]int64, 0)
+			for _, receipt := range got {
+				gotIds = append(gotIds, receipt.Id)
+			}
+			if !reflect.DeepEqual(gotIds, tt.wantIds) {
+				t.Errorf("%s: GetReceipts() ids = %v, want %v",
+					tt.name,
+					gotIds,
+					tt.wantIds)
+			}
+
+			count, err := store.CountReceipts(ctx, testUserId, tt.filter)
+			if err != nil || count != int64(len(tt.wantIds)) {
+				t.Errorf("%s: CountReceipts() = %d, %v, want %d",
+					tt.name,
+					count,
+					err,
+					len(tt.wantIds))
+			}
+		})
+	}
+}
+
+func TestGetReceipt(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+	populateReceipts(memDb)
+
+	type args struct {
+		ctx       context.Context
+		receiptId int64
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    *Receipt
+		wantErr error
+	}{
+		{
+			"Existing receipt",
+			args{ctx, 1},
+			&Receipt{1, testUserId, "a.jpg", "", 0, "2019-05-15", "2021-05-15",
+				[]string{"computershop", "laptop"}, laptopDetails()},
+			nil,
+		},
+		{
+			"Missing receipt",
+			args{ctx, 42},
+			nil,
+			ErrReceiptNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.GetReceipt(tt.args.ctx, testUserId, tt.args.receiptId)
+			if err != tt.wantErr {
+				t.Errorf("%s: GetReceipt() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: GetReceipt() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
+
+func TestDeleteReceipt(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+	populateReceipts(memDb)
+	_, err := memDb.Exec(`
+INSERT INTO receipt_tag_association (receipt_id, tag_id) VALUES (3, 1);
+INSERT INTO expiry_notification (receipt_id, lead_days, sent_at)
+	VALUES (1, 30, '2021-04-15 00:00:00');`)
+	if err != nil {
+		log.Fatalf("Unexpected error on SQL INSERT: %v", err)
+	}
+	storeDir := t.TempDir()
+	files := blobstore.NewLocalStore(storeDir)
+	if err := files.Put(ctx, "a.jpg", []byte("receipt")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	type args struct {
+		ctx       context.Context
+		receiptId int64
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr error
+	}{
+		{
+			"Delete receipt",
+			args{ctx, 1},
+			"a.jpg",
+			nil,
+		},
+		{
+			"Already deleted",
+			args{ctx, 1},
+			"",
+			ErrReceiptNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.DeleteReceipt(tt.args.ctx, testUserId, files, tt.args.receiptId)
+			if err != tt.wantErr {
+				t.Errorf("%s: DeleteReceipt() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("%s: DeleteReceipt() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+
+	if left := listDir(t, storeDir); len(left) != 0 {
+		t.Errorf("DeleteReceipt() left files behind: %v", left)
+	}
+
+	// Tag laptop was used only by the deleted receipt
+	remainingTags := make([]string, 0)
+	rows, _ := memDb.Query("SELECT tag FROM tag ORDER BY tag;")
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			t.Errorf("Failed to get row data: %v", err)
+		}
+		remainingTags = append(remainingTags, tag)
+	}
+	if !reflect.DeepEqual(remainingTags, []string{"computershop", "food"}) {
+		t.Errorf("ERROR: mismatch in remainingTags: %v", remainingTags)
+	}
+
+	var leftovers int
+	err = memDb.QueryRow(`SELECT
+	(SELECT COUNT(*) FROM receipt_tag_association WHERE receipt_id = 1) +
+	(SELECT COUNT(*) FROM expiry_notification WHERE receipt_id = 1);`).Scan(&leftovers)
+	if err != nil || leftovers != 0 {
+		t.Errorf("ERROR: %d rows referencing the deleted receipt left: %v",
+			leftovers,
+			err)
+	}
+}
+
+func TestUpdateReceipt(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+	populateReceipts(memDb)
+
+	purchaseDate := "2019-05-16"
+	noExpiry := ""
+	type args struct {
+		ctx       context.Context
+		receiptId int64
+		update    ReceiptUpdate
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    *Receipt
+		wantErr error
+	}{
+		{
+			"Change dates",
+			args{ctx, 1, ReceiptUpdate{
+				PurchaseDate: &purchaseDate,
+				ExpiryDate:   &noExpiry,
+			}},
+			&Receipt{1, testUserId, "a.jpg", "", 0, "2019-05-16", "",
+				[]string{"computershop", "laptop"}, laptopDetails()},
+			nil,
+		},
+		{
+			"Add and remove tags",
+			args{ctx, 1, ReceiptUpdate{
+				AddTags:    []string{"laptop", "warranty", "food"},
+				RemoveTags: []string{"computershop"},
+			}},
+			&Receipt{1, testUserId, "a.jpg", "", 0, "2019-05-16", "",
+				[]string{"food", "laptop", "warranty"}, laptopDetails()},
+			nil,
+		},
+		{
+			"Missing receipt",
+			args{ctx, 42, ReceiptUpdate{AddTags: []string{"food"}}},
+			nil,
+			ErrReceiptNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := store.UpdateReceipt(tt.args.ctx, testUserId, tt.args.receiptId, tt.args.update)
+			if err != tt.wantErr {
+				t.Errorf("%s: UpdateReceipt() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if tt.want == nil {
+				return
+			}
+			got, _ := store.GetReceipt(tt.args.ctx, testUserId, tt.args.receiptId)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: UpdateReceipt() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+
+	// computershop isn't used by any receipt anymore
+	var orphans int
+	err := memDb.QueryRow("SELECT COUNT(*) FROM tag WHERE tag = 'computershop';").Scan(&orphans)
+	if err != nil || orphans != 0 {
+		t.Errorf("ERROR: orphaned tag left: %d, %v", orphans, err)
+	}
+}
@@ -0,0 +1,76 @@
+package dbengine
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+var ErrInvalidGrouping = errors.New("Grouping must be one of month, tag or vendor")
+
+// SpendingRow is the total of one group in one currency. Amounts in
+// different currencies are never summed together.
+type SpendingRow struct {
+	Group    string `json:"group"`
+	Currency string `json:"currency"`
+	Total    int64  `json:"total"`
+	Count    int64  `json:"count"`
+}
+
+// Grouping expressions by the name used in the API. Receipts with
+// several tags are counted in each of their tags' groups.
+var spendingGroups = map[string]struct {
+	expression string
+	joins      string
+}{
+	"month":  {"IFNULL(strftime('%Y-%m', r.purchase_date), '')", ""},
+	"vendor": {"IFNULL(r.vendor, '')", ""},
+	"tag": {"t.tag", `JOIN receipt_tag_association rta ON rta.receipt_id = r.id
+JOIN tag t ON t.id = rta.tag_id
+`},
+}
+
+// GetSpending sums up amounts of the receipts visible to the user
+// matching the filter
+func (s *Store) GetSpending(
+	ctx context.Context,
+	userId int64,
+	groupBy string,
+	filter ReceiptFilter) ([]SpendingRow, error) {
+	group, found := spendingGroups[groupBy]
+	if !found {
+		return nil, ErrInvalidGrouping
+	}
+	filter.HasAmount = true
+	whereSql, values := filter.whereSql(userId)
+
+	rows, err := s.db.QueryContext(ctx, `SELECT
+	`+group.expression+` AS grp,
+	IFNULL(r.currency, '') AS cur,
+	SUM(r.amount),
+	COUNT(*)
+FROM receipt r
+`+group.joins+whereSql+`GROUP BY grp, cur ORDER BY grp, cur;`,
+		values...)
+	if err != nil {
+		log.Printf("ERROR: querying spending by %s failed: %v", groupBy, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	spending := make([]SpendingRow, 0)
+	for rows.Next() {
+		var row SpendingRow
+		err := rows.Scan(&row.Group, &row.Currency, &row.Total, &row.Count)
+		if err != nil {
+			log.Printf("ERROR: failed to scan spending row: %v", err)
+			return nil, err
+		}
+		spending = append(spending, row)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("ERROR: iterating spending rows failed: %v", err)
+		return nil, err
+	}
+	return spending, nil
+}
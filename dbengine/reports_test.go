@@ -0,0 +1,106 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestGetSpending(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+
+	_, err := memDb.Exec(`
+INSERT INTO receipt (owner_id, filename, purchase_date, amount, currency, vendor) VALUES
+	(1, 'a.jpg', '2020-01-05', 1000, 'EUR', 'ikea'),
+	(1, 'b.jpg', '2020-01-20', 250, 'EUR', 'lidl'),
+	(1, 'c.jpg', '2020-02-01', 500, 'EUR', 'ikea'),
+	(1, 'd.jpg', '2020-02-02', 700, 'USD', 'amazon'),
+	(1, 'e.jpg', '2020-02-03', NULL, NULL, 'ikea'),
+	(1, 'f.jpg', '', 100, 'EUR', NULL);
+INSERT INTO tag (owner_id, tag) VALUES (1, 'furniture'), (1, 'food');
+INSERT INTO receipt_tag_association (receipt_id, tag_id) VALUES
+	(1, 1), (2, 2), (3, 1), (3, 2), (5, 1);`)
+	if err != nil {
+		log.Fatalf("Unexpected error on SQL INSERT: %v", err)
+	}
+
+	type args struct {
+		groupBy string
+		filter  ReceiptFilter
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    []SpendingRow
+		wantErr error
+	}{
+		{
+			"By month",
+			args{"month", ReceiptFilter{}},
+			[]SpendingRow{
+				{"", "EUR", 100, 1},
+				{"2020-01", "EUR", 1250, 2},
+				{"2020-02", "EUR", 500, 1},
+				{"2020-02", "USD", 700, 1},
+			},
+			nil,
+		},
+		{
+			"By vendor in February",
+			args{"vendor", ReceiptFilter{
+				PurchasedAfter:  "2020-02-01",
+				PurchasedBefore: "2020-03-01",
+			}},
+			[]SpendingRow{
+				{"amazon", "USD", 700, 1},
+				{"ikea", "EUR", 500, 1},
+			},
+			nil,
+		},
+		{
+			"By tag",
+			args{"tag", ReceiptFilter{}},
+			[]SpendingRow{
+				{"food", "EUR", 750, 2},
+				{"furniture", "EUR", 1500, 2},
+			},
+			nil,
+		},
+		{
+			"Unknown grouping",
+			args{"year; DROP TABLE receipt", ReceiptFilter{}},
+			nil,
+			ErrInvalidGrouping,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.GetSpending(ctx, testUserId, tt.args.groupBy, tt.args.filter)
+			if err != tt.wantErr {
+				t.Errorf("%s: GetSpending() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: GetSpending() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"html"
+	"log"
+	"strings"
+)
+
+var (
+	ErrSearchUnavailable = errors.New("Full-text search is not available")
+	ErrEmptySearch       = errors.New("Missing search terms")
+)
+
+const (
+	SEARCH_HIGHLIGHT_START string = "<mark>"
+	SEARCH_HIGHLIGHT_END   string = "</mark>"
+	SEARCH_SNIPPET_TOKENS  int    = 12
+	// FTS5 marks the matches with these control characters, the HTML
+	// tags are added only after the text around them is escaped.
+	searchMatchStart string = "\x02"
+	searchMatchEnd   string = "\x03"
+)
+
+// The search index is set up here rather than in a migration since
+// FTS5 is compiled into the SQLite driver only with the sqlite_fts5
+// build tag. A database written by a build without it has its triggers
+// removed and gets reindexed once FTS5 is available again.
+const searchTableSql = `
+CREATE VIRTUAL TABLE IF NOT EXISTS receipt_search USING fts5(
+	ocr_text,
+	tags
+);`
+
+const searchTagsSql = `(
+	SELECT IFNULL(GROUP_CONCAT(t.tag, ' '), '')
+	FROM receipt_tag_association rta
+	JOIN tag t ON t.id = rta.tag_id
+	WHERE rta.receipt_id = %s)`
+
+var searchTriggers = map[string]string{
+	"receipt_search_insert": `
+CREATE TRIGGER receipt_search_insert AFTER INSERT ON receipt BEGIN
+	INSERT INTO receipt_search (rowid, ocr_text, tags)
+	VALUES (new.id, new.ocr_text, ` + tagsOf("new.id") + `);
+END;`,
+	"receipt_search_update": `
+CREATE TRIGGER receipt_search_update AFTER UPDATE OF ocr_text ON receipt BEGIN
+	UPDATE receipt_search SET ocr_text = new.ocr_text WHERE rowid = new.id;
+END;`,
+	"receipt_search_delete": `
+CREATE TRIGGER receipt_search_delete AFTER DELETE ON receipt BEGIN
+	DELETE FROM receipt_search WHERE rowid = old.id;
+END;`,
+	"receipt_search_tag_insert": `
+CREATE TRIGGER receipt_search_tag_insert AFTER INSERT ON receipt_tag_association BEGIN
+	UPDATE receipt_search SET tags = ` + tagsOf("new.receipt_id") + `
+	WHERE rowid = new.receipt_id;
+END;`,
+	"receipt_search_tag_delete": `
+CREATE TRIGGER receipt_search_tag_delete AFTER DELETE ON receipt_tag_association BEGIN
+	UPDATE receipt_search SET tags = ` + tagsOf("old.receipt_id") + `
+	WHERE rowid = old.receipt_id;
+END;`,
+	"receipt_search_tag_rename": `
+CREATE TRIGGER receipt_search_tag_rename AFTER UPDATE OF tag ON tag BEGIN
+	UPDATE receipt_search SET tags = ` + tagsOf("receipt_search.rowid") + `
+	WHERE rowid IN (
+		SELECT receipt_id FROM receipt_tag_association WHERE tag_id = new.id);
+END;`,
+}
+
+func tagsOf(receiptIdSql string) string {
+	return strings.Replace(searchTagsSql, "%s", receiptIdSql, 1)
+}
+
+// SearchResult is a receipt matching a full-text search. Higher scores
+// are better matches and the snippets are HTML, escaped apart from the
+// matching words wrapped in SEARCH_HIGHLIGHT_START and
+// SEARCH_HIGHLIGHT_END.
+type SearchResult struct {
+	Receipt
+	Score       float64 `json:"score"`
+	OcrSnippet  string  `json:"ocr_snippet,omitempty"`
+	TagsSnippet string  `json:"tags_snippet,omitempty"`
+}
+
+// highlightMatches escapes the OCR text and tags, which anyone can
+// write, before marking the matches in them.
+func highlightMatches(snippet string) string {
+	return strings.NewReplacer(
+		searchMatchStart, SEARCH_HIGHLIGHT_START,
+		searchMatchEnd, SEARCH_HIGHLIGHT_END,
+	).Replace(html.EscapeString(snippet))
+}
+
+func hasFts5(ctx context.Context, db dbtx) bool {
+	var enabled bool
+	err := db.QueryRowContext(ctx,
+		"SELECT sqlite_compileoption_used('ENABLE_FTS5');").Scan(&enabled)
+	return err == nil && enabled
+}
+
+// ensureSearchIndex creates the full-text index with the triggers
+// keeping it in sync and fills it when the triggers were missing.
+func ensureSearchIndex(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("ERROR: beginning transaction failed: %v", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	fts5 := hasFts5(ctx, tx)
+	if !fts5 {
+		log.Printf("WARNING: SQLite built without FTS5, full-text search disabled")
+	}
+
+	missing := 0
+	for name, createSql := range searchTriggers {
+		var count int
+		err := tx.QueryRowContext(ctx,
+			"SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = ?;",
+			name).Scan(&count)
+		if err != nil {
+			log.Printf("ERROR: querying trigger %s failed: %v", name, err)
+			return err
+		}
+		switch {
+		case !fts5 && count > 0:
+			_, err = tx.ExecContext(ctx, "DROP TRIGGER "+name+";")
+		case fts5 && count == 0:
+			missing++
+			if _, err = tx.ExecContext(ctx, searchTableSql); err == nil {
+				_, err = tx.ExecContext(ctx, createSql)
+			}
+		}
+		if err != nil {
+			log.Printf("ERROR: setting up trigger %s failed: %v", name, err)
+			return err
+		}
+	}
+
+	if missing > 0 {
+		log.Printf("Rebuilding full-text search index")
+		rebuild := []string{
+			"DELETE FROM receipt_search;",
+			`INSERT INTO receipt_search (rowid, ocr_text, tags)
+SELECT r.id, r.ocr_text, ` + tagsOf("r.id") + `
+FROM receipt r;`,
+		}
+		for _, rawSql := range rebuild {
+			if _, err := tx.ExecContext(ctx, rawSql); err != nil {
+				log.Printf("ERROR: rebuilding search index failed: %v", err)
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// ftsQuery turns free text into an FTS5 query matching receipts having
+// all of the words. Words are quoted so that characters like '-' in
+// serial numbers aren't read as operators; a trailing '*' still makes
+// a prefix search.
+func ftsQuery(text string) string {
+	terms := []string{}
+	for _, word := range strings.Fields(text) {
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.Trim(word, "*\"")
+		if word == "" {
+			continue
+		}
+		term := `"` + strings.Replace(word, `"`, `""`, -1) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+func (s *Store) searchAvailable(ctx context.Context) bool {
+	var count int
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM sqlite_master WHERE name = 'receipt_search';").Scan(&count)
+	return err == nil && count > 0 && hasFts5(ctx, s.db)
+}
+
+// SearchReceipts returns receipts visible to the user whose OCR text or
+// tags contain all the words in text, best matches first.
+func (s *Store) SearchReceipts(
+	ctx context.Context,
+	userId int64,
+	text string,
+	limit int,
+	offset int) ([]SearchResult, error) {
+	query := ftsQuery(text)
+	if query == "" {
+		return nil, ErrEmptySearch
+	}
+	if !s.searchAvailable(ctx) {
+		return nil, ErrSearchUnavailable
+	}
+
+	// Ranking and snippets are only available on the rows of the
+	// full-text query itself, hence the subquery.
+	rows, err := s.db.QueryContext(ctx, "SELECT"+receiptColumnsSql+`,
+	m.score,
+	IFNULL(m.ocr_snippet, ''),
+	IFNULL(m.tags_snippet, '')
+FROM (
+	SELECT
+		rowid AS id,
+		-bm25(receipt_search) AS score,
+		snippet(receipt_search, 0, :start, :end, '…', :tokens) AS ocr_snippet,
+		highlight(receipt_search, 1, :start, :end) AS tags_snippet
+	FROM receipt_search
+	WHERE receipt_search MATCH :query
+		AND rowid IN (`+visibleReceiptIds(":user_id")+`)
+	ORDER BY rank
+	LIMIT :limit OFFSET :offset
+) m
+JOIN receipt r ON r.id = m.id`+receiptTagJoinSql+`GROUP BY r.id
+ORDER BY m.score DESC, r.id DESC;`,
+		sql.Named("start", searchMatchStart),
+		sql.Named("end", searchMatchEnd),
+		sql.Named("tokens", SEARCH_SNIPPET_TOKENS),
+		sql.Named("query", query),
+		sql.Named("user_id", userId),
+		sql.Named("limit", limit),
+		sql.Named("offset", offset),
+	)
+	if err != nil {
+		log.Printf("ERROR: searching receipts failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		var result SearchResult
+		receipt, err := scanReceiptRow(rows,
+			&result.Score,
+			&result.OcrSnippet,
+			&result.TagsSnippet)
+		if err != nil {
+			return nil, err
+		}
+		result.Receipt = receipt
+		result.OcrSnippet = highlightMatches(result.OcrSnippet)
+		if strings.Contains(result.TagsSnippet, searchMatchStart) {
+			result.TagsSnippet = highlightMatches(result.TagsSnippet)
+		} else {
+			result.TagsSnippet = ""
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("ERROR: iterating search results failed: %v", err)
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *Store) CountSearchResults(
+	ctx context.Context,
+	userId int64,
+	text string) (int64, error) {
+	query := ftsQuery(text)
+	if query == "" {
+		return 0, ErrEmptySearch
+	}
+	if !s.searchAvailable(ctx) {
+		return 0, ErrSearchUnavailable
+	}
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM receipt_search
+WHERE receipt_search MATCH :query AND rowid IN (`+visibleReceiptIds(":user_id")+");",
+		sql.Named("query", query),
+		sql.Named("user_id", userId)).Scan(&count)
+	if err != nil {
+		log.Printf("ERROR: counting search results failed: %v", err)
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,131 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"receiptstracker-api/blobstore"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSearchReceipts(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+	if !hasFts5(ctx, memDb) {
+		t.Skip("SQLite built without FTS5, use -tags sqlite_fts5")
+	}
+	populateReceipts(memDb)
+
+	_, err := memDb.Exec(`
+UPDATE receipt SET ocr_text = 'COMPUTER SHOP laptop 1299.00 EUR serial SN-4711' WHERE id = 1;
+UPDATE receipt SET ocr_text = 'Coffee machine 89.90, coffee filters 2.50' WHERE id = 2;`)
+	if err != nil {
+		log.Fatalf("Unexpected error on SQL UPDATE: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		text    string
+		wantIds []int64
+		wantErr error
+	}{
+		{"Words in OCR text", "coffee machine", []int64{2}, nil},
+		{"Serial number", "SN-4711", []int64{1}, nil},
+		{"Tag", "food", []int64{3}, nil},
+		{"Tag and OCR text", "laptop", []int64{1}, nil},
+		{"Prefix", "comp*", []int64{1}, nil},
+		{"All words must match", "coffee laptop", []int64{}, nil},
+		{"Operators are not interpreted", `NOT "coffee`, []int64{}, nil},
+		{"No words", " * ", nil, ErrEmptySearch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.SearchReceipts(ctx, testUserId, tt.text, 10, 0)
+			if err != tt.wantErr {
+				t.Errorf("%s: SearchReceipts() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if len(got) != len(tt.wantIds) {
+				t.Errorf("%s: SearchReceipts() = %v, want IDs %v",
+					tt.name,
+					got,
+					tt.wantIds)
+				return
+			}
+			for i, result := range got {
+				if result.Id != tt.wantIds[i] {
+					t.Errorf("%s: SearchReceipts() = %v, want IDs %v",
+						tt.name,
+						got,
+						tt.wantIds)
+				}
+			}
+		})
+	}
+
+	results, _ := store.SearchReceipts(ctx, testUserId, "coffee", 10, 0)
+	wantSnippet := "<mark>Coffee</mark> machine 89.90, <mark>coffee</mark> filters 2.50"
+	if len(results) != 1 || results[0].OcrSnippet != wantSnippet {
+		t.Errorf("SearchReceipts() snippet = %v, want %q", results, wantSnippet)
+	}
+	results, _ = store.SearchReceipts(ctx, testUserId, "laptop", 10, 0)
+	wantTags := "<mark>laptop</mark> computershop"
+	if len(results) != 1 || results[0].TagsSnippet != wantTags {
+		t.Errorf("SearchReceipts() tags snippet = %v, want %q", results, wantTags)
+	}
+
+	// Stored text comes back escaped with only the highlight as HTML
+	memDb.Exec("UPDATE receipt SET ocr_text = 'Bakery <script>alert(1)</script> & bread' WHERE id = 3;")
+	err = store.UpdateReceipt(ctx, testUserId, 3,
+		ReceiptUpdate{AddTags: []string{"<img/src=x/onerror=alert(1)>"}})
+	if err != nil {
+		t.Fatalf("UpdateReceipt() error = %v", err)
+	}
+	results, _ = store.SearchReceipts(ctx, testUserId, "bakery", 10, 0)
+	wantSnippet = "<mark>Bakery</mark> &lt;script&gt;alert(1)&lt;/script&gt; &amp; bread"
+	if len(results) != 1 || results[0].OcrSnippet != wantSnippet {
+		t.Errorf("SearchReceipts() snippet = %v, want %q", results, wantSnippet)
+	}
+	results, _ = store.SearchReceipts(ctx, testUserId, "onerror", 10, 0)
+	wantTags = "&lt;img/src=x/<mark>onerror</mark>=alert(1)&gt;"
+	if len(results) != 1 || !strings.Contains(results[0].TagsSnippet, wantTags) ||
+		strings.Contains(results[0].TagsSnippet, "<img") {
+		t.Errorf("SearchReceipts() tags snippet = %v, want %q", results, wantTags)
+	}
+
+	// Other users find only what has been shared with them
+	const otherUserId int64 = 2
+	if results, err := store.SearchReceipts(ctx, otherUserId, "coffee", 10, 0); err != nil || len(results) != 0 {
+		t.Errorf("SearchReceipts() of other user = %v, %v, want none", results, err)
+	}
+	memDb.Exec("INSERT INTO receipt_share (receipt_id, user_id) VALUES (2, ?);", otherUserId)
+	if count, _ := store.CountSearchResults(ctx, otherUserId, "coffee"); count != 1 {
+		t.Errorf("CountSearchResults() of shared receipt = %d, want 1", count)
+	}
+
+	// Index follows tag and receipt changes
+	if err := store.UpdateReceipt(ctx, testUserId, 3, ReceiptUpdate{RemoveTags: []string{"food"}}); err != nil {
+		t.Fatalf("UpdateReceipt() error = %v", err)
+	}
+	if _, err := store.DeleteReceipt(ctx, testUserId, blobstore.NewLocalStore(t.TempDir()), 2); err != nil {
+		t.Fatalf("DeleteReceipt() error = %v", err)
+	}
+	for _, text := range []string{"food", "coffee"} {
+		if count, _ := store.CountSearchResults(ctx, testUserId, text); count != 0 {
+			t.Errorf("store.CountSearchResults(%q) = %d, want 0", text, count)
+		}
+	}
+}
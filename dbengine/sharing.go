@@ -0,0 +1,225 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+)
+
+var (
+	ErrNotOwner       = errors.New("Only the owner can change the receipt")
+	ErrTagNotFound    = errors.New("Tag not found")
+	ErrShareWithOwner = errors.New("Cannot share with the owner")
+	ErrShareNotFound  = errors.New("Not shared with the user")
+)
+
+// visibleReceiptIdsSql selects the receipts a user owns together with
+// the ones shared with them, either one by one or through a tag. Shared
+// receipts can be read but only their owner can change them.
+const visibleReceiptIdsSql = `SELECT id FROM receipt WHERE owner_id = %s
+	UNION SELECT receipt_id FROM receipt_share WHERE user_id = %s
+	UNION SELECT vta.receipt_id FROM receipt_tag_association vta
+		JOIN tag_share vts ON vts.tag_id = vta.tag_id
+		WHERE vts.user_id = %s`
+
+// visibleReceiptIds takes the placeholder of the user ID, which is used
+// three times when it is "?".
+func visibleReceiptIds(userIdSql string) string {
+	return strings.Replace(visibleReceiptIdsSql, "%s", userIdSql, -1)
+}
+
+// checkOwner returns ErrReceiptNotFound when the user can't see the
+// receipt at all and ErrNotOwner when it has only been shared with them.
+func checkOwner(ctx context.Context, db dbtx, userId int64, receiptId int64) error {
+	var ownerId int64
+	err := db.QueryRowContext(ctx,
+		"SELECT owner_id FROM receipt WHERE id = ? AND id IN ("+visibleReceiptIds("?")+");",
+		receiptId,
+		userId,
+		userId,
+		userId).Scan(&ownerId)
+	if err == sql.ErrNoRows {
+		return ErrReceiptNotFound
+	}
+	if err != nil {
+		log.Printf("ERROR: querying owner of receipt %d failed: %v", receiptId, err)
+		return err
+	}
+	if ownerId != userId {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// tagId returns the ID of the user's own tag
+func tagId(ctx context.Context, db dbtx, userId int64, tag string) (int64, error) {
+	var id int64
+	err := db.QueryRowContext(ctx,
+		"SELECT id FROM tag WHERE owner_id = ? AND tag = ?;",
+		userId,
+		tag).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrTagNotFound
+	}
+	if err != nil {
+		log.Printf("ERROR: querying tag %q failed: %v", tag, err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// shareTable is one of the tables of the same shape keeping the shares
+// of receipts and of tags
+type shareTable struct {
+	name   string
+	column string
+}
+
+var (
+	receiptShares = shareTable{"receipt_share", "receipt_id"}
+	tagShares     = shareTable{"tag_share", "tag_id"}
+)
+
+func addShare(
+	ctx context.Context,
+	db dbtx,
+	table shareTable,
+	id int64,
+	ownerId int64,
+	withUser string) error {
+	user, err := getUserByName(ctx, db, withUser)
+	if err != nil {
+		return err
+	}
+	if user.Id == ownerId {
+		return ErrShareWithOwner
+	}
+	_, err = db.ExecContext(ctx,
+		"INSERT OR IGNORE INTO "+table.name+" ("+table.column+", user_id) VALUES (?, ?);",
+		id,
+		user.Id)
+	if err != nil {
+		log.Printf("ERROR: sharing %s %d with %q failed: %v", table.column, id, withUser, err)
+		return err
+	}
+	return nil
+}
+
+func removeShare(
+	ctx context.Context,
+	db dbtx,
+	table shareTable,
+	id int64,
+	withUser string) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM "+table.name+" WHERE "+table.column+` = ?
+	AND user_id IN (SELECT id FROM user WHERE name = ?);`,
+		id,
+		withUser)
+	if err != nil {
+		log.Printf("ERROR: unsharing %s %d with %q failed: %v", table.column, id, withUser, err)
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrShareNotFound
+	}
+	return nil
+}
+
+// sharedWith returns the names of the users in alphabetical order
+func sharedWith(ctx context.Context, db dbtx, table shareTable, id int64) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT u.name FROM `+table.name+` sh
+JOIN user u ON u.id = sh.user_id
+WHERE sh.`+table.column+` = ? ORDER BY u.name;`,
+		id)
+	if err != nil {
+		log.Printf("ERROR: querying shares of %s %d failed: %v", table.column, id, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			log.Printf("ERROR: failed to scan share: %v", err)
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// ShareReceipt lets another user see one of the user's receipts
+func (s *Store) ShareReceipt(
+	ctx context.Context,
+	userId int64,
+	receiptId int64,
+	withUser string) error {
+	if err := checkOwner(ctx, s.db, userId, receiptId); err != nil {
+		return err
+	}
+	return addShare(ctx, s.db, receiptShares, receiptId, userId, withUser)
+}
+
+func (s *Store) UnshareReceipt(
+	ctx context.Context,
+	userId int64,
+	receiptId int64,
+	withUser string) error {
+	if err := checkOwner(ctx, s.db, userId, receiptId); err != nil {
+		return err
+	}
+	return removeShare(ctx, s.db, receiptShares, receiptId, withUser)
+}
+
+// GetReceiptShares tells whom the receipt has been shared with one by
+// one, shares through tags are listed by GetTagShares.
+func (s *Store) GetReceiptShares(
+	ctx context.Context,
+	userId int64,
+	receiptId int64) ([]string, error) {
+	if err := checkOwner(ctx, s.db, userId, receiptId); err != nil {
+		return nil, err
+	}
+	return sharedWith(ctx, s.db, receiptShares, receiptId)
+}
+
+// ShareTag lets another user see every receipt of the user having the
+// tag, including the ones tagged later on.
+func (s *Store) ShareTag(
+	ctx context.Context,
+	userId int64,
+	tag string,
+	withUser string) error {
+	id, err := tagId(ctx, s.db, userId, tag)
+	if err != nil {
+		return err
+	}
+	return addShare(ctx, s.db, tagShares, id, userId, withUser)
+}
+
+func (s *Store) UnshareTag(
+	ctx context.Context,
+	userId int64,
+	tag string,
+	withUser string) error {
+	id, err := tagId(ctx, s.db, userId, tag)
+	if err != nil {
+		return err
+	}
+	return removeShare(ctx, s.db, tagShares, id, withUser)
+}
+
+func (s *Store) GetTagShares(ctx context.Context, userId int64, tag string) ([]string, error) {
+	id, err := tagId(ctx, s.db, userId, tag)
+	if err != nil {
+		return nil, err
+	}
+	return sharedWith(ctx, s.db, tagShares, id)
+}
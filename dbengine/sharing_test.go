@@ -0,0 +1,194 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"receiptstracker-api/blobstore"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSharing(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+	ids := map[string]int64{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		user, err := store.CreateUser(ctx, name)
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		ids[name] = user.Id
+	}
+	alice, bob, carol := ids["alice"], ids["bob"], ids["carol"]
+	if alice != testUserId {
+		t.Fatalf("First user has ID %d, want %d", alice, testUserId)
+	}
+	// Receipts 1-3 of alice, 3 tagged with food
+	populateReceipts(memDb)
+	files := blobstore.NewLocalStore(t.TempDir())
+	if err := files.Put(ctx, "a.jpg", []byte("receipt")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	filtered := func(userId int64, filter ReceiptFilter) []int64 {
+		receipts, err := store.GetReceipts(ctx, userId, filter, 10, 0)
+		if err != nil {
+			t.Fatalf("GetReceipts() error = %v", err)
+		}
+		receiptIds := []int64{}
+		for _, receipt := range receipts {
+			receiptIds = append(receiptIds, receipt.Id)
+		}
+		return receiptIds
+	}
+	visible := func(userId int64) []int64 {
+		return filtered(userId, ReceiptFilter{})
+	}
+
+	if got := visible(bob); len(got) != 0 {
+		t.Errorf("Receipts of bob before sharing = %v, want none", got)
+	}
+	if _, err := store.GetReceipt(ctx, bob, 1); err != ErrReceiptNotFound {
+		t.Errorf("GetReceipt() of unshared receipt error = %v, want %v", err, ErrReceiptNotFound)
+	}
+	if err := store.ShareReceipt(ctx, bob, 1, "carol"); err != ErrReceiptNotFound {
+		t.Errorf("ShareReceipt() of unshared receipt error = %v, want %v", err, ErrReceiptNotFound)
+	}
+
+	// Files and tags are the user's own
+	bobsReceipt, err := store.InsertReceipt(ctx, bob, "a.jpg", "image/jpeg", 1, "", "", PurchaseDetails{})
+	if err != nil {
+		t.Errorf("InsertReceipt() of other user's file error = %v", err)
+	}
+	if _, err := store.InsertReceipt(ctx, alice, "a.jpg", "image/jpeg", 1, "", "", PurchaseDetails{}); err != ErrReceiptExists {
+		t.Errorf("InsertReceipt() of own file again error = %v, want %v", err, ErrReceiptExists)
+	}
+	store.InsertTags(ctx, bob, []string{"food"})
+	for tagId := range store.getTagsIds(ctx, bob, []string{"food"}) {
+		if _, alicesTag := store.getTagsIds(ctx, alice, []string{"food"})[tagId]; alicesTag {
+			t.Errorf("Users share the tag %d", tagId)
+		}
+	}
+
+	shareErrors := []struct {
+		name     string
+		userId   int64
+		withUser string
+		want     error
+	}{
+		{"Owner", alice, "alice", ErrShareWithOwner},
+		{"Unknown user", alice, "dave", ErrUserNotFound},
+	}
+	for _, tt := range shareErrors {
+		if err := store.ShareReceipt(ctx, tt.userId, 1, tt.withUser); err != tt.want {
+			t.Errorf("%s: ShareReceipt() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	if err := store.ShareReceipt(ctx, alice, 1, "bob"); err != nil {
+		t.Fatalf("ShareReceipt() error = %v", err)
+	}
+	if got := visible(bob); !reflect.DeepEqual(got, []int64{bobsReceipt, 1}) {
+		t.Errorf("Receipts of bob = %v, want %v", got, []int64{bobsReceipt, 1})
+	}
+	if shares, err := store.GetReceiptShares(ctx, alice, 1); err != nil || !reflect.DeepEqual(shares, []string{"bob"}) {
+		t.Errorf("GetReceiptShares() = %v, %v, want [bob]", shares, err)
+	}
+
+	// Tag filters match the user's own tags, not the same names of the
+	// owners of receipts shared one by one
+	store.InsertReceiptTagAssociation(ctx, bob, bobsReceipt, []string{"food"})
+	if err := store.ShareReceipt(ctx, alice, 3, "bob"); err != nil {
+		t.Fatalf("ShareReceipt() error = %v", err)
+	}
+	food := []string{"food"}
+	if got := filtered(bob, ReceiptFilter{Tags: food}); !reflect.DeepEqual(got, []int64{bobsReceipt}) {
+		t.Errorf("Receipts of bob tagged food = %v, want %v", got, []int64{bobsReceipt})
+	}
+	if got := filtered(bob, ReceiptFilter{ExcludedTags: food}); !reflect.DeepEqual(got, []int64{3, 1}) {
+		t.Errorf("Receipts of bob not tagged food = %v, want [3 1]", got)
+	}
+	if err := store.UnshareReceipt(ctx, alice, 3, "bob"); err != nil {
+		t.Errorf("UnshareReceipt() error = %v", err)
+	}
+
+	// Shared receipts can only be read
+	date := "2019-05-16"
+	if err := store.UpdateReceipt(ctx, bob, 1, ReceiptUpdate{PurchaseDate: &date}); err != ErrNotOwner {
+		t.Errorf("UpdateReceipt() of shared receipt error = %v, want %v", err, ErrNotOwner)
+	}
+	if _, err := store.DeleteReceipt(ctx, bob, files, 1); err != ErrNotOwner {
+		t.Errorf("DeleteReceipt() of shared receipt error = %v, want %v", err, ErrNotOwner)
+	}
+	if err := store.ShareReceipt(ctx, bob, 1, "carol"); err != ErrNotOwner {
+		t.Errorf("ShareReceipt() of shared receipt error = %v, want %v", err, ErrNotOwner)
+	}
+	if _, err := store.GetReceiptShares(ctx, bob, 1); err != ErrNotOwner {
+		t.Errorf("GetReceiptShares() of shared receipt error = %v, want %v", err, ErrNotOwner)
+	}
+
+	// Tags share the receipts tagged later on too
+	if err := store.ShareTag(ctx, alice, "food", "carol"); err != nil {
+		t.Fatalf("ShareTag() error = %v", err)
+	}
+	if err := store.ShareTag(ctx, alice, "garden", "carol"); err != ErrTagNotFound {
+		t.Errorf("ShareTag() of missing tag error = %v, want %v", err, ErrTagNotFound)
+	}
+	if got := visible(carol); !reflect.DeepEqual(got, []int64{3}) {
+		t.Errorf("Receipts of carol = %v, want [3]", got)
+	}
+	if got := filtered(carol, ReceiptFilter{Tags: []string{"food"}, MatchAllTags: true}); !reflect.DeepEqual(got, []int64{3}) {
+		t.Errorf("Receipts of carol tagged food = %v, want [3]", got)
+	}
+	if err := store.UpdateReceipt(ctx, alice, 2, ReceiptUpdate{AddTags: []string{"food"}}); err != nil {
+		t.Errorf("UpdateReceipt() error = %v", err)
+	}
+	if got := visible(carol); !reflect.DeepEqual(got, []int64{3, 2}) {
+		t.Errorf("Receipts of carol after tagging = %v, want [3 2]", got)
+	}
+	if count, err := store.CountReceipts(ctx, carol, ReceiptFilter{}); err != nil || count != 2 {
+		t.Errorf("CountReceipts() of carol = %d, %v, want 2", count, err)
+	}
+	if shares, err := store.GetTagShares(ctx, alice, "food"); err != nil || !reflect.DeepEqual(shares, []string{"carol"}) {
+		t.Errorf("GetTagShares() = %v, %v, want [carol]", shares, err)
+	}
+	if err := store.UnshareTag(ctx, alice, "food", "carol"); err != nil {
+		t.Errorf("UnshareTag() error = %v", err)
+	}
+	if got := visible(carol); len(got) != 0 {
+		t.Errorf("Receipts of carol after unsharing = %v, want none", got)
+	}
+
+	if err := store.UnshareReceipt(ctx, alice, 1, "bob"); err != nil {
+		t.Errorf("UnshareReceipt() error = %v", err)
+	}
+	if err := store.UnshareReceipt(ctx, alice, 1, "bob"); err != ErrShareNotFound {
+		t.Errorf("UnshareReceipt() twice error = %v, want %v", err, ErrShareNotFound)
+	}
+	if _, err := store.GetReceipt(ctx, bob, 1); err != ErrReceiptNotFound {
+		t.Errorf("GetReceipt() after unsharing error = %v, want %v", err, ErrReceiptNotFound)
+	}
+
+	// The file stays as long as a receipt has it
+	if filename, err := store.DeleteReceipt(ctx, alice, files, 1); err != nil || filename != "" {
+		t.Errorf("DeleteReceipt() of file in use = %q, %v, want no filename", filename, err)
+	}
+	if exists, _ := files.Exists(ctx, "a.jpg"); !exists {
+		t.Errorf("DeleteReceipt() removed the file in use")
+	}
+	if filename, err := store.DeleteReceipt(ctx, bob, files, bobsReceipt); err != nil || filename != "a.jpg" {
+		t.Errorf("DeleteReceipt() of last receipt of file = %q, %v, want a.jpg", filename, err)
+	}
+	if exists, _ := files.Exists(ctx, "a.jpg"); exists {
+		t.Errorf("DeleteReceipt() left the file of the last receipt behind")
+	}
+}
@@ -5,80 +5,195 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-)
+	"receiptstracker-api/config"
 
-const sqlSchema = `CREATE TABLE receipt (
-        id INTEGER PRIMARY KEY,
-        filename VARCHAR NOT NULL,
-        purchase_date DATE,
-        expiry_date DATE,
-        ocr_text VARCHAR,
-        UNIQUE (filename)
-);
-CREATE TABLE tag (
-        id INTEGER PRIMARY KEY,
-        tag VARCHAR,
-        UNIQUE (tag)
-);
-CREATE TABLE receipt_tag_association (
-        id INTEGER PRIMARY KEY,
-        receipt_id INTEGER,
-        tag_id INTEGER,
-        FOREIGN KEY(receipt_id) REFERENCES receipt (id),
-        FOREIGN KEY(tag_id) REFERENCES tag (id)
-);
-`
-
-var (
-	dbConn *sql.DB
+	"github.com/mattn/go-sqlite3"
 )
 
-func UpdateDbRef(db *sql.DB) {
-	if db == nil {
-		return
+// Store runs the queries of the API on its database. Being a value
+// rather than a package variable, several databases can be open at once.
+type Store struct {
+	db    *sql.DB
+	files fileLocks
+}
+
+// fileLocks serialises the stores and deletions of receipts having the
+// same file. Receipts of several users may share a file, which is written
+// or removed depending on the other receipts having it, and that count
+// must not change until the file has been written or removed.
+type fileLocks struct {
+	mu    sync.Mutex
+	locks map[string]*fileLock
+}
+
+type fileLock struct {
+	sync.Mutex
+	waiting int
+}
+
+// lock returns the function releasing the lock of the file
+func (l *fileLocks) lock(filename string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*fileLock{}
+	}
+	fl, found := l.locks[filename]
+	if !found {
+		fl = &fileLock{}
+		l.locks[filename] = fl
+	}
+	fl.waiting++
+	l.mu.Unlock()
+
+	fl.Lock()
+	return func() {
+		fl.Unlock()
+		l.mu.Lock()
+		fl.waiting--
+		if fl.waiting == 0 {
+			delete(l.locks, filename)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// NewStore uses db as it is, its schema is expected to be up to date
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Open connects to the database of cfg and brings its schema up to date
+func Open(cfg config.DatabaseConfig) (*Store, error) {
+	dsn := fmt.Sprintf("%s?_busy_timeout=%d",
+		cfg.Path,
+		cfg.BusyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = Migrate(context.Background(), db, false)
+	if err == nil {
+		err = ensureSearchIndex(context.Background(), db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Schema creation failed: %v", err)
 	}
-	dbConn = db
+	return NewStore(db), nil
 }
 
-func ShutdownDb() {
-	if err := dbConn.Close(); err != nil {
+func (s *Store) Close() {
+	if err := s.db.Close(); err != nil {
 		log.Printf("ERROR: Closing db: %v", err)
 	}
 }
 
+// CreateSchema brings the schema up to date by applying all pending
+// migrations and sets up the full-text search index.
 func CreateSchema(db *sql.DB) {
-	_, err := db.Exec(sqlSchema)
+	_, err := Migrate(context.Background(), db, false)
+	if err == nil {
+		err = ensureSearchIndex(context.Background(), db)
+	}
 	if err != nil {
 		errMsg := fmt.Sprintf("ERROR: schema creation failed: %v", err)
 		log.Fatal(errMsg)
 	}
 }
 
-// InsertReceipt returns true if insert succeeds, false otherwise
-func InsertReceipt(
+// formatTimestamp stores times in UTC in a form which also sorts right
+// when compared as text.
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx so that the same
+// queries can be run either on their own or inside a transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// InsertReceipt returns ID of the inserted receipt
+func (s *Store) InsertReceipt(
+	ctx context.Context,
+	ownerId int64,
+	filename string,
+	mimeType string,
+	pageCount int,
+	purchaseDate string,
+	expiryDate string,
+	details PurchaseDetails) (int64, error) {
+	return insertReceipt(ctx,
+		s.db,
+		ownerId,
+		filename,
+		mimeType,
+		pageCount,
+		purchaseDate,
+		expiryDate,
+		details)
+}
+
+func insertReceipt(
 	ctx context.Context,
+	db dbtx,
+	ownerId int64,
 	filename string,
+	mimeType string,
+	pageCount int,
 	purchaseDate string,
-	expiryDate string) (int64, error) {
-	stmt, err := dbConn.PrepareContext(ctx, `
-INSERT OR IGNORE INTO receipt(
+	expiryDate string,
+	details PurchaseDetails) (int64, error) {
+	stmt, err := db.PrepareContext(ctx, `
+INSERT INTO receipt(
+	owner_id,
 	filename,
+	mime_type,
+	page_count,
 	purchase_date,
-	expiry_date
+	expiry_date,
+	amount,
+	currency,
+	vendor,
+	payment_method
 ) VALUES (
+	:owner_id,
 	:filename,
+	:mime_type,
+	:page_count,
 	:purchase_date,
-	:expiry_date);`)
-
+	:expiry_date,
+	:amount,
+	:currency,
+	:vendor,
+	:payment_method);`)
+	if err != nil {
+		log.Printf("ERROR: preparing statement for receipt failed: %v", err)
+		return 0, err
+	}
 	defer stmt.Close()
 
 	res, err := stmt.ExecContext(ctx,
+		sql.Named("owner_id", ownerId),
 		sql.Named("filename", filename),
+		sql.Named("mime_type", mimeType),
+		sql.Named("page_count", pageCount),
 		sql.Named("purchase_date", purchaseDate),
 		sql.Named("expiry_date", expiryDate),
+		sql.Named("amount", details.Amount),
+		sql.Named("currency", details.Currency),
+		sql.Named("vendor", details.Vendor),
+		sql.Named("payment_method", details.PaymentMethod),
 	)
+	if isUniqueViolation(err) {
+		return 0, ErrReceiptExists
+	}
 	if err != nil {
 		log.Printf("ERROR: receipt insert failed: %v", err)
 		return 0, err
@@ -92,42 +207,67 @@ INSERT OR IGNORE INTO receipt(
 	return receiptId, nil
 }
 
-func InsertTags(ctx context.Context, tags []string) bool {
-	rawSql := "INSERT OR IGNORE INTO tag (tag) VALUES "
+func isUniqueViolation(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+// InsertTags adds the tags missing from the owner's tags
+func (s *Store) InsertTags(ctx context.Context, ownerId int64, tags []string) bool {
+	return insertTags(ctx, s.db, ownerId, tags) == nil
+}
+
+func insertTags(ctx context.Context, db dbtx, ownerId int64, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	rawSql := "INSERT OR IGNORE INTO tag (owner_id, tag) VALUES "
 	values := []interface{}{}
 
 	for _, tag := range tags {
-		rawSql += "(?),"
-		values = append(values, tag)
+		rawSql += "(?, ?),"
+		values = append(values, ownerId, tag)
 	}
 	// Remove comma postfix
 	rawSql = rawSql[0 : len(rawSql)-1]
-	stmt, err := dbConn.PrepareContext(ctx, rawSql)
+	stmt, err := db.PrepareContext(ctx, rawSql)
 	if err != nil {
 		log.Printf("ERROR: preparing statement for tags failed: %v",
 			err)
-		return false
+		return err
 	}
 	defer stmt.Close()
 
 	_, err = stmt.ExecContext(ctx, values...)
 	if err != nil {
 		log.Printf("ERROR: inserting tags failed: %v", err)
-	} else {
-		return true
+		return err
 	}
+	return nil
+}
 
-	return false
+// InsertReceiptTagAssociation tags the receipt with the owner's tags
+func (s *Store) InsertReceiptTagAssociation(
+	ctx context.Context,
+	ownerId int64,
+	receiptId int64,
+	tags []string) (int64, error) {
+	return insertReceiptTagAssociation(ctx, s.db, ownerId, receiptId, tags)
 }
 
-func InsertReceiptTagAssociation(
+func insertReceiptTagAssociation(
 	ctx context.Context,
+	db dbtx,
+	ownerId int64,
 	receiptId int64,
 	tags []string) (int64, error) {
 	values := []interface{}{}
 	rawSql := "INSERT OR IGNORE INTO receipt_tag_association (receipt_id, tag_id) VALUES "
 
-	tagIds := getTagsIds(ctx, tags)
+	tagIds := getTagsIdsWith(ctx, db, ownerId, tags)
+	if len(tagIds) == 0 {
+		return 0, nil
+	}
 	for tagId, _ := range tagIds {
 		values = append(values, receiptId)
 		values = append(values, tagId)
@@ -136,7 +276,7 @@ func InsertReceiptTagAssociation(
 	// Remove comma postfix
 	rawSql = rawSql[0 : len(rawSql)-1]
 
-	stmt, err := dbConn.PrepareContext(ctx, rawSql)
+	stmt, err := db.PrepareContext(ctx, rawSql)
 	if err != nil {
 		log.Printf("ERROR: preparing statement for tag ids failed: %v", err)
 		return 0, err
@@ -157,9 +297,16 @@ func InsertReceiptTagAssociation(
 	return affected, nil
 }
 
-func getTagsIds(ctx context.Context, tags []string) map[int64]string {
-	rawSql := "SELECT id, tag FROM tag WHERE tag IN ("
-	values := []interface{}{}
+func (s *Store) getTagsIds(ctx context.Context, ownerId int64, tags []string) map[int64]string {
+	return getTagsIdsWith(ctx, s.db, ownerId, tags)
+}
+
+func getTagsIdsWith(ctx context.Context, db dbtx, ownerId int64, tags []string) map[int64]string {
+	if len(tags) == 0 {
+		return map[int64]string{}
+	}
+	rawSql := "SELECT id, tag FROM tag WHERE owner_id = ? AND tag IN ("
+	values := []interface{}{ownerId}
 
 	for _, tag := range tags {
 		rawSql += "?,"
@@ -168,7 +315,7 @@ func getTagsIds(ctx context.Context, tags []string) map[int64]string {
 	// Remove comma postfix
 	rawSql = rawSql[0 : len(rawSql)-1]
 	rawSql += ");"
-	stmt, err := dbConn.PrepareContext(ctx, rawSql)
+	stmt, err := db.PrepareContext(ctx, rawSql)
 	if err != nil {
 		log.Printf("ERROR: preparing statement for tag ids failed: %v", err)
 		return map[int64]string{}
@@ -181,6 +328,7 @@ func getTagsIds(ctx context.Context, tags []string) map[int64]string {
 		log.Printf("ERROR: getting tag ids failed: %v", err)
 		return map[int64]string{}
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var tagId int64
 		var tag string
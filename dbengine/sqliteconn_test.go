@@ -31,8 +31,8 @@ func TestInsertTags(t *testing.T) {
 		time.Duration(5)*time.Second)
 	defer cancel()
 
-	UpdateDbRef(memDb)
 	CreateSchema(memDb)
+	store := NewStore(memDb)
 
 	type args struct {
 		ctx  context.Context
@@ -52,7 +52,7 @@ func TestInsertTags(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := InsertTags(tt.args.ctx, tt.args.tags)
+			got := store.InsertTags(tt.args.ctx, testUserId, tt.args.tags)
 			if got != tt.want {
 				t.Errorf("%s: InsertTags() = %v, want %v",
 					tt.name,
@@ -76,11 +76,9 @@ func TestInsertTags(t *testing.T) {
 	if !reflect.DeepEqual(insertedTags, expectedTags) {
 		t.Errorf("ERROR: mismatch in insertedTags: %v", insertedTags)
 	}
-
-	ShutdownDb()
 }
 
-func TestgetTagsIds(t *testing.T) {
+func Test_getTagsIds(t *testing.T) {
 	expectedTags := []string{"computershop", "laptop", "2019-05-15"}
 	memDb, _ := sql.Open("sqlite3", ":memory:")
 	defer memDb.Close()
@@ -88,10 +86,10 @@ func TestgetTagsIds(t *testing.T) {
 		time.Duration(5)*time.Second)
 	defer cancel()
 
-	UpdateDbRef(memDb)
 	CreateSchema(memDb)
+	store := NewStore(memDb)
 
-	_, err := memDb.Exec(`INSERT INTO tag (tag) VALUES ('computershop'), ('laptop'), ('2019-05-15');`)
+	_, err := memDb.Exec(`INSERT INTO tag (owner_id, tag) VALUES (1, 'computershop'), (1, 'laptop'), (1, '2019-05-15');`)
 	if err != nil {
 		log.Fatalf("Unexpected error on SQL INSERT: %v", err)
 	}
@@ -103,12 +101,12 @@ func TestgetTagsIds(t *testing.T) {
 	tests := []struct {
 		name string
 		args args
-		want map[int]string
+		want map[int64]string
 	}{
 		{
 			"Laptop purchase",
 			args{ctx, expectedTags},
-			map[int]string{
+			map[int64]string{
 				1: expectedTags[0],
 				2: expectedTags[1],
 				3: expectedTags[2],
@@ -117,7 +115,7 @@ func TestgetTagsIds(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := getTagsIds(tt.args.ctx, tt.args.tags)
+			got := store.getTagsIds(tt.args.ctx, testUserId, tt.args.tags)
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("%s: GetTagsIds() = %v, want %v",
 					tt.name,
@@ -126,8 +124,6 @@ func TestgetTagsIds(t *testing.T) {
 			}
 		})
 	}
-
-	ShutdownDb()
 }
 
 func TestInsertReceiptTagAssociation(t *testing.T) {
@@ -138,10 +134,10 @@ func TestInsertReceiptTagAssociation(t *testing.T) {
 		time.Duration(5)*time.Second)
 	defer cancel()
 
-	UpdateDbRef(memDb)
 	CreateSchema(memDb)
+	store := NewStore(memDb)
 
-	_, err := memDb.Exec(`INSERT INTO tag (tag) VALUES ('computershop'), ('laptop'), ('2019-05-15');`)
+	_, err := memDb.Exec(`INSERT INTO tag (owner_id, tag) VALUES (1, 'computershop'), (1, 'laptop'), (1, '2019-05-15');`)
 	if err != nil {
 		log.Fatalf("Unexpected error on SQL INSERT: %v", err)
 	}
@@ -166,8 +162,7 @@ func TestInsertReceiptTagAssociation(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := InsertReceiptTagAssociation(
-				tt.args.ctx,
+			got, err := store.InsertReceiptTagAssociation(tt.args.ctx, testUserId,
 				tt.args.receiptId,
 				tt.args.tags)
 			if (err != nil) != tt.wantErr {
@@ -223,6 +218,4 @@ func TestInsertReceiptTagAssociation(t *testing.T) {
 	if !reflect.DeepEqual(insertedAssociations, expectedAssociations) {
 		t.Errorf("ERROR: mismatch in insertedAssociations: %v", insertedAssociations)
 	}
-
-	ShutdownDb()
 }
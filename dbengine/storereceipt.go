@@ -0,0 +1,125 @@
+package dbengine
+
+import (
+	"context"
+	"log"
+	"receiptstracker-api/blobstore"
+)
+
+// NewReceipt holds everything parsed from an upload
+type NewReceipt struct {
+	Filename     string
+	MimeType     string
+	PageCount    int
+	PurchaseDate string
+	ExpiryDate   string
+	Tags         []string
+	Content      []byte
+	// Extracted tells which of the details were read from the file
+	// rather than given by the user
+	Extracted []ExtractedField
+	PurchaseDetails
+}
+
+// StoreReceipt writes the receipt file into the store and its metadata
+// into the database as a single unit for the owner. The file is written
+// before the transaction is committed and removed again if the commit
+// fails, so a failure at any step leaves neither an orphaned file nor a
+// receipt without its tags behind. Files are named after their content,
+// so a file another receipt has is used as it is. Whether one has it is
+// decided in the transaction under the lock of the file, which keeps a
+// concurrent store or deletion of the same file from interfering.
+func (s *Store) StoreReceipt(
+	ctx context.Context,
+	ownerId int64,
+	store blobstore.BlobStore,
+	receipt NewReceipt) (int64, error) {
+	unlock := s.files.lock(receipt.Filename)
+	defer unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("ERROR: beginning transaction failed: %v", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	receiptId, err := insertReceipt(ctx,
+		tx,
+		ownerId,
+		receipt.Filename,
+		receipt.MimeType,
+		receipt.PageCount,
+		receipt.PurchaseDate,
+		receipt.ExpiryDate,
+		receipt.PurchaseDetails)
+	if err != nil {
+		return 0, err
+	}
+	if err := insertTags(ctx, tx, ownerId, receipt.Tags); err != nil {
+		return 0, err
+	}
+	tagAssociationCount, err := insertReceiptTagAssociation(ctx,
+		tx,
+		ownerId,
+		receiptId,
+		receipt.Tags)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range receipt.Extracted {
+		if err := recordExtractedField(ctx, tx, receiptId, f); err != nil {
+			return 0, err
+		}
+	}
+	if err := insertOcrJob(ctx, tx, receiptId); err != nil {
+		return 0, err
+	}
+
+	otherReceipts, err := countFileReceipts(ctx, tx, receipt.Filename)
+	if err != nil {
+		return 0, err
+	}
+	// Count includes the receipt just inserted
+	exists := otherReceipts > 1
+	if !exists {
+		if err := store.Put(ctx, receipt.Filename, receipt.Content); err != nil {
+			log.Printf("ERROR: writing file %s failed: %v", receipt.Filename, err)
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("ERROR: committing receipt %s failed: %v",
+			receipt.Filename,
+			err)
+		if exists {
+			return 0, err
+		}
+		// Request may have been cancelled, the file must go regardless
+		if delErr := store.Delete(context.Background(), receipt.Filename); delErr != nil {
+			log.Printf("ERROR: removing file %s of uncommitted receipt failed: %v",
+				receipt.Filename,
+				delErr)
+		}
+		return 0, err
+	}
+	log.Printf("Wrote %d number of associations for receipt ID %d",
+		tagAssociationCount,
+		receiptId)
+	log.Printf("Wrote file %s", receipt.Filename)
+
+	return receiptId, nil
+}
+
+// countFileReceipts tells how many receipts of all users have the file
+func countFileReceipts(ctx context.Context, db dbtx, filename string) (int, error) {
+	var count int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM receipt WHERE filename = ?;",
+		filename).Scan(&count)
+	if err != nil {
+		log.Printf("ERROR: querying receipts of file %s failed: %v", filename, err)
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,188 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"receiptstracker-api/blobstore"
+	"receiptstracker-api/config"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func listDir(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read directory %s: %v", dir, err)
+	}
+	names := make([]string, 0)
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestStoreReceipt(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+	storeDir, err := ioutil.TempDir("", "receipts")
+	if err != nil {
+		log.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+	files := blobstore.NewLocalStore(storeDir)
+
+	receipt := NewReceipt{
+		Filename:     "abc.jpg",
+		MimeType:     "image/jpeg",
+		PageCount:    1,
+		PurchaseDate: "2019-05-15",
+		ExpiryDate:   "2021-05-15",
+		Tags:         []string{"computershop", "laptop"},
+		Content:      []byte{0, 1, 0, 1},
+		PurchaseDetails: PurchaseDetails{
+			Currency: "EUR",
+			Vendor:   "Computer Shop",
+		},
+	}
+
+	receiptId, err := store.StoreReceipt(ctx, testUserId, files, receipt)
+	if err != nil || receiptId != 1 {
+		t.Fatalf("StoreReceipt() = %d, %v, want 1", receiptId, err)
+	}
+	got, _ := store.GetReceipt(ctx, testUserId, receiptId)
+	want := &Receipt{1, testUserId, "abc.jpg", "image/jpeg", 1, "2019-05-15", "2021-05-15",
+		[]string{"computershop", "laptop"},
+		PurchaseDetails{nil, "EUR", "Computer Shop", ""}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("StoreReceipt() stored %v, want %v", got, want)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(storeDir, "abc.jpg"))
+	if !reflect.DeepEqual(content, receipt.Content) {
+		t.Errorf("StoreReceipt() wrote %v, want %v", content, receipt.Content)
+	}
+
+	// Same file again
+	_, err = store.StoreReceipt(ctx, testUserId, files, receipt)
+	if err != ErrReceiptExists {
+		t.Errorf("StoreReceipt() duplicate error = %v, want %v",
+			err,
+			ErrReceiptExists)
+	}
+
+	// File removed by hand but the receipt row still exists
+	os.Remove(filepath.Join(storeDir, "abc.jpg"))
+	_, err = store.StoreReceipt(ctx, testUserId, files, receipt)
+	if err != ErrReceiptExists {
+		t.Errorf("StoreReceipt() duplicate row error = %v, want %v",
+			err,
+			ErrReceiptExists)
+	}
+	if files := listDir(t, storeDir); len(files) != 0 {
+		t.Errorf("StoreReceipt() left files behind: %v", files)
+	}
+
+	// Failing file write must roll back the receipt
+	receipt.Filename = "ghi.jpg"
+	missingDir := blobstore.NewLocalStore(filepath.Join(storeDir, "missing"))
+	if _, err := store.StoreReceipt(ctx, testUserId, missingDir, receipt); err == nil {
+		t.Errorf("StoreReceipt() succeeded without a directory")
+	}
+	var count int
+	memDb.QueryRow("SELECT COUNT(*) FROM receipt WHERE filename = 'ghi.jpg';").Scan(&count)
+	if count != 0 {
+		t.Errorf("StoreReceipt() left a receipt row without a file behind")
+	}
+
+	// Failing tag insert must roll back the receipt and the file
+	if _, err := memDb.Exec("DROP TABLE tag;"); err != nil {
+		log.Fatalf("Unexpected error on SQL DROP: %v", err)
+	}
+	receipt.Filename = "def.jpg"
+	_, err = store.StoreReceipt(ctx, testUserId, files, receipt)
+	if err == nil {
+		t.Errorf("StoreReceipt() succeeded without tag table")
+	}
+	memDb.QueryRow("SELECT COUNT(*) FROM receipt WHERE filename = 'def.jpg';").Scan(&count)
+	if count != 0 {
+		t.Errorf("StoreReceipt() left a receipt row behind")
+	}
+	if files := listDir(t, storeDir); len(files) != 0 {
+		t.Errorf("StoreReceipt() left files behind: %v", files)
+	}
+}
+
+// Receipts of several users sharing a file are stored and deleted at the
+// same time, the file must stay exactly as long as a receipt has it.
+func TestStoreReceiptConcurrently(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(20)*time.Second)
+	defer cancel()
+	store, err := Open(config.DatabaseConfig{
+		Path:        filepath.Join(t.TempDir(), "receipts.db"),
+		BusyTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer store.Close()
+	files := blobstore.NewLocalStore(t.TempDir())
+	receipt := NewReceipt{
+		Filename:  "abc.jpg",
+		MimeType:  "image/jpeg",
+		PageCount: 1,
+		Content:   []byte{0, 1, 0, 1},
+	}
+
+	for round := 0; round < 20; round++ {
+		// Users with odd IDs keep their receipt
+		var wg sync.WaitGroup
+		type keptReceipt struct{ ownerId, receiptId int64 }
+		kept := make(chan keptReceipt, 4)
+		for ownerId := int64(1); ownerId <= 4; ownerId++ {
+			wg.Add(1)
+			go func(ownerId int64) {
+				defer wg.Done()
+				receiptId, err := store.StoreReceipt(ctx, ownerId, files, receipt)
+				if err != nil {
+					t.Errorf("StoreReceipt() of user %d error = %v", ownerId, err)
+					return
+				}
+				if ownerId%2 == 1 {
+					kept <- keptReceipt{ownerId, receiptId}
+					return
+				}
+				if _, err := store.DeleteReceipt(ctx, ownerId, files, receiptId); err != nil {
+					t.Errorf("DeleteReceipt() of user %d error = %v", ownerId, err)
+				}
+			}(ownerId)
+		}
+		wg.Wait()
+		close(kept)
+
+		if exists, _ := files.Exists(ctx, receipt.Filename); !exists {
+			t.Fatalf("Round %d: file removed while receipts still have it", round)
+		}
+		for k := range kept {
+			if _, err := store.DeleteReceipt(ctx, k.ownerId, files, k.receiptId); err != nil {
+				t.Fatalf("DeleteReceipt() error = %v", err)
+			}
+		}
+		if exists, _ := files.Exists(ctx, receipt.Filename); exists {
+			t.Fatalf("Round %d: file left behind after its last receipt", round)
+		}
+	}
+}
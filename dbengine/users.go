@@ -0,0 +1,114 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	ErrUserNotFound = errors.New("User not found")
+	ErrUserExists   = errors.New("User already exists")
+)
+
+// User owns receipts, tags and API tokens of their own
+type User struct {
+	Id        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *Store) CreateUser(ctx context.Context, name string) (*User, error) {
+	user := &User{
+		Name:      name,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	res, err := s.db.ExecContext(ctx, `
+INSERT INTO user(
+	name,
+	created_at
+) VALUES (
+	:name,
+	:created_at);`,
+		sql.Named("name", name),
+		sql.Named("created_at", formatTimestamp(user.CreatedAt)),
+	)
+	if isUniqueViolation(err) {
+		return nil, ErrUserExists
+	}
+	if err != nil {
+		log.Printf("ERROR: inserting user %q failed: %v", name, err)
+		return nil, err
+	}
+	if user.Id, err = res.LastInsertId(); err != nil {
+		log.Printf("ERROR: failed to get last inserted id: %v", err)
+		return nil, err
+	}
+	return user, nil
+}
+
+// SetUserEmail sets the address the user's expiry reminders are sent to,
+// an empty one stopping them
+func (s *Store) SetUserEmail(ctx context.Context, name string, email string) error {
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE user SET email = ? WHERE name = ?;",
+		email,
+		name)
+	if err != nil {
+		log.Printf("ERROR: setting e-mail of user %q failed: %v", name, err)
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// GetUserByName returns ErrUserNotFound when there is no such user
+func (s *Store) GetUserByName(ctx context.Context, name string) (*User, error) {
+	return getUserByName(ctx, s.db, name)
+}
+
+func getUserByName(ctx context.Context, db dbtx, name string) (*User, error) {
+	var user User
+	err := db.QueryRowContext(ctx,
+		"SELECT id, name, email, created_at FROM user WHERE name = ?;",
+		name).Scan(&user.Id, &user.Name, &user.Email, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		log.Printf("ERROR: querying user %q failed: %v", name, err)
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ListUsers returns the users in the order they were created
+func (s *Store) ListUsers(ctx context.Context) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, name, email, created_at FROM user ORDER BY id;")
+	if err != nil {
+		log.Printf("ERROR: querying users failed: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]User, 0)
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.Id, &user.Name, &user.Email, &user.CreatedAt); err != nil {
+			log.Printf("ERROR: failed to scan user: %v", err)
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
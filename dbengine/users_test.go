@@ -0,0 +1,55 @@
+package dbengine
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestUsers(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	CreateSchema(memDb)
+	store := NewStore(memDb)
+
+	alice, err := store.CreateUser(ctx, "alice")
+	if err != nil || alice.Id == 0 {
+		t.Fatalf("CreateUser() = %v, %v", alice, err)
+	}
+	if _, err := store.CreateUser(ctx, "alice"); err != ErrUserExists {
+		t.Errorf("CreateUser() twice error = %v, want %v", err, ErrUserExists)
+	}
+	if _, err := store.CreateUser(ctx, "bob"); err != nil {
+		t.Errorf("CreateUser() error = %v", err)
+	}
+
+	got, err := store.GetUserByName(ctx, "alice")
+	if err != nil || got.Id != alice.Id || !got.CreatedAt.Equal(alice.CreatedAt) {
+		t.Errorf("GetUserByName() = %v, %v, want %v", got, err, alice)
+	}
+	if _, err := store.GetUserByName(ctx, "carol"); err != ErrUserNotFound {
+		t.Errorf("GetUserByName() of missing user error = %v, want %v", err, ErrUserNotFound)
+	}
+
+	if err := store.SetUserEmail(ctx, "bob", "bob@example.com"); err != nil {
+		t.Errorf("SetUserEmail() error = %v", err)
+	}
+	if err := store.SetUserEmail(ctx, "carol", "carol@example.com"); err != ErrUserNotFound {
+		t.Errorf("SetUserEmail() of missing user error = %v, want %v", err, ErrUserNotFound)
+	}
+
+	users, err := store.ListUsers(ctx)
+	if err != nil || len(users) != 2 || users[0].Name != "alice" || users[1].Name != "bob" {
+		t.Errorf("ListUsers() = %v, %v, want alice and bob", users, err)
+	}
+	if len(users) == 2 && (users[0].Email != "" || users[1].Email != "bob@example.com") {
+		t.Errorf("ListUsers() e-mails = %q %q, want only bob's", users[0].Email, users[1].Email)
+	}
+}
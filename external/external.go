@@ -1,15 +1,18 @@
 package external
 
+import "time"
+
 const (
-	PORT             string = ":8081"
-	UPLOAD_DIRECTORY string = "img"
-	MAX_FILE_SIZE    int64  = 16 * 1024 * 1024
-)
+	MAX_JSON_BODY_SIZE int64 = 64 * 1024
+	DEFAULT_PAGE_SIZE  int   = 50
+	MAX_PAGE_SIZE      int   = 500
 
-var AllowedExtensions []string = []string{
-	"gif",
-	"jpg",
-	"jpeg",
-	"png",
-	"tiff",
-}
+	NOTIFICATION_INTERVAL time.Duration = time.Hour
+
+	OCR_POLL_INTERVAL time.Duration = time.Minute
+	OCR_RETRY_DELAY   time.Duration = 5 * time.Minute
+	OCR_MAX_ATTEMPTS  int           = 3
+	// Photos are often taken later than the purchase, so the capture
+	// time gives way to any date read from the receipt itself
+	CAPTURE_DATE_CONFIDENCE float64 = 0.5
+)
@@ -1,5 +1,11 @@
 module receiptstracker-api
 
-go 1.13
+go 1.19
 
-require github.com/mattn/go-sqlite3 v2.0.3+incompatible
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/mattn/go-sqlite3 v2.0.3+incompatible
+	golang.org/x/image v0.24.0
+	gopkg.in/yaml.v3 v3.0.1
+	rsc.io/pdf v0.1.1
+)
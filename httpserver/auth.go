@@ -0,0 +1,106 @@
+package httpserver
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"receiptstracker-api/dbengine"
+	"strings"
+)
+
+type contextKey int
+
+// apiTokenKey keeps the token a request was let in with in its context
+const apiTokenKey contextKey = 0
+
+// requestUserId returns the user whose token let the request in
+func requestUserId(r *http.Request) int64 {
+	apiToken, ok := r.Context().Value(apiTokenKey).(*dbengine.ApiToken)
+	if !ok {
+		return 0
+	}
+	return apiToken.UserId
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// redactedHeader returns a copy of the header safe to log, without the
+// token of the request
+func redactedHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	if redacted.Get("Authorization") != "" {
+		redacted.Set("Authorization", "[REDACTED]")
+	}
+	return redacted
+}
+
+// authorize lets requests through to next only with a valid token,
+// which next finds in the request context. Reading, i.e. GET and HEAD,
+// needs readScope and everything else writeScope.
+func (s *Server) authorize(readScope string, writeScope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope := writeScope
+		if r.Method == "GET" || r.Method == "HEAD" {
+			scope = readScope
+		}
+
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="receipts"`)
+			WriteApiError(w, r, &ApiError{
+				Status:  http.StatusUnauthorized,
+				Code:    "unauthorized",
+				Message: "Missing bearer token",
+			})
+			return
+		}
+		apiToken, err := s.tokens.Authenticate(r.Context(), token)
+		if err == dbengine.ErrInvalidToken {
+			log.Printf("Rejected %s %s from %s: %v",
+				r.Method,
+				r.URL.Path,
+				r.RemoteAddr,
+				err)
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="receipts", error="invalid_token"`)
+			WriteApiError(w, r, &ApiError{
+				Status:  http.StatusUnauthorized,
+				Code:    "unauthorized",
+				Message: err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			WriteApiError(w, r, &ApiError{
+				Status:  http.StatusInternalServerError,
+				Code:    "internal_server_error",
+				Message: "Failed to check token",
+			})
+			return
+		}
+		if !apiToken.HasScope(scope) {
+			log.Printf("Rejected %s %s from %s: token %d lacks scope %s",
+				r.Method,
+				r.URL.Path,
+				r.RemoteAddr,
+				apiToken.Id,
+				scope)
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="receipts", error="insufficient_scope", scope="`+scope+`"`)
+			WriteApiError(w, r, &ApiError{
+				Status:  http.StatusForbidden,
+				Code:    "forbidden",
+				Message: "Token lacks the " + scope + " scope",
+			})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey, apiToken)))
+	}
+}
@@ -0,0 +1,82 @@
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_authorize(t *testing.T) {
+	t.Parallel()
+	handler := testServer(t).Handler()
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization string
+		wantStatus    int
+	}{
+		{"Missing token", "GET", "/receipts/", "", http.StatusUnauthorized},
+		{"Upload page", "GET", "/", "", http.StatusOK},
+		{"Upload without token", "POST", "/", "", http.StatusUnauthorized},
+		{"Other page", "GET", "/other", "", http.StatusUnauthorized},
+		{"Other scheme", "GET", "/receipts/", "Basic " + readToken, http.StatusUnauthorized},
+		{"Unknown token", "GET", "/receipts/", "Bearer rt_unknown", http.StatusUnauthorized},
+		{"Read", "GET", "/receipts/", "Bearer " + readToken, http.StatusOK},
+		{"Scheme in lower case", "GET", "/receipts/", "bearer " + readToken, http.StatusOK},
+		{"Write with read token", "DELETE", "/receipts/1", "Bearer " + readToken, http.StatusForbidden},
+		{"Upload with read token", "POST", "/receipts/", "Bearer " + readToken, http.StatusForbidden},
+		{"Write", "DELETE", "/receipts/1", "Bearer " + writeToken, http.StatusNotFound},
+		{"Report", "GET", "/reports/spending", "Bearer " + readToken, http.StatusOK},
+		{"Tokens with write token", "GET", "/tokens/", "Bearer " + writeToken, http.StatusForbidden},
+		{"Tokens", "GET", "/tokens/", "Bearer " + adminToken, http.StatusOK},
+		{"Admin reads receipts", "GET", "/receipts/", "Bearer " + adminToken, http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("%s: %s %s = %d %s, want %d",
+					tt.name,
+					tt.method,
+					tt.path,
+					rec.Code,
+					rec.Body.String(),
+					tt.wantStatus)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s: missing WWW-Authenticate header", tt.name)
+			}
+		})
+	}
+}
+
+func Test_redactedHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+readToken)
+	header.Set("Content-Type", "image/jpeg")
+
+	logged := fmt.Sprint(redactedHeader(header))
+	if strings.Contains(logged, readToken) {
+		t.Errorf("redactedHeader() = %s, shows the token", logged)
+	}
+	if !strings.Contains(logged, "image/jpeg") {
+		t.Errorf("redactedHeader() = %s, want the other headers", logged)
+	}
+	if header.Get("Authorization") != "Bearer "+readToken {
+		t.Errorf("redactedHeader() changed the request header")
+	}
+}
@@ -1,6 +1,8 @@
 package httpserver
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -8,15 +10,35 @@ import (
 	"path/filepath"
 	"receiptstracker-api/dbengine"
 	"receiptstracker-api/external"
+	"receiptstracker-api/imagemeta"
+	"receiptstracker-api/thumbnail"
 	"receiptstracker-api/utils"
+	"strings"
+	"time"
 )
 
-func ApiHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// UploadResult is returned to JSON clients after a successful upload
+type UploadResult struct {
+	Id           int64    `json:"id"`
+	Filename     string   `json:"filename"`
+	MimeType     string   `json:"mime_type"`
+	PageCount    int      `json:"page_count"`
+	FileHash     string   `json:"file_hash"`
+	PurchaseDate string   `json:"purchase_date,omitempty"`
+	ExpiryDate   string   `json:"expiry_date,omitempty"`
+	Tags         []string `json:"tags"`
+	dbengine.PurchaseDetails
+}
 
+// OcrQueue is told about receipts whose text should be recognised
+type OcrQueue interface {
+	Enqueue(receiptId int64)
+}
+
+func (s *Server) ApiHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Incoming %s [%v] connection from %s with size %d bytes",
 		r.Method,
-		r.Header,
+		redactedHeader(r.Header),
 		r.RemoteAddr,
 		r.ContentLength)
 
@@ -27,118 +49,276 @@ func ApiHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	case "POST":
-		// Limit request's maximum size to 16.5 MB
-		r.Body = http.MaxBytesReader(w, r.Body, external.MAX_FILE_SIZE+512)
-		if err := r.ParseMultipartForm(external.MAX_FILE_SIZE); err != nil {
-			log.Printf("ERROR: parsing form failed: %v", err)
-			userErrMsg := "Couldn't parse form or mandatory value(s) missing"
-			fmt.Fprint(w, userErrMsg+"\r\n")
+		result, apiErr := s.storeUpload(w, r)
+		if apiErr != nil {
+			WriteApiError(w, r, apiErr)
 			return
 		}
 
-		tags := NormaliseTags(r.FormValue("tags"))
-		log.Printf("Parsed tags: %v", *tags)
-
-		formFile, formFileHeaders, err := r.FormFile("file")
-		if err != nil {
-			log.Printf("ERROR: no file included")
-			fmt.Fprint(w, "Missing 'file' parameter\r\n")
+		w.Header().Set("Location", fmt.Sprintf("/receipts/%d", result.Id))
+		if WantsJSON(r) {
+			WriteJSON(w, http.StatusCreated, result)
 			return
 		}
-		if utils.IsAllowedFileExt(formFileHeaders.Filename) == false {
-			log.Printf("ERROR: file extension not allowed: %s",
-				formFileHeaders.Filename)
-			fmt.Fprintf(w, "ERROR: File extension not allowed. Allowed extensions: %v\r\n",
-				external.AllowedExtensions)
-			return
+		doneMsg := fmt.Sprintf("Storing of receipt %s completed with ID %d",
+			result.Filename,
+			result.Id)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, doneMsg+"\r\n")
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		WriteApiError(w, r, &ApiError{
+			Status:  http.StatusMethodNotAllowed,
+			Code:    "method_not_allowed",
+			Message: "Supported methods: GET, POST",
+		})
+		return
+	}
+}
+
+func isTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// storeUpload parses the multipart form and stores the receipt in it
+func (s *Server) storeUpload(w http.ResponseWriter, r *http.Request) (*UploadResult, *ApiError) {
+	ctx := r.Context()
+
+	tooLargeErr := &ApiError{
+		Status: http.StatusRequestEntityTooLarge,
+		Code:   "file_too_large",
+		Message: fmt.Sprintf("File is larger than the maximum of %d bytes",
+			s.cfg.MaxFileSize),
+	}
+
+	// Leave room for the form fields next to the file
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxFileSize+512)
+	if err := r.ParseMultipartForm(s.cfg.MaxFileSize); err != nil {
+		log.Printf("ERROR: parsing form failed: %v", err)
+		if isTooLarge(err) {
+			return nil, tooLargeErr
 		}
-		// Get binary from form
-		binFile, err := ioutil.ReadAll(formFile)
-		if err != nil {
-			log.Printf("ERROR: reading file %s failed: %v",
-				formFileHeaders.Filename,
-				err)
-			fmt.Fprint(w, "Error while reading file binary\r\n")
-			return
+		return nil, &ApiError{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_form",
+			Message: "Couldn't parse form or mandatory value(s) missing",
 		}
-		filename, err := CalculateFileHash(binFile, formFileHeaders)
-		if err != nil {
-			log.Printf("ERROR: %s", err)
-			fmt.Fprintf(w, "%s\r\n", err)
-			return
+	}
+
+	tags := NormaliseTags(r.FormValue("tags"))
+	log.Printf("Parsed tags: %v", *tags)
+	details, err := ParsePurchaseDetails(r.Form, tags)
+	if err != nil {
+		log.Printf("ERROR: parsing purchase details failed: %v", err)
+		return nil, &ApiError{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_purchase_details",
+			Message: err.Error(),
 		}
-		log.Printf("Hash of incoming filename %s is %s",
+	}
+
+	formFile, formFileHeaders, err := r.FormFile("file")
+	if err != nil {
+		log.Printf("ERROR: no file included")
+		return nil, &ApiError{
+			Status:  http.StatusBadRequest,
+			Code:    "missing_file",
+			Message: "Missing 'file' parameter",
+		}
+	}
+	defer formFile.Close()
+	if utils.IsAllowedFileExt(formFileHeaders.Filename, s.cfg.AllowedExtensions) == false {
+		log.Printf("ERROR: file extension not allowed: %s",
+			formFileHeaders.Filename)
+		return nil, &ApiError{
+			Status: http.StatusUnsupportedMediaType,
+			Code:   "unsupported_file_type",
+			Message: fmt.Sprintf("ERROR: File extension not allowed. Allowed extensions: %v",
+				s.cfg.AllowedExtensions),
+		}
+	}
+	// Get binary from form
+	binFile, err := ioutil.ReadAll(formFile)
+	if err != nil {
+		log.Printf("ERROR: reading file %s failed: %v",
 			formFileHeaders.Filename,
-			filename)
-		// Write or try to write file
-		writePath := filepath.Join(external.UPLOAD_DIRECTORY, filename)
-		duplicate, err := utils.PathExists(writePath)
-		if duplicate {
-			fmt.Fprint(w, "Error: receipt already archived\r\n")
-			log.Printf("ERROR: Receipt already archived: %v", err)
-			return
+			err)
+		if isTooLarge(err) {
+			return nil, tooLargeErr
 		}
-		err = ioutil.WriteFile(writePath, binFile, 0600)
-		if err != nil {
-			log.Printf("ERROR: writing file %s: %v", writePath, err)
-			fmt.Fprint(w, "Failed to save file\r\n")
-			return
+		return nil, &ApiError{
+			Status:  http.StatusInternalServerError,
+			Code:    "read_failed",
+			Message: "Error while reading file binary",
 		}
-		log.Printf("Wrote file to %s", writePath)
+	}
+	if len(binFile) == 0 {
+		log.Printf("ERROR: empty file %s", formFileHeaders.Filename)
+		return nil, &ApiError{
+			Status:  http.StatusBadRequest,
+			Code:    "empty_file",
+			Message: "Empty file",
+		}
+	}
+	// Extension of the upload is only what the client claims
+	mimeType, pageCount, err := DetectFileType(binFile, s.cfg.MaxPdfPages, s.cfg.MaxImagePixels)
+	if err != nil {
+		log.Printf("ERROR: %s: %v", formFileHeaders.Filename, err)
+		return nil, &ApiError{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    "unsupported_file_type",
+			Message: err.Error(),
+		}
+	}
+	if claimedType := ContentTypeByFilename(formFileHeaders.Filename); claimedType != mimeType {
+		log.Printf("ERROR: %s has content of type %s",
+			formFileHeaders.Filename,
+			mimeType)
+		return nil, &ApiError{
+			Status: http.StatusUnsupportedMediaType,
+			Code:   "content_type_mismatch",
+			Message: fmt.Sprintf("File extension claims %s but the content is %s",
+				claimedType,
+				mimeType),
+		}
+	}
+	// Photos are archived without location or device details and
+	// upright, so that any viewer shows them the right way
+	binFile, imageMeta, err := imagemeta.Clean(binFile, mimeType, s.cfg.MaxImagePixels)
+	if err != nil {
+		log.Printf("ERROR: cleaning %s failed: %v", formFileHeaders.Filename, err)
+		return nil, &ApiError{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_image",
+			Message: "Couldn't read the image: " + err.Error(),
+		}
+	}
+	filename, err := CalculateFileHash(binFile, mimeType)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return nil, &ApiError{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    "unsupported_file_type",
+			Message: err.Error(),
+		}
+	}
+	log.Printf("Hash of incoming filename %s is %s",
+		formFileHeaders.Filename,
+		filename)
+
+	var expiryDate string = ""
+	var purchaseDate string = ""
+	var extracted []dbengine.ExtractedField
+	purchaseDateTmp, err := ParsePurchaseDate(tags)
+	if err != nil && s.cfg.CaptureDate && isPastCaptureTime(imageMeta.CapturedAt) {
+		log.Printf("Using capture time of %s as purchase date",
+			formFileHeaders.Filename)
+		purchaseDateTmp, err = imageMeta.CapturedAt, nil
+		extracted = append(extracted, dbengine.ExtractedField{
+			Field:      "purchase_date",
+			Value:      purchaseDateTmp.Format("2006-01-02"),
+			Confidence: external.CAPTURE_DATE_CONFIDENCE,
+		})
+	}
+	if err != nil {
+		log.Printf("WARNING: no purchase date: %v", err)
+	} else {
+		purchaseDate = purchaseDateTmp.Format("2006-01-02")
+		log.Printf("Found and parsed purchase date: %s",
+			purchaseDate)
 
-		var expiryDate string = ""
-		var purchaseDate string = ""
-		purchaseDateTmp, err := ParsePurchaseDate(tags)
+		expiryDateTmp, err := ParseExpiryDate(tags, purchaseDateTmp)
 		if err != nil {
-			log.Printf("WARNING: no purchase date: %v", err)
+			log.Printf("WARNING: no expiry date: %v", err)
 		} else {
-			purchaseDate = purchaseDateTmp.Format("2006-01-02")
-			log.Printf("Found and parsed purchase date: %s",
-				purchaseDate)
-
-			expiryDateTmp, err := ParseExpiryDate(tags, purchaseDateTmp)
-			if err != nil {
-				log.Printf("WARNING: no expiry date: %v", err)
-			} else {
-				expiryDate = expiryDateTmp.Format("2006-01-02")
-				log.Printf("Found and parsed expiry date: %s",
-					expiryDate)
-			}
-		}
-
-		// XXX Handle format here
-		receiptId, err := dbengine.InsertReceipt(
-			ctx,
-			filename,
-			purchaseDate,
-			expiryDate)
-		if err != nil {
-			// TODO Show error to user
-			return
+			expiryDate = expiryDateTmp.Format("2006-01-02")
+			log.Printf("Found and parsed expiry date: %s",
+				expiryDate)
 		}
-		tagsWriteSucceed := dbengine.InsertTags(ctx, *tags)
-		if tagsWriteSucceed == false {
-			fmt.Fprint(w, "Failed to write tags\r\n")
-			return
+	}
+
+	receiptId, err := s.db.StoreReceipt(
+		ctx,
+		requestUserId(r),
+		s.store,
+		dbengine.NewReceipt{
+			Filename:        filename,
+			MimeType:        mimeType,
+			PageCount:       pageCount,
+			PurchaseDate:    purchaseDate,
+			ExpiryDate:      expiryDate,
+			Tags:            *tags,
+			Content:         binFile,
+			Extracted:       extracted,
+			PurchaseDetails: details,
+		})
+	if err == dbengine.ErrReceiptExists {
+		log.Printf("ERROR: Receipt already archived: %s", filename)
+		return nil, &ApiError{
+			Status:  http.StatusConflict,
+			Code:    "receipt_exists",
+			Message: "Error: receipt already archived",
 		}
-		tagAssociationCount, err := dbengine.InsertReceiptTagAssociation(
-			ctx,
-			receiptId,
-			*tags)
-		if err != nil {
-			fmt.Fprint(w, "Failed to write receipt ID <-> tag IDs associations")
-			return
+	}
+	if err != nil {
+		log.Printf("ERROR: storing receipt %s failed: %v", filename, err)
+		return nil, &ApiError{
+			Status:  http.StatusInternalServerError,
+			Code:    "store_failed",
+			Message: "Failed to save receipt",
 		}
-		log.Printf("Wrote %d number of associations for receipt ID %d",
-			tagAssociationCount,
-			receiptId)
+	}
+	log.Printf("Storing of receipt %s completed with ID %d",
+		filename,
+		receiptId)
+	if s.ocrQueue != nil {
+		s.ocrQueue.Enqueue(receiptId)
+	}
+	if strings.HasPrefix(mimeType, "image/") {
+		// Missing ones are generated on request, no need to wait here
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.generateThumbnails(filename, binFile)
+		}()
+	}
 
-		doneMsg := fmt.Sprintf("Storing of receipt %s completed",
-			filename)
-		log.Print(doneMsg)
-		fmt.Fprint(w, doneMsg+"\r\n")
-	default:
-		fmt.Fprint(w, "Supported methods: GET, POST\r\n")
-		return
+	return &UploadResult{
+		Id:              receiptId,
+		Filename:        filename,
+		MimeType:        mimeType,
+		PageCount:       pageCount,
+		FileHash:        fileHashOf(filename),
+		PurchaseDate:    purchaseDate,
+		ExpiryDate:      expiryDate,
+		Tags:            *tags,
+		PurchaseDetails: details,
+	}, nil
+}
+
+// isPastCaptureTime filters out unset and obviously wrong camera clocks.
+// The capture time has no zone, so a day ahead is still accepted.
+func isPastCaptureTime(capturedAt time.Time) bool {
+	return !capturedAt.IsZero() && capturedAt.Before(time.Now().AddDate(0, 0, 1))
+}
+
+// generateThumbnails caches the thumbnails on the local disk even when
+// the receipts are kept elsewhere.
+func (s *Server) generateThumbnails(filename string, content []byte) {
+	err := thumbnail.Generate(
+		bytes.NewReader(content),
+		s.cfg.ThumbnailDir,
+		fileHashOf(filename),
+		s.cfg.ThumbnailSizes,
+		s.cfg.MaxImagePixels)
+	if err != nil {
+		log.Printf("ERROR: generating thumbnails of %s failed: %v", filename, err)
 	}
 }
+
+// fileHashOf strips the extension from the stored filename
+func fileHashOf(filename string) string {
+	return strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+}
@@ -0,0 +1,149 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"receiptstracker-api/blobstore"
+	"receiptstracker-api/config"
+	"receiptstracker-api/dbengine"
+	"testing"
+)
+
+// testServer keeps the receipts in memory and their files in a
+// temporary directory
+func testServer(t *testing.T, receipts ...dbengine.Receipt) *Server {
+	cfg := config.Default()
+	cfg.ThumbnailDir = t.TempDir()
+	return NewServer(
+		cfg,
+		newFakeRepository(receipts...),
+		newFakeTokens(),
+		blobstore.NewLocalStore(t.TempDir()),
+		nil)
+}
+
+func multipartBody(t *testing.T, filename string, content []byte) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if err := writer.WriteField("tags", "shop 2019-08-06"); err != nil {
+		t.Fatalf("Failed to write field: %v", err)
+	}
+	if filename != "" {
+		part, err := writer.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatalf("Failed to create form file: %v", err)
+		}
+		part.Write(content)
+	}
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+func Test_apiHandlerErrors(t *testing.T) {
+	t.Parallel()
+	jpegImage := encodeImage(t, "jpeg")
+	tests := []struct {
+		name       string
+		method     string
+		filename   string
+		content    []byte
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			"Missing file",
+			"POST",
+			"",
+			nil,
+			http.StatusBadRequest,
+			"missing_file",
+		},
+		{
+			"Extension not allowed",
+			"POST",
+			"receipt.exe",
+			[]byte{1, 2, 3},
+			http.StatusUnsupportedMediaType,
+			"unsupported_file_type",
+		},
+		{
+			"Empty file",
+			"POST",
+			"receipt.jpg",
+			[]byte{},
+			http.StatusBadRequest,
+			"empty_file",
+		},
+		{
+			"Renamed executable",
+			"POST",
+			"receipt.png",
+			[]byte("MZ\x90\x00\x03\x00\x00\x00"),
+			http.StatusUnsupportedMediaType,
+			"unsupported_file_type",
+		},
+		{
+			"Extension not matching the content",
+			"POST",
+			"receipt.png",
+			jpegImage,
+			http.StatusUnsupportedMediaType,
+			"content_type_mismatch",
+		},
+		{
+			"Image cut short",
+			"POST",
+			"receipt.jpg",
+			jpegImage[:len(jpegImage)-2],
+			http.StatusBadRequest,
+			"invalid_image",
+		},
+		{
+			"Too large",
+			"POST",
+			"receipt.jpg",
+			make([]byte, config.Default().MaxFileSize+1024),
+			http.StatusRequestEntityTooLarge,
+			"file_too_large",
+		},
+		{
+			"Unsupported method",
+			"PUT",
+			"",
+			nil,
+			http.StatusMethodNotAllowed,
+			"method_not_allowed",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			body, contentType := multipartBody(t, tt.filename, tt.content)
+			req := httptest.NewRequest(tt.method, "/receipts/", body)
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+
+			testServer(t).ApiHandler(rec, req)
+
+			var got ApiError
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatalf("%s: ApiHandler() returned malformed JSON: %v",
+					tt.name,
+					err)
+			}
+			if rec.Code != tt.wantStatus || got.Code != tt.wantCode {
+				t.Errorf("%s: ApiHandler() = %d %q, want %d %q",
+					tt.name,
+					rec.Code,
+					got.Code,
+					tt.wantStatus,
+					tt.wantCode)
+			}
+		})
+	}
+}
@@ -1,18 +1,29 @@
 package httpserver
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"log"
-	"mime/multipart"
-	"path/filepath"
+	"mime"
+	"net/http"
+	"net/url"
+	"receiptstracker-api/dbengine"
+	"receiptstracker-api/external"
 	"receiptstracker-api/utils"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	_ "golang.org/x/image/tiff"
 )
 
 var expiryDatePat = regexp.MustCompile(`^[0-9]+_(day|month|year)s?$`)
@@ -77,15 +88,16 @@ func ParseExpiryDate(tags *[]string, startDate time.Time) (time.Time, error) {
 	return time.Time{}, errors.New("No expiry time found")
 }
 
-func CalculateFileHash(binFile []byte,
-	formFileHeaders *multipart.FileHeader) (string, error) {
+// CalculateFileHash names the file by its SHA-256 hash and the
+// extension of its detected MIME type.
+func CalculateFileHash(binFile []byte, mimeType string) (string, error) {
 	if len(binFile) == 0 {
 		return "", errors.New("Empty file")
 	}
-
-	tmp := filepath.Ext(formFileHeaders.Filename)
-	fileExt := strings.Trim(tmp, ".")
-	fileExt = strings.ToLower(fileExt)
+	fileExt, found := fileExtensions[mimeType]
+	if !found {
+		return "", fmt.Errorf("Unsupported file type %s", mimeType)
+	}
 
 	tmpHash := sha256.Sum256(binFile)
 	fileHash := hex.EncodeToString(tmpHash[:])
@@ -95,6 +107,72 @@ func CalculateFileHash(binFile []byte,
 	return fullFileName, nil
 }
 
+// tiff is not among the types http.DetectContentType knows
+var tiffSignatures = [][]byte{
+	[]byte("II*\x00"),
+	[]byte("MM\x00*"),
+}
+
+// DetectFileType tells the MIME type of an uploaded receipt from its
+// content together with its number of pages. Images have one page.
+func DetectFileType(
+	content []byte,
+	maxPdfPages int,
+	maxImagePixels int64) (string, int, error) {
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(content))
+	if mimeType != "application/pdf" {
+		imageType, err := DetectImageType(content, maxImagePixels)
+		if err != nil {
+			return "", 0, err
+		}
+		return imageType, 1, nil
+	}
+
+	pageCount, err := utils.PdfPageCount(content)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid PDF: %v", err)
+	}
+	if pageCount > maxPdfPages {
+		return "", 0, fmt.Errorf("PDF has %d pages, at most %d are allowed",
+			pageCount,
+			maxPdfPages)
+	}
+	return mimeType, pageCount, nil
+}
+
+// DetectImageType tells the MIME type of an uploaded image from its
+// content. The image header is decoded too so that a file which only
+// starts like an image is rejected, as is one larger than maxPixels.
+func DetectImageType(content []byte, maxPixels int64) (string, error) {
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(content))
+	for _, signature := range tiffSignatures {
+		if bytes.HasPrefix(content, signature) {
+			mimeType = "image/tiff"
+		}
+	}
+	if _, found := fileExtensions[mimeType]; !found ||
+		!strings.HasPrefix(mimeType, "image/") {
+		return "", fmt.Errorf("File content is %s, not an image", mimeType)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("Invalid %s image: %v", mimeType, err)
+	}
+	if "image/"+format != mimeType {
+		return "", fmt.Errorf("File content is %s but decodes as %s",
+			mimeType,
+			format)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return "", errors.New("Image has no pixels")
+	}
+	if err := utils.CheckImageSize(config, maxPixels); err != nil {
+		return "", err
+	}
+	return mimeType, nil
+}
+
 func NormaliseTags(tags string) *[]string {
 	keys := make(map[string]bool)
 	list := &[]string{}
@@ -114,3 +192,307 @@ func NormaliseTags(tags string) *[]string {
 	}
 	return list
 }
+
+// ParsePagination reads limit and offset query parameters, falling back
+// to the default page size when limit is not given.
+func ParsePagination(query url.Values) (int, int, error) {
+	limit := external.DEFAULT_PAGE_SIZE
+	offset := 0
+
+	if l := query.Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed < 1 || parsed > external.MAX_PAGE_SIZE {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d",
+				external.MAX_PAGE_SIZE)
+		}
+		limit = parsed
+	}
+	if o := query.Get("offset"); o != "" {
+		parsed, err := strconv.Atoi(o)
+		if err != nil || parsed < 0 {
+			return 0, 0, errors.New("offset must be a non-negative number")
+		}
+		offset = parsed
+	}
+	return limit, offset, nil
+}
+
+// splitQueryTags accepts both comma and whitespace separated tags.
+func splitQueryTags(tags string) []string {
+	return *NormaliseTags(strings.Replace(tags, ",", " ", -1))
+}
+
+// ParseTagSearch builds a receipt filter from tags, not and mode query
+// parameters. Mode is either "all" (default) or "any".
+func ParseTagSearch(query url.Values) (dbengine.ReceiptFilter, error) {
+	filter, err := ParseDateFilters(query)
+	if err != nil {
+		return dbengine.ReceiptFilter{}, err
+	}
+	filter.Tags = splitQueryTags(query.Get("tags"))
+	filter.ExcludedTags = splitQueryTags(query.Get("not"))
+
+	switch query.Get("mode") {
+	case "", "all":
+		filter.MatchAllTags = true
+	case "any":
+		filter.MatchAllTags = false
+	default:
+		return dbengine.ReceiptFilter{},
+			errors.New("mode must be either 'all' or 'any'")
+	}
+
+	if len(filter.Tags) == 0 && len(filter.ExcludedTags) == 0 {
+		return dbengine.ReceiptFilter{},
+			errors.New("At least one of 'tags' or 'not' is required")
+	}
+	return filter, nil
+}
+
+// ParseDateFilters reads purchased_after, purchased_before, expires_after,
+// expires_before and expired query parameters. Dates must be given in
+// YYYY-MM-DD format.
+func ParseDateFilters(query url.Values) (dbengine.ReceiptFilter, error) {
+	filter := dbengine.ReceiptFilter{}
+
+	dateParams := []struct {
+		name  string
+		value *string
+	}{
+		{"purchased_after", &filter.PurchasedAfter},
+		{"purchased_before", &filter.PurchasedBefore},
+		{"expires_after", &filter.ExpiresAfter},
+		{"expires_before", &filter.ExpiresBefore},
+	}
+	for _, p := range dateParams {
+		value := query.Get(p.name)
+		if value == "" {
+			continue
+		}
+		dtime, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return dbengine.ReceiptFilter{},
+				fmt.Errorf("%s must be a date in YYYY-MM-DD format", p.name)
+		}
+		*p.value = dtime.Format("2006-01-02")
+	}
+
+	if expired := query.Get("expired"); expired != "" {
+		parsed, err := strconv.ParseBool(expired)
+		if err != nil {
+			return dbengine.ReceiptFilter{},
+				errors.New("expired must be either true or false")
+		}
+		filter.Expired = &parsed
+	}
+	return filter, nil
+}
+
+// ReceiptPatch is the JSON body of PATCH /receipts/{id}. Omitted dates
+// stay as they are and empty strings clear them.
+type ReceiptPatch struct {
+	PurchaseDate *string  `json:"purchase_date"`
+	ExpiryDate   *string  `json:"expiry_date"`
+	AddTags      []string `json:"add_tags"`
+	RemoveTags   []string `json:"remove_tags"`
+}
+
+// ParseReceiptPatch validates the patch against the current receipt.
+// Expiry date is either absolute or relative to the purchase date in
+// the same form as the upload tags, e.g. 3_years. Validation errors
+// are returned by JSON field name.
+func ParseReceiptPatch(
+	patch ReceiptPatch,
+	current dbengine.Receipt) (dbengine.ReceiptUpdate, map[string]string) {
+	update := dbengine.ReceiptUpdate{}
+	fieldErrors := map[string]string{}
+
+	purchaseDate := current.PurchaseDate
+	if patch.PurchaseDate != nil {
+		value := strings.TrimSpace(*patch.PurchaseDate)
+		if value != "" {
+			dtime, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				fieldErrors["purchase_date"] = "must be a date in YYYY-MM-DD format"
+			} else {
+				value = dtime.Format("2006-01-02")
+			}
+		}
+		purchaseDate = value
+		update.PurchaseDate = &value
+	}
+
+	if patch.ExpiryDate != nil {
+		value := strings.TrimSpace(*patch.ExpiryDate)
+		switch {
+		case value == "":
+		case expiryDatePat.MatchString(value):
+			startDate, err := time.Parse("2006-01-02", purchaseDate)
+			if err != nil {
+				fieldErrors["expiry_date"] = "relative expiry date requires a purchase date"
+				break
+			}
+			expiryDate, err := ParseExpiryDate(&[]string{value}, startDate)
+			if err != nil {
+				fieldErrors["expiry_date"] = err.Error()
+				break
+			}
+			value = expiryDate.Format("2006-01-02")
+		default:
+			dtime, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				fieldErrors["expiry_date"] = "must be a date in YYYY-MM-DD format " +
+					"or relative to purchase date, e.g. 3_years"
+				break
+			}
+			value = dtime.Format("2006-01-02")
+		}
+		update.ExpiryDate = &value
+	}
+
+	update.AddTags = *NormaliseTags(strings.Join(patch.AddTags, " "))
+	update.RemoveTags = *NormaliseTags(strings.Join(patch.RemoveTags, " "))
+	for _, added := range update.AddTags {
+		for _, removed := range update.RemoveTags {
+			if added == removed {
+				fieldErrors["add_tags"] = fmt.Sprintf(
+					"tag %q is both added and removed", added)
+			}
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		return dbengine.ReceiptUpdate{}, fieldErrors
+	}
+	return update, nil
+}
+
+// WantsJSON tells whether the client listed application/json in its
+// Accept header.
+func WantsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaRange)
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var amountTagPat = regexp.MustCompile(`^(?i)amount:(-?[0-9]+(?:[.,][0-9]+)?)([a-z]{3})?$`)
+var detailTagPat = regexp.MustCompile(`^(?i)(currency|vendor|payment):(.+)$`)
+
+const maxDetailLength = 128
+
+// ParsePurchaseDetails reads amount, currency, vendor and payment_method
+// form values. Tags like amount:12.50EUR, currency:EUR, vendor:ikea and
+// payment:card work as shortcuts for them and are removed from the tags
+// the same way as dates are. Form values win over the shortcuts.
+func ParsePurchaseDetails(
+	form url.Values,
+	tags *[]string) (dbengine.PurchaseDetails, error) {
+	values := map[string]string{}
+	remainingTags := []string{}
+	for _, t := range *tags {
+		if found := amountTagPat.FindStringSubmatch(t); found != nil {
+			values["amount"] = found[1]
+			if found[2] != "" {
+				values["currency"] = found[2]
+			}
+			continue
+		}
+		if found := detailTagPat.FindStringSubmatch(t); found != nil {
+			field := strings.ToLower(found[1])
+			if field == "payment" {
+				field = "payment_method"
+			}
+			values[field] = found[2]
+			continue
+		}
+		remainingTags = append(remainingTags, t)
+	}
+	*tags = remainingTags
+
+	for _, field := range []string{"amount", "currency", "vendor", "payment_method"} {
+		if value := strings.TrimSpace(form.Get(field)); value != "" {
+			values[field] = value
+		}
+	}
+
+	details := dbengine.PurchaseDetails{
+		Currency:      strings.ToUpper(values["currency"]),
+		Vendor:        values["vendor"],
+		PaymentMethod: strings.ToLower(values["payment_method"]),
+	}
+	if details.Currency != "" && !utils.IsCurrencyCode(details.Currency) {
+		return dbengine.PurchaseDetails{},
+			fmt.Errorf("Unknown currency %q, expected ISO 4217 code like EUR",
+				details.Currency)
+	}
+	if len(details.Vendor) > maxDetailLength ||
+		len(details.PaymentMethod) > maxDetailLength {
+		return dbengine.PurchaseDetails{},
+			fmt.Errorf("Vendor and payment method can be at most %d characters",
+				maxDetailLength)
+	}
+	if values["amount"] != "" {
+		amount, err := utils.ParseAmount(values["amount"], details.Currency)
+		if err != nil {
+			return dbengine.PurchaseDetails{}, err
+		}
+		details.Amount = &amount
+	}
+	return details, nil
+}
+
+// ParseSpendingQuery reads group_by, from and to query parameters of
+// the spending report. The from date is inclusive and to exclusive.
+func ParseSpendingQuery(query url.Values) (string, dbengine.ReceiptFilter, error) {
+	groupBy := query.Get("group_by")
+	if groupBy == "" {
+		groupBy = "month"
+	}
+
+	filter := dbengine.ReceiptFilter{}
+	dateParams := []struct {
+		name  string
+		value *string
+	}{
+		{"from", &filter.PurchasedAfter},
+		{"to", &filter.PurchasedBefore},
+	}
+	for _, p := range dateParams {
+		value := query.Get(p.name)
+		if value == "" {
+			continue
+		}
+		dtime, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return "", dbengine.ReceiptFilter{},
+				fmt.Errorf("%s must be a date in YYYY-MM-DD format", p.name)
+		}
+		*p.value = dtime.Format("2006-01-02")
+	}
+	return groupBy, filter, nil
+}
+
+// ParseThumbnailSize reads the size query parameter which has to be one
+// of the allowed sizes. The smallest one is the default.
+func ParseThumbnailSize(query url.Values, allowed []int) (int, error) {
+	sizes := append([]int{}, allowed...)
+	sort.Ints(sizes)
+	if query.Get("size") == "" {
+		return sizes[0], nil
+	}
+	size, err := strconv.Atoi(query.Get("size"))
+	if err == nil {
+		for _, s := range sizes {
+			if s == size {
+				return size, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("Size must be one of %v", sizes)
+}
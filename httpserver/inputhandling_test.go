@@ -1,10 +1,21 @@
 package httpserver
 
 import (
-	"mime/multipart"
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http/httptest"
+	"net/url"
+	"receiptstracker-api/dbengine"
+	"receiptstracker-api/external"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
+
+	"golang.org/x/image/tiff"
 )
 
 func Test_parseExpiryDate(t *testing.T) {
@@ -215,8 +226,8 @@ func Test_normaliseTags(t *testing.T) {
 
 func Test_calculateFileHash(t *testing.T) {
 	type args struct {
-		binFile         []byte
-		formFileHeaders *multipart.FileHeader
+		binFile  []byte
+		mimeType string
 	}
 	tests := []struct {
 		name    string
@@ -226,22 +237,26 @@ func Test_calculateFileHash(t *testing.T) {
 	}{
 		{
 			"Null byte",
-			args{[]byte{}, &multipart.FileHeader{}},
+			args{[]byte{}, "image/jpeg"},
 			"",
 			true,
 		},
 		{
 			"Real content",
-			args{[]byte{0, 1, 0, 1, 0},
-				&multipart.FileHeader{Filename: "test-file.JPEG"},
-			},
-			"01e246b58d8e782fc96881c090d833eefa37e804cb308aeae0f7471c9ef1ea1a.jpeg",
+			args{[]byte{0, 1, 0, 1, 0}, "image/jpeg"},
+			"01e246b58d8e782fc96881c090d833eefa37e804cb308aeae0f7471c9ef1ea1a.jpg",
 			false,
 		},
+		{
+			"Not an image",
+			args{[]byte{0, 1, 0, 1, 0}, "application/octet-stream"},
+			"",
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := CalculateFileHash(tt.args.binFile, tt.args.formFileHeaders)
+			got, err := CalculateFileHash(tt.args.binFile, tt.args.mimeType)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("%s: CalculateFileHash() error = %v, wantErr %v",
 					tt.name,
@@ -258,3 +273,698 @@ func Test_calculateFileHash(t *testing.T) {
 		})
 	}
 }
+
+// encodeImage returns a small image in the given format
+func encodeImage(t *testing.T, format string) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	buf := &bytes.Buffer{}
+	var err error
+	switch format {
+	case "gif":
+		err = gif.Encode(buf, img, nil)
+	case "jpeg":
+		err = jpeg.Encode(buf, img, nil)
+	case "png":
+		err = png.Encode(buf, img)
+	case "tiff":
+		err = tiff.Encode(buf, img, nil)
+	}
+	if err != nil {
+		t.Fatalf("Encoding %s failed: %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+// twoPagePdf has two empty pages
+const twoPagePdf = `%PDF-1.4
+1 0 obj
+<< /Type /Catalog /Pages 2 0 R >>
+endobj
+2 0 obj
+<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 >>
+endobj
+3 0 obj
+<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] >>
+endobj
+4 0 obj
+<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] >>
+endobj
+xref
+0 5
+0000000000 65535 f 
+0000000009 00000 n 
+0000000058 00000 n 
+0000000121 00000 n 
+0000000192 00000 n 
+trailer
+<< /Size 5 /Root 1 0 R >>
+startxref
+263
+%%EOF
+`
+
+func Test_detectFileType(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		content       []byte
+		maxPdfPages   int
+		wantType      string
+		wantPageCount int
+		wantErr       bool
+	}{
+		{"Image", encodeImage(t, "png"), 50, "image/png", 1, false},
+		{"PDF", []byte(twoPagePdf), 50, "application/pdf", 2, false},
+		{"PDF with too many pages", []byte(twoPagePdf), 1, "", 0, true},
+		{"PDF header only", []byte("%PDF-1.4\n%%EOF\n"), 50, "", 0, true},
+		{"Not a receipt", []byte("MZ\x90\x00"), 50, "", 0, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			gotType, gotPageCount, err := DetectFileType(tt.content, tt.maxPdfPages, 100)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: DetectFileType() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if gotType != tt.wantType || gotPageCount != tt.wantPageCount {
+				t.Errorf("%s: DetectFileType() = %v, %v, want %v, %v",
+					tt.name,
+					gotType,
+					gotPageCount,
+					tt.wantType,
+					tt.wantPageCount)
+			}
+		})
+	}
+}
+
+func Test_detectImageType(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		content   []byte
+		maxPixels int64
+		want      string
+		wantErr   bool
+	}{
+		{"GIF", encodeImage(t, "gif"), 100, "image/gif", false},
+		{"JPEG", encodeImage(t, "jpeg"), 100, "image/jpeg", false},
+		{"PNG", encodeImage(t, "png"), 100, "image/png", false},
+		{"TIFF", encodeImage(t, "tiff"), 100, "image/tiff", false},
+		{"Exactly the largest", encodeImage(t, "png"), 12, "image/png", false},
+		{"Too many pixels", encodeImage(t, "png"), 11, "", true},
+		{"Executable", []byte("MZ\x90\x00\x03\x00\x00\x00"), 100, "", true},
+		{"Text", []byte("#!/bin/sh\nrm -rf /\n"), 100, "", true},
+		{"PNG signature only", encodeImage(t, "png")[:12], 100, "", true},
+		{"PDF", []byte(twoPagePdf), 100, "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := DetectImageType(tt.content, tt.maxPixels)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: DetectImageType() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("%s: DetectImageType() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
+
+func Test_parsePagination(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		query url.Values
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantLimit  int
+		wantOffset int
+		wantErr    bool
+	}{
+		{
+			"Defaults",
+			args{url.Values{}},
+			external.DEFAULT_PAGE_SIZE,
+			0,
+			false,
+		},
+		{
+			"Limit and offset",
+			args{url.Values{"limit": {"10"}, "offset": {"20"}}},
+			10,
+			20,
+			false,
+		},
+		{
+			"Too large limit",
+			args{url.Values{"limit": {"100000"}}},
+			0,
+			0,
+			true,
+		},
+		{
+			"Negative offset",
+			args{url.Values{"offset": {"-1"}}},
+			0,
+			0,
+			true,
+		},
+		{
+			"Not a number",
+			args{url.Values{"limit": {"ten"}}},
+			0,
+			0,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			gotLimit, gotOffset, err := ParsePagination(tt.args.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: ParsePagination() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if gotLimit != tt.wantLimit || gotOffset != tt.wantOffset {
+				t.Errorf("%s: ParsePagination() = %d, %d, want %d, %d",
+					tt.name,
+					gotLimit,
+					gotOffset,
+					tt.wantLimit,
+					tt.wantOffset)
+			}
+		})
+	}
+}
+
+func Test_parseTagSearch(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		query url.Values
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    dbengine.ReceiptFilter
+		wantErr bool
+	}{
+		{
+			"Tags with default mode",
+			args{url.Values{"tags": {"electronics,warranty"}}},
+			dbengine.ReceiptFilter{
+				Tags:         []string{"electronics", "warranty"},
+				MatchAllTags: true,
+				ExcludedTags: []string{},
+			},
+			false,
+		},
+		{
+			"Any mode with excluded",
+			args{url.Values{
+				"tags": {"electronics, warranty"},
+				"not":  {"returned"},
+				"mode": {"any"},
+			}},
+			dbengine.ReceiptFilter{
+				Tags:         []string{"electronics", "warranty"},
+				ExcludedTags: []string{"returned"},
+			},
+			false,
+		},
+		{
+			"Unknown mode",
+			args{url.Values{"tags": {"a"}, "mode": {"some"}}},
+			dbengine.ReceiptFilter{},
+			true,
+		},
+		{
+			"No tags",
+			args{url.Values{"tags": {" , "}}},
+			dbengine.ReceiptFilter{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseTagSearch(tt.args.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: ParseTagSearch() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: ParseTagSearch() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseDateFilters(t *testing.T) {
+	t.Parallel()
+	expired := true
+	type args struct {
+		query url.Values
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    dbengine.ReceiptFilter
+		wantErr bool
+	}{
+		{
+			"No filters",
+			args{url.Values{}},
+			dbengine.ReceiptFilter{},
+			false,
+		},
+		{
+			"All filters",
+			args{url.Values{
+				"purchased_after":  {"2019-01-01"},
+				"purchased_before": {"2020-01-01"},
+				"expires_after":    {"2021-01-01"},
+				"expires_before":   {"2022-01-01"},
+				"expired":          {"true"},
+			}},
+			dbengine.ReceiptFilter{
+				PurchasedAfter:  "2019-01-01",
+				PurchasedBefore: "2020-01-01",
+				ExpiresAfter:    "2021-01-01",
+				ExpiresBefore:   "2022-01-01",
+				Expired:         &expired,
+			},
+			false,
+		},
+		{
+			"Malformed date",
+			args{url.Values{"expires_before": {"01.01.2022"}}},
+			dbengine.ReceiptFilter{},
+			true,
+		},
+		{
+			"Malformed expired",
+			args{url.Values{"expired": {"maybe"}}},
+			dbengine.ReceiptFilter{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseDateFilters(tt.args.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: ParseDateFilters() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: ParseDateFilters() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseReceiptPatch(t *testing.T) {
+	t.Parallel()
+	strPtr := func(s string) *string { return &s }
+	current := dbengine.Receipt{
+		Id:           1,
+		Filename:     "a.jpg",
+		PurchaseDate: "2019-08-06",
+		ExpiryDate:   "2020-08-06",
+		Tags:         []string{"laptop"},
+	}
+	type args struct {
+		patch   ReceiptPatch
+		current dbengine.Receipt
+	}
+	tests := []struct {
+		name       string
+		args       args
+		want       dbengine.ReceiptUpdate
+		wantFields []string
+	}{
+		{
+			"Absolute dates",
+			args{ReceiptPatch{
+				PurchaseDate: strPtr("2019-08-07"),
+				ExpiryDate:   strPtr("2021-08-07"),
+			}, current},
+			dbengine.ReceiptUpdate{
+				PurchaseDate: strPtr("2019-08-07"),
+				ExpiryDate:   strPtr("2021-08-07"),
+				AddTags:      []string{},
+				RemoveTags:   []string{},
+			},
+			nil,
+		},
+		{
+			"Relative expiry from current purchase date",
+			args{ReceiptPatch{ExpiryDate: strPtr("3_years")}, current},
+			dbengine.ReceiptUpdate{
+				ExpiryDate: strPtr("2022-08-06"),
+				AddTags:    []string{},
+				RemoveTags: []string{},
+			},
+			nil,
+		},
+		{
+			"Relative expiry from new purchase date",
+			args{ReceiptPatch{
+				PurchaseDate: strPtr("2020-01-31"),
+				ExpiryDate:   strPtr("1_month"),
+			}, current},
+			dbengine.ReceiptUpdate{
+				PurchaseDate: strPtr("2020-01-31"),
+				ExpiryDate:   strPtr("2020-03-02"),
+				AddTags:      []string{},
+				RemoveTags:   []string{},
+			},
+			nil,
+		},
+		{
+			"Clear dates and change tags",
+			args{ReceiptPatch{
+				PurchaseDate: strPtr(""),
+				ExpiryDate:   strPtr(""),
+				AddTags:      []string{"warranty", " food  warranty"},
+				RemoveTags:   []string{"laptop"},
+			}, current},
+			dbengine.ReceiptUpdate{
+				PurchaseDate: strPtr(""),
+				ExpiryDate:   strPtr(""),
+				AddTags:      []string{"warranty", "food"},
+				RemoveTags:   []string{"laptop"},
+			},
+			nil,
+		},
+		{
+			"Relative expiry without purchase date",
+			args{ReceiptPatch{
+				PurchaseDate: strPtr(""),
+				ExpiryDate:   strPtr("2_years"),
+			}, current},
+			dbengine.ReceiptUpdate{},
+			[]string{"expiry_date"},
+		},
+		{
+			"Malformed values",
+			args{ReceiptPatch{
+				PurchaseDate: strPtr("06.08.2019"),
+				ExpiryDate:   strPtr("forever"),
+				AddTags:      []string{"food"},
+				RemoveTags:   []string{"food"},
+			}, current},
+			dbengine.ReceiptUpdate{},
+			[]string{"add_tags", "expiry_date", "purchase_date"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, gotErrors := ParseReceiptPatch(tt.args.patch, tt.args.current)
+			gotFields := []string(nil)
+			for field := range gotErrors {
+				gotFields = append(gotFields, field)
+			}
+			sort.Strings(gotFields)
+			if !reflect.DeepEqual(gotFields, tt.wantFields) {
+				t.Errorf("%s: ParseReceiptPatch() errors = %v, want fields %v",
+					tt.name,
+					gotErrors,
+					tt.wantFields)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: ParseReceiptPatch() = %+v, want %+v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
+
+func Test_wantsJSON(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		accept string
+		want   bool
+	}{
+		{"No Accept header", "", false},
+		{"Browser", "text/html,application/xhtml+xml,*/*;q=0.8", false},
+		{"JSON", "application/json", true},
+		{"JSON with parameters", "text/plain;q=0.5, application/json; q=1", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			if got := WantsJSON(req); got != tt.want {
+				t.Errorf("%s: WantsJSON() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
+
+func Test_parsePurchaseDetails(t *testing.T) {
+	t.Parallel()
+	amount := func(a int64) *int64 { return &a }
+	type args struct {
+		form url.Values
+		tags *[]string
+	}
+	tests := []struct {
+		name     string
+		args     args
+		want     dbengine.PurchaseDetails
+		wantTags []string
+		wantErr  bool
+	}{
+		{
+			"Tag shortcuts",
+			args{url.Values{}, &[]string{
+				"laptop", "amount:12.50EUR", "vendor:ikea", "payment:Card"}},
+			dbengine.PurchaseDetails{
+				Amount:        amount(1250),
+				Currency:      "EUR",
+				Vendor:        "ikea",
+				PaymentMethod: "card",
+			},
+			[]string{"laptop"},
+			false,
+		},
+		{
+			"Separate currency tag",
+			args{url.Values{}, &[]string{"currency:jpy", "amount:1200"}},
+			dbengine.PurchaseDetails{Amount: amount(1200), Currency: "JPY"},
+			[]string{},
+			false,
+		},
+		{
+			"Form values win",
+			args{url.Values{
+				"amount":   {"10,00"},
+				"currency": {"usd"},
+				"vendor":   {"Corner Shop"},
+			}, &[]string{"amount:12.50EUR", "laptop"}},
+			dbengine.PurchaseDetails{
+				Amount:   amount(1000),
+				Currency: "USD",
+				Vendor:   "Corner Shop",
+			},
+			[]string{"laptop"},
+			false,
+		},
+		{
+			"No details",
+			args{url.Values{}, &[]string{"laptop"}},
+			dbengine.PurchaseDetails{},
+			[]string{"laptop"},
+			false,
+		},
+		{
+			"Unknown currency",
+			args{url.Values{}, &[]string{"amount:12.50XYZ"}},
+			dbengine.PurchaseDetails{},
+			[]string{},
+			true,
+		},
+		{
+			"Malformed amount",
+			args{url.Values{"amount": {"twelve"}}, &[]string{}},
+			dbengine.PurchaseDetails{},
+			[]string{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParsePurchaseDetails(tt.args.form, tt.args.tags)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: ParsePurchaseDetails() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: ParsePurchaseDetails() = %+v, want %+v",
+					tt.name,
+					got,
+					tt.want)
+			}
+			if !reflect.DeepEqual(*tt.args.tags, tt.wantTags) {
+				t.Errorf("%s: ParsePurchaseDetails() left tags %v, want %v",
+					tt.name,
+					*tt.args.tags,
+					tt.wantTags)
+			}
+		})
+	}
+}
+
+func Test_parseSpendingQuery(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		query url.Values
+	}
+	tests := []struct {
+		name        string
+		args        args
+		wantGroupBy string
+		wantFilter  dbengine.ReceiptFilter
+		wantErr     bool
+	}{
+		{
+			"Defaults to month",
+			args{url.Values{}},
+			"month",
+			dbengine.ReceiptFilter{},
+			false,
+		},
+		{
+			"Tags in a date range",
+			args{url.Values{
+				"group_by": {"tag"},
+				"from":     {"2020-01-01"},
+				"to":       {"2020-04-01"},
+			}},
+			"tag",
+			dbengine.ReceiptFilter{
+				PurchasedAfter:  "2020-01-01",
+				PurchasedBefore: "2020-04-01",
+			},
+			false,
+		},
+		{
+			"Malformed date",
+			args{url.Values{"from": {"2020"}}},
+			"",
+			dbengine.ReceiptFilter{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			gotGroupBy, gotFilter, err := ParseSpendingQuery(tt.args.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: ParseSpendingQuery() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if gotGroupBy != tt.wantGroupBy ||
+				!reflect.DeepEqual(gotFilter, tt.wantFilter) {
+				t.Errorf("%s: ParseSpendingQuery() = %v, %+v, want %v, %+v",
+					tt.name,
+					gotGroupBy,
+					gotFilter,
+					tt.wantGroupBy,
+					tt.wantFilter)
+			}
+		})
+	}
+}
+
+func Test_parseThumbnailSize(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		query   url.Values
+		want    int
+		wantErr bool
+	}{
+		{"Smallest by default", url.Values{}, 200, false},
+		{"Allowed size", url.Values{"size": {"800"}}, 800, false},
+		{"Other size", url.Values{"size": {"300"}}, 0, true},
+		{"Not a number", url.Values{"size": {"big"}}, 0, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseThumbnailSize(tt.query, []int{800, 200})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: ParseThumbnailSize() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("%s: ParseThumbnailSize() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
@@ -1,12 +1,34 @@
 package httpserver
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"path/filepath"
+	"strings"
 )
 
+var fileContentTypes = map[string]string{
+	"gif":  "image/gif",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"pdf":  "application/pdf",
+	"png":  "image/png",
+	"tiff": "image/tiff",
+}
+
+// fileExtensions gives the extension uploads of each type are stored with
+var fileExtensions = map[string]string{
+	"application/pdf": "pdf",
+	"image/gif":       "gif",
+	"image/jpeg":      "jpg",
+	"image/png":       "png",
+	"image/tiff":      "tiff",
+}
+
 func LoadPage(w http.ResponseWriter, r *http.Request) error {
 	page, err := ioutil.ReadFile("resources/send.html")
 	if err != nil {
@@ -15,3 +37,76 @@ func LoadPage(w http.ResponseWriter, r *http.Request) error {
 	fmt.Fprintf(w, "%s", page)
 	return nil
 }
+
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("ERROR: encoding JSON response failed: %v", err)
+	}
+}
+
+// ApiError carries a machine-readable code next to the message shown
+// to the user.
+type ApiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"error"`
+}
+
+func (e *ApiError) Error() string {
+	return e.Message
+}
+
+// errorCode derives a generic code from the status, e.g. "not_found"
+func errorCode(status int) string {
+	return strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1))
+}
+
+func WriteJSONError(w http.ResponseWriter, status int, msg string) {
+	WriteJSON(w, status, &ApiError{
+		Status:  status,
+		Code:    errorCode(status),
+		Message: msg,
+	})
+}
+
+// WriteApiError answers in JSON to clients accepting it and in plain
+// text to everyone else, e.g. the upload form and curl.
+func WriteApiError(w http.ResponseWriter, r *http.Request, apiErr *ApiError) {
+	if WantsJSON(r) {
+		WriteJSON(w, apiErr.Status, apiErr)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(apiErr.Status)
+	fmt.Fprint(w, apiErr.Message+"\r\n")
+}
+
+// ContentTypeByFilename maps the allowed upload extensions to their MIME
+// types without relying on the system's mime.types.
+func ContentTypeByFilename(fname string) string {
+	fileExt := strings.Trim(strings.ToLower(filepath.Ext(fname)), ".")
+	if contentType, found := fileContentTypes[fileExt]; found {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// csvText keeps spreadsheets from running user written text as a
+// formula by prefixing the characters starting one with a quote.
+func csvText(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// WriteValidationErrors tells which fields of the request were invalid
+func WriteValidationErrors(w http.ResponseWriter, fieldErrors map[string]string) {
+	WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"error":  "Validation failed",
+		"code":   "validation_failed",
+		"fields": fieldErrors,
+	})
+}
@@ -0,0 +1,88 @@
+package httpserver
+
+import (
+	"net/http/httptest"
+	"receiptstracker-api/dbengine"
+	"testing"
+)
+
+func Test_contentTypeByFilename(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		fname string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			"Jpeg",
+			args{"abc.jpg"},
+			"image/jpeg",
+		},
+		{
+			"Upper case tiff",
+			args{"abc.TIFF"},
+			"image/tiff",
+		},
+		{
+			"Unknown extension",
+			args{"abc.exe"},
+			"application/octet-stream",
+		},
+		{
+			"No extension",
+			args{"abc"},
+			"application/octet-stream",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := ContentTypeByFilename(tt.args.fname)
+			if got != tt.want {
+				t.Errorf("%s: ContentTypeByFilename() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
+
+func Test_writeSpendingCSV(t *testing.T) {
+	t.Parallel()
+	rows := []spendingRow{}
+	for _, vendor := range []string{
+		"Cafe",
+		"=HYPERLINK(\"http://example.com\")",
+		"+cmd|' /C calc'!A0",
+		"-2+3",
+		"@SUM(A1)",
+		"\tTab",
+		"\rReturn",
+		"",
+	} {
+		rows = append(rows, spendingRow{
+			SpendingRow:  dbengine.SpendingRow{Group: vendor, Currency: "EUR", Total: -450, Count: 1},
+			TotalDecimal: "-4.50",
+		})
+	}
+	rec := httptest.NewRecorder()
+	writeSpendingCSV(rec, "vendor", rows)
+
+	want := "vendor,currency,total,count\n" +
+		"Cafe,EUR,-4.50,1\n" +
+		"\"'=HYPERLINK(\"\"http://example.com\"\")\",EUR,-4.50,1\n" +
+		"'+cmd|' /C calc'!A0,EUR,-4.50,1\n" +
+		"'-2+3,EUR,-4.50,1\n" +
+		"'@SUM(A1),EUR,-4.50,1\n" +
+		"'\tTab,EUR,-4.50,1\n" +
+		"\"'\rReturn\",EUR,-4.50,1\n" +
+		",EUR,-4.50,1\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("writeSpendingCSV() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,416 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"receiptstracker-api/blobstore"
+	"receiptstracker-api/dbengine"
+	"receiptstracker-api/external"
+	"receiptstracker-api/thumbnail"
+	"strconv"
+	"strings"
+)
+
+type receiptList struct {
+	Receipts []dbengine.Receipt `json:"receipts"`
+	Total    int64              `json:"total"`
+	Limit    int                `json:"limit"`
+	Offset   int                `json:"offset"`
+}
+
+// ReceiptsHandler serves everything under /receipts/. Uploads posted to
+// the collection itself are passed on to ApiHandler.
+func (s *Server) ReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	resource := strings.Trim(strings.TrimPrefix(r.URL.Path, "/receipts"), "/")
+	if resource == "" && r.Method == "POST" {
+		s.ApiHandler(w, r)
+		return
+	}
+
+	log.Printf("Incoming %s %s connection from %s",
+		r.Method,
+		r.URL.Path,
+		r.RemoteAddr)
+
+	if resource == "search" {
+		switch r.Method {
+		case "GET":
+			s.searchReceipts(w, r)
+		default:
+			w.Header().Set("Allow", "GET")
+			WriteJSONError(w, http.StatusMethodNotAllowed,
+				"Supported methods: GET")
+		}
+		return
+	}
+
+	if resource == "" {
+		switch r.Method {
+		case "GET":
+			filter, err := ParseDateFilters(r.URL.Query())
+			if err != nil {
+				WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			s.listReceipts(w, r, filter)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			WriteJSONError(w, http.StatusMethodNotAllowed,
+				"Supported methods: GET, POST")
+		}
+		return
+	}
+
+	parts := strings.Split(resource, "/")
+	receiptId, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) > 3 || (len(parts) == 3 && parts[1] != "shares") {
+		WriteJSONError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	subResource := ""
+	if len(parts) > 1 {
+		subResource = parts[1]
+	}
+	if subResource == "shares" {
+		withUser := ""
+		if len(parts) == 3 {
+			withUser = parts[2]
+		}
+		s.serveShares(w, r, withUser, receiptSharing(s.db, receiptId))
+		return
+	}
+
+	switch {
+	case subResource == "" && r.Method == "GET":
+		s.getReceipt(w, r, receiptId)
+	case subResource == "" && r.Method == "PATCH":
+		s.patchReceipt(w, r, receiptId)
+	case subResource == "" && r.Method == "DELETE":
+		s.deleteReceipt(w, r, receiptId)
+	case subResource == "file" && (r.Method == "GET" || r.Method == "HEAD"):
+		s.serveReceiptFile(w, r, receiptId)
+	case subResource == "thumbnail" && (r.Method == "GET" || r.Method == "HEAD"):
+		s.serveThumbnail(w, r, receiptId)
+	case subResource == "":
+		w.Header().Set("Allow", "GET, PATCH, DELETE")
+		WriteJSONError(w, http.StatusMethodNotAllowed,
+			"Supported methods: GET, PATCH, DELETE")
+	case subResource == "file" || subResource == "thumbnail":
+		w.Header().Set("Allow", "GET")
+		WriteJSONError(w, http.StatusMethodNotAllowed,
+			"Supported methods: GET")
+	default:
+		WriteJSONError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// receiptDetails tells which of the receipt's details were read from
+// the receipt itself and how confidently.
+type receiptDetails struct {
+	*dbengine.Receipt
+	Extracted map[string]dbengine.ExtractedField `json:"extracted,omitempty"`
+}
+
+type searchResultList struct {
+	Results []dbengine.SearchResult `json:"results"`
+	Total   int64                   `json:"total"`
+	Limit   int                     `json:"limit"`
+	Offset  int                     `json:"offset"`
+}
+
+// searchReceipts does a full-text search when q is given and otherwise
+// searches by tags.
+func (s *Server) searchReceipts(w http.ResponseWriter, r *http.Request) {
+	if _, found := r.URL.Query()["q"]; found {
+		s.fullTextSearch(w, r)
+		return
+	}
+	filter, err := ParseTagSearch(r.URL.Query())
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.listReceipts(w, r, filter)
+}
+
+func (s *Server) fullTextSearch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	text := r.URL.Query().Get("q")
+
+	limit, offset, err := ParsePagination(r.URL.Query())
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	results, err := s.db.SearchReceipts(ctx, requestUserId(r), text, limit, offset)
+	switch err {
+	case nil:
+	case dbengine.ErrEmptySearch:
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	case dbengine.ErrSearchUnavailable:
+		WriteJSONError(w, http.StatusNotImplemented, err.Error())
+		return
+	default:
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to search receipts")
+		return
+	}
+	total, err := s.db.CountSearchResults(ctx, requestUserId(r), text)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to count search results")
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, searchResultList{
+		Results: results,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
+
+func (s *Server) listReceipts(
+	w http.ResponseWriter,
+	r *http.Request,
+	filter dbengine.ReceiptFilter) {
+	ctx := r.Context()
+
+	limit, offset, err := ParsePagination(r.URL.Query())
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	receipts, err := s.db.GetReceipts(ctx, requestUserId(r), filter, limit, offset)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to fetch receipts")
+		return
+	}
+	total, err := s.db.CountReceipts(ctx, requestUserId(r), filter)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to count receipts")
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, receiptList{
+		Receipts: receipts,
+		Total:    total,
+		Limit:    limit,
+		Offset:   offset,
+	})
+}
+
+func (s *Server) getReceipt(w http.ResponseWriter, r *http.Request, receiptId int64) {
+	receipt, err := s.db.GetReceipt(r.Context(), requestUserId(r), receiptId)
+	if err == dbengine.ErrReceiptNotFound {
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to fetch receipt")
+		return
+	}
+	extracted, err := s.db.GetExtractedFields(r.Context(), requestUserId(r), receiptId)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to fetch receipt")
+		return
+	}
+	WriteJSON(w, http.StatusOK, receiptDetails{
+		Receipt:   receipt,
+		Extracted: extracted,
+	})
+}
+
+func (s *Server) patchReceipt(w http.ResponseWriter, r *http.Request, receiptId int64) {
+	ctx := r.Context()
+
+	receipt, err := s.db.GetReceipt(ctx, requestUserId(r), receiptId)
+	if err == dbengine.ErrReceiptNotFound {
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to fetch receipt")
+		return
+	}
+	if receipt.OwnerId != requestUserId(r) {
+		WriteJSONError(w, http.StatusForbidden, dbengine.ErrNotOwner.Error())
+		return
+	}
+
+	var patch ReceiptPatch
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, external.MAX_JSON_BODY_SIZE))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		log.Printf("ERROR: decoding patch for receipt %d failed: %v",
+			receiptId,
+			err)
+		WriteJSONError(w, http.StatusBadRequest, "Malformed JSON body")
+		return
+	}
+	update, fieldErrors := ParseReceiptPatch(patch, *receipt)
+	if fieldErrors != nil {
+		WriteValidationErrors(w, fieldErrors)
+		return
+	}
+
+	if err := s.db.UpdateReceipt(ctx, requestUserId(r), receiptId, update); err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to update receipt")
+		return
+	}
+	log.Printf("Updated receipt %d", receiptId)
+	s.getReceipt(w, r, receiptId)
+}
+
+// deleteReceipt removes the thumbnails along with the file when no other
+// receipt has it.
+func (s *Server) deleteReceipt(w http.ResponseWriter, r *http.Request, receiptId int64) {
+	filename, err := s.db.DeleteReceipt(r.Context(), requestUserId(r), s.store, receiptId)
+	if err == dbengine.ErrReceiptNotFound {
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err == dbengine.ErrNotOwner {
+		WriteJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to delete receipt")
+		return
+	}
+
+	if filename == "" {
+		log.Printf("Deleted receipt %d, its file is still in use", receiptId)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	thumbnail.Remove(s.cfg.ThumbnailDir, fileHashOf(filename))
+	log.Printf("Deleted receipt %d and its file %s", receiptId, filename)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// receiptContentType is the type detected from the content on upload.
+// Older uploads of types never accepted have none and are served as
+// plain bytes.
+func receiptContentType(receipt *dbengine.Receipt) string {
+	if receipt.MimeType != "" {
+		return receipt.MimeType
+	}
+	return "application/octet-stream"
+}
+
+// serveReceiptFile streams the stored image. Files are named after the
+// SHA-256 of their content so the name doubles as a strong ETag.
+func (s *Server) serveReceiptFile(w http.ResponseWriter, r *http.Request, receiptId int64) {
+	receipt, err := s.db.GetReceipt(r.Context(), requestUserId(r), receiptId)
+	if err == dbengine.ErrReceiptNotFound {
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to fetch receipt")
+		return
+	}
+
+	blob, err := s.store.Get(r.Context(), receipt.Filename)
+	if err == blobstore.ErrNotFound {
+		log.Printf("ERROR: receipt file %s is missing", receipt.Filename)
+		WriteJSONError(w, http.StatusNotFound, "Receipt file not found")
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: reading receipt file %s failed: %v", receipt.Filename, err)
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to read receipt file")
+		return
+	}
+
+	defer blob.Close()
+
+	fileHash := fileHashOf(receipt.Filename)
+	// Browsers must not guess that a stored file is e.g. HTML
+	w.Header().Set("Content-Type", receiptContentType(receipt))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", `"`+fileHash+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	http.ServeContent(w, r, receipt.Filename, blob.ModTime, blob)
+}
+
+// serveThumbnail serves the receipt image scaled to one of the
+// configured sizes, the smallest one by default.
+func (s *Server) serveThumbnail(w http.ResponseWriter, r *http.Request, receiptId int64) {
+	size, err := ParseThumbnailSize(r.URL.Query(), s.cfg.ThumbnailSizes)
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	receipt, err := s.db.GetReceipt(r.Context(), requestUserId(r), receiptId)
+	if err == dbengine.ErrReceiptNotFound {
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to fetch receipt")
+		return
+	}
+	if !strings.HasPrefix(receiptContentType(receipt), "image/") {
+		WriteJSONError(w, http.StatusNotFound,
+			"Thumbnails are only available for images")
+		return
+	}
+
+	fileHash := fileHashOf(receipt.Filename)
+	open := func() (io.ReadSeekCloser, error) {
+		blob, err := s.store.Get(r.Context(), receipt.Filename)
+		if err != nil {
+			return nil, err
+		}
+		return blob, nil
+	}
+	thumbPath, err := thumbnail.Get(open, s.cfg.ThumbnailDir, fileHash, size, s.cfg.MaxImagePixels)
+	if err == blobstore.ErrNotFound {
+		WriteJSONError(w, http.StatusNotFound, "Receipt file not found")
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: thumbnail of receipt %d failed: %v", receiptId, err)
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to create thumbnail")
+		return
+	}
+	f, err := os.Open(thumbPath)
+	if err != nil {
+		log.Printf("ERROR: opening thumbnail %s failed: %v", thumbPath, err)
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to read thumbnail")
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		log.Printf("ERROR: stat on thumbnail %s failed: %v", thumbPath, err)
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to read thumbnail")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("ETag", fmt.Sprintf(`"%s_%d"`, fileHash, size))
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	http.ServeContent(w, r, filepath.Base(thumbPath), stat.ModTime(), f)
+}
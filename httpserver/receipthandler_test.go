@@ -0,0 +1,126 @@
+package httpserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"receiptstracker-api/dbengine"
+	"strings"
+	"testing"
+)
+
+func Test_receiptsHandler(t *testing.T) {
+	handler := testServer(t, dbengine.Receipt{
+		Id:           1,
+		Filename:     "a.jpg",
+		PurchaseDate: "2019-08-06",
+		Tags:         []string{"shop"},
+	}).Handler()
+
+	// Run in order, each request seeing what the previous ones did
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"List", "GET", "/receipts/", "", http.StatusOK, `"total":1`},
+		{"Get", "GET", "/receipts/1", "", http.StatusOK, `"filename":"a.jpg"`},
+		{"Get missing", "GET", "/receipts/2", "", http.StatusNotFound, "Receipt not found"},
+		{
+			"Patch",
+			"PATCH",
+			"/receipts/1",
+			`{"add_tags": ["warranty"], "remove_tags": ["shop"]}`,
+			http.StatusOK,
+			`"tags":["warranty"]`,
+		},
+		{"Patch missing", "PATCH", "/receipts/2", `{}`, http.StatusNotFound, "Receipt not found"},
+		{"Search unavailable", "GET", "/receipts/search?q=cafe", "", http.StatusNotImplemented, "not available"},
+		{"Delete", "DELETE", "/receipts/1", "", http.StatusNoContent, ""},
+		{"Get deleted", "GET", "/receipts/1", "", http.StatusNotFound, "Receipt not found"},
+		{"List empty", "GET", "/receipts/", "", http.StatusOK, `"total":0`},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+writeToken)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+			t.Errorf("%s: %s %s = %d %s, want %d containing %s",
+				tt.name,
+				tt.method,
+				tt.path,
+				rec.Code,
+				rec.Body.String(),
+				tt.wantStatus,
+				tt.wantBody)
+		}
+	}
+}
+
+func requestFile(handler http.Handler, receiptId int64, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", fmt.Sprintf("/receipts/%d/file", receiptId), nil)
+	req.Header.Set("Authorization", "Bearer "+readToken)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func Test_serveReceiptFile(t *testing.T) {
+	s := testServer(t,
+		dbengine.Receipt{Id: 1, Filename: "a.jpg", MimeType: "image/jpeg"},
+		dbengine.Receipt{Id: 2, Filename: "b.html"},
+	)
+	s.store.Put(context.Background(), "a.jpg", []byte("0123456789"))
+	s.store.Put(context.Background(), "b.html", []byte("<script>alert(1)</script>"))
+	handler := s.Handler()
+
+	rec := requestFile(handler, 1, nil)
+	lastModified := rec.Header().Get("Last-Modified")
+	if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" || lastModified == "" {
+		t.Fatalf("GET = %d %q, Last-Modified %q", rec.Code, rec.Body.String(), lastModified)
+	}
+	// Type of the content detected on upload, never guessed from the name
+	for id, want := range map[int64]string{1: "image/jpeg", 2: "application/octet-stream"} {
+		header := requestFile(handler, id, nil).Header()
+		if header.Get("Content-Type") != want || header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("GET of receipt %d Content-Type = %q, X-Content-Type-Options = %q, want %q and nosniff",
+				id,
+				header.Get("Content-Type"),
+				header.Get("X-Content-Type-Options"),
+				want)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		wantStatus int
+		wantBody   string
+	}{
+		{"Range", map[string]string{"Range": "bytes=2-4"}, http.StatusPartialContent, "234"},
+		{"Open range", map[string]string{"Range": "bytes=7-"}, http.StatusPartialContent, "789"},
+		{"Not modified", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified, ""},
+		{"Same ETag", map[string]string{"If-None-Match": rec.Header().Get("ETag")}, http.StatusNotModified, ""},
+	}
+	for _, tt := range tests {
+		rec := requestFile(handler, 1, tt.header)
+		if rec.Code != tt.wantStatus || rec.Body.String() != tt.wantBody {
+			t.Errorf("%s: GET = %d %q, want %d %q",
+				tt.name,
+				rec.Code,
+				rec.Body.String(),
+				tt.wantStatus,
+				tt.wantBody)
+		}
+	}
+}
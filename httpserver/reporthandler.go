@@ -0,0 +1,109 @@
+package httpserver
+
+import (
+	"encoding/csv"
+	"log"
+	"net/http"
+	"receiptstracker-api/dbengine"
+	"receiptstracker-api/utils"
+	"strconv"
+	"strings"
+)
+
+type spendingReport struct {
+	GroupBy string        `json:"group_by"`
+	From    string        `json:"from,omitempty"`
+	To      string        `json:"to,omitempty"`
+	Rows    []spendingRow `json:"rows"`
+}
+
+type spendingRow struct {
+	dbengine.SpendingRow
+	TotalDecimal string `json:"total_decimal"`
+}
+
+// ReportsHandler serves everything under /reports/
+func (s *Server) ReportsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Incoming %s %s connection from %s",
+		r.Method,
+		r.URL.Path,
+		r.RemoteAddr)
+
+	report := strings.Trim(strings.TrimPrefix(r.URL.Path, "/reports"), "/")
+	if report != "spending" {
+		WriteJSONError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		WriteJSONError(w, http.StatusMethodNotAllowed,
+			"Supported methods: GET")
+		return
+	}
+
+	groupBy, filter, err := ParseSpendingQuery(r.URL.Query())
+	if err != nil {
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	spending, err := s.db.GetSpending(r.Context(), requestUserId(r), groupBy, filter)
+	if err == dbengine.ErrInvalidGrouping {
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to calculate spending")
+		return
+	}
+
+	rows := make([]spendingRow, 0, len(spending))
+	for _, s := range spending {
+		rows = append(rows, spendingRow{
+			SpendingRow:  s,
+			TotalDecimal: utils.FormatAmount(s.Total, s.Currency),
+		})
+	}
+
+	if wantsCSV(r) {
+		writeSpendingCSV(w, groupBy, rows)
+		return
+	}
+	WriteJSON(w, http.StatusOK, spendingReport{
+		GroupBy: groupBy,
+		From:    filter.PurchasedAfter,
+		To:      filter.PurchasedBefore,
+		Rows:    rows,
+	})
+}
+
+// wantsCSV checks format=csv query parameter first since it's easier
+// to use from a browser than the Accept header.
+func wantsCSV(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+func writeSpendingCSV(w http.ResponseWriter, groupBy string, rows []spendingRow) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="spending-by-`+groupBy+`.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{groupBy, "currency", "total", "count"})
+	for _, row := range rows {
+		writer.Write([]string{
+			csvText(row.Group),
+			row.Currency,
+			row.TotalDecimal,
+			strconv.FormatInt(row.Count, 10),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("ERROR: writing spending CSV failed: %v", err)
+	}
+}
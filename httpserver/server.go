@@ -0,0 +1,179 @@
+package httpserver
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"receiptstracker-api/blobstore"
+	"receiptstracker-api/config"
+	"receiptstracker-api/dbengine"
+	"sync"
+)
+
+// ReceiptRepository keeps the receipts, *dbengine.Store being the one
+// used outside of tests. Each user sees their own receipts and the ones
+// shared with them, but can change only their own.
+type ReceiptRepository interface {
+	StoreReceipt(
+		ctx context.Context,
+		userId int64,
+		store blobstore.BlobStore,
+		receipt dbengine.NewReceipt) (int64, error)
+	GetReceipt(ctx context.Context, userId int64, receiptId int64) (*dbengine.Receipt, error)
+	GetReceipts(
+		ctx context.Context,
+		userId int64,
+		filter dbengine.ReceiptFilter,
+		limit int,
+		offset int) ([]dbengine.Receipt, error)
+	CountReceipts(
+		ctx context.Context,
+		userId int64,
+		filter dbengine.ReceiptFilter) (int64, error)
+	GetExtractedFields(
+		ctx context.Context,
+		userId int64,
+		receiptId int64) (map[string]dbengine.ExtractedField, error)
+	UpdateReceipt(
+		ctx context.Context,
+		userId int64,
+		receiptId int64,
+		update dbengine.ReceiptUpdate) error
+	// DeleteReceipt removes the file from store too unless another
+	// receipt still has it and returns the filename of the removed file
+	DeleteReceipt(
+		ctx context.Context,
+		userId int64,
+		store blobstore.BlobStore,
+		receiptId int64) (string, error)
+	SearchReceipts(
+		ctx context.Context,
+		userId int64,
+		text string,
+		limit int,
+		offset int) ([]dbengine.SearchResult, error)
+	CountSearchResults(ctx context.Context, userId int64, text string) (int64, error)
+	GetSpending(
+		ctx context.Context,
+		userId int64,
+		groupBy string,
+		filter dbengine.ReceiptFilter) ([]dbengine.SpendingRow, error)
+	ShareReceipt(ctx context.Context, userId int64, receiptId int64, withUser string) error
+	UnshareReceipt(ctx context.Context, userId int64, receiptId int64, withUser string) error
+	GetReceiptShares(ctx context.Context, userId int64, receiptId int64) ([]string, error)
+	ShareTag(ctx context.Context, userId int64, tag string, withUser string) error
+	UnshareTag(ctx context.Context, userId int64, tag string, withUser string) error
+	GetTagShares(ctx context.Context, userId int64, tag string) ([]string, error)
+}
+
+// TokenRepository keeps the API tokens of the users, *dbengine.Store
+// being the one used outside of tests.
+type TokenRepository interface {
+	Authenticate(ctx context.Context, token string) (*dbengine.ApiToken, error)
+	CreateApiToken(
+		ctx context.Context,
+		userId int64,
+		name string,
+		scopes []string) (string, *dbengine.ApiToken, error)
+	ListApiTokens(ctx context.Context, userId int64) ([]dbengine.ApiToken, error)
+	RevokeApiToken(ctx context.Context, userId int64, tokenId int64) error
+}
+
+// Server serves the API with the given configuration. The handlers are
+// its methods so that settings aren't shared through package variables.
+type Server struct {
+	cfg      *config.Config
+	db       ReceiptRepository
+	tokens   TokenRepository
+	store    blobstore.BlobStore
+	ocrQueue OcrQueue
+	// Work left running by the handlers, such as thumbnail generation
+	background sync.WaitGroup
+}
+
+// NewServer returns a server keeping the receipts in db and their files
+// in store. Requests are let in with the tokens in tokens. Without an OCR
+// queue the jobs stay in the database until a queue is started.
+func NewServer(
+	cfg *config.Config,
+	db ReceiptRepository,
+	tokens TokenRepository,
+	store blobstore.BlobStore,
+	ocrQueue OcrQueue) *Server {
+	return &Server{
+		cfg:      cfg,
+		db:       db,
+		tokens:   tokens,
+		store:    store,
+		ocrQueue: ocrQueue,
+	}
+}
+
+// Handler routes the requests to the handlers of the API, each one but
+// the upload page needing a token with the scope of the route
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	upload := s.authorize(
+		dbengine.SCOPE_READ,
+		dbengine.SCOPE_WRITE,
+		s.ApiHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// The upload page holds no receipts and asks for the token
+		// itself, a browser can't send it when opening the page
+		if r.URL.Path == "/" && r.Method == "GET" {
+			s.ApiHandler(w, r)
+			return
+		}
+		upload(w, r)
+	})
+	mux.HandleFunc("/receipts/", s.authorize(
+		dbengine.SCOPE_READ,
+		dbengine.SCOPE_WRITE,
+		s.ReceiptsHandler))
+	mux.HandleFunc("/tags/", s.authorize(
+		dbengine.SCOPE_READ,
+		dbengine.SCOPE_WRITE,
+		s.TagsHandler))
+	mux.HandleFunc("/reports/", s.authorize(
+		dbengine.SCOPE_READ,
+		dbengine.SCOPE_READ,
+		s.ReportsHandler))
+	mux.HandleFunc("/tokens/", s.authorize(
+		dbengine.SCOPE_ADMIN,
+		dbengine.SCOPE_ADMIN,
+		s.TokensHandler))
+	return mux
+}
+
+// Serve answers requests on listener until ctx is cancelled. Requests in
+// flight are then given the configured shutdown timeout to complete
+// before their connections are closed, and work the handlers left
+// running in the background is waited for.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	httpServer := &http.Server{Handler: s.Handler()}
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- httpServer.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErrCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Waiting up to %v for requests to complete", s.cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(
+		context.Background(),
+		s.cfg.ShutdownTimeout)
+	defer cancel()
+	err := httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("ERROR: requests did not complete in time: %v", err)
+		httpServer.Close()
+	}
+	<-serveErrCh // http.ErrServerClosed
+	s.background.Wait()
+	return err
+}
@@ -0,0 +1,539 @@
+package httpserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"receiptstracker-api/blobstore"
+	"receiptstracker-api/config"
+	"receiptstracker-api/dbengine"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Users of the fakes, the tokens of the fake token repository belonging
+// to alice unless named after bob
+const (
+	aliceId int64 = 1
+	bobId   int64 = 2
+)
+
+var fakeUsers = map[string]int64{"alice": aliceId, "bob": bobId}
+
+// tagKey is a tag in the namespace of its owner
+type tagKey struct {
+	ownerId int64
+	tag     string
+}
+
+// fakeRepository keeps the receipts in memory. Filters are ignored and
+// full-text search is never available. Receipts without an owner belong
+// to alice.
+type fakeRepository struct {
+	mu            sync.Mutex
+	receipts      map[int64]dbengine.Receipt
+	nextId        int64
+	receiptShares map[int64]map[int64]bool
+	tagShares     map[tagKey]map[int64]bool
+}
+
+func newFakeRepository(receipts ...dbengine.Receipt) *fakeRepository {
+	f := &fakeRepository{
+		receipts:      map[int64]dbengine.Receipt{},
+		receiptShares: map[int64]map[int64]bool{},
+		tagShares:     map[tagKey]map[int64]bool{},
+	}
+	for _, receipt := range receipts {
+		if receipt.OwnerId == 0 {
+			receipt.OwnerId = aliceId
+		}
+		f.receipts[receipt.Id] = receipt
+		if receipt.Id > f.nextId {
+			f.nextId = receipt.Id
+		}
+	}
+	return f
+}
+
+func (f *fakeRepository) visible(userId int64, receipt dbengine.Receipt) bool {
+	if receipt.OwnerId == userId || f.receiptShares[receipt.Id][userId] {
+		return true
+	}
+	for _, tag := range receipt.Tags {
+		if f.tagShares[tagKey{receipt.OwnerId, tag}][userId] {
+			return true
+		}
+	}
+	return false
+}
+
+// owned returns the receipt if the user owns it
+func (f *fakeRepository) owned(userId int64, receiptId int64) (dbengine.Receipt, error) {
+	receipt, found := f.receipts[receiptId]
+	if !found || !f.visible(userId, receipt) {
+		return receipt, dbengine.ErrReceiptNotFound
+	}
+	if receipt.OwnerId != userId {
+		return receipt, dbengine.ErrNotOwner
+	}
+	return receipt, nil
+}
+
+func (f *fakeRepository) StoreReceipt(
+	ctx context.Context,
+	userId int64,
+	store blobstore.BlobStore,
+	receipt dbengine.NewReceipt) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, existing := range f.receipts {
+		if existing.OwnerId == userId && existing.Filename == receipt.Filename {
+			return 0, dbengine.ErrReceiptExists
+		}
+	}
+	if err := store.Put(ctx, receipt.Filename, receipt.Content); err != nil {
+		return 0, err
+	}
+	f.nextId++
+	f.receipts[f.nextId] = dbengine.Receipt{
+		Id:              f.nextId,
+		OwnerId:         userId,
+		Filename:        receipt.Filename,
+		MimeType:        receipt.MimeType,
+		PageCount:       receipt.PageCount,
+		PurchaseDate:    receipt.PurchaseDate,
+		ExpiryDate:      receipt.ExpiryDate,
+		Tags:            receipt.Tags,
+		PurchaseDetails: receipt.PurchaseDetails,
+	}
+	return f.nextId, nil
+}
+
+func (f *fakeRepository) GetReceipt(
+	ctx context.Context,
+	userId int64,
+	receiptId int64) (*dbengine.Receipt, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	receipt, found := f.receipts[receiptId]
+	if !found || !f.visible(userId, receipt) {
+		return nil, dbengine.ErrReceiptNotFound
+	}
+	return &receipt, nil
+}
+
+func (f *fakeRepository) GetReceipts(
+	ctx context.Context,
+	userId int64,
+	filter dbengine.ReceiptFilter,
+	limit int,
+	offset int) ([]dbengine.Receipt, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	receipts := []dbengine.Receipt{}
+	for _, receipt := range f.receipts {
+		if f.visible(userId, receipt) {
+			receipts = append(receipts, receipt)
+		}
+	}
+	sort.Slice(receipts, func(i, j int) bool {
+		return receipts[i].Id > receipts[j].Id
+	})
+	if offset > len(receipts) {
+		offset = len(receipts)
+	}
+	receipts = receipts[offset:]
+	if limit < len(receipts) {
+		receipts = receipts[:limit]
+	}
+	return receipts, nil
+}
+
+func (f *fakeRepository) CountReceipts(
+	ctx context.Context,
+	userId int64,
+	filter dbengine.ReceiptFilter) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := int64(0)
+	for _, receipt := range f.receipts {
+		if f.visible(userId, receipt) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (f *fakeRepository) GetExtractedFields(
+	ctx context.Context,
+	userId int64,
+	receiptId int64) (map[string]dbengine.ExtractedField, error) {
+	return map[string]dbengine.ExtractedField{}, nil
+}
+
+func (f *fakeRepository) UpdateReceipt(
+	ctx context.Context,
+	userId int64,
+	receiptId int64,
+	update dbengine.ReceiptUpdate) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	receipt, err := f.owned(userId, receiptId)
+	if err != nil {
+		return err
+	}
+	if update.PurchaseDate != nil {
+		receipt.PurchaseDate = *update.PurchaseDate
+	}
+	if update.ExpiryDate != nil {
+		receipt.ExpiryDate = *update.ExpiryDate
+	}
+	tags := []string{}
+	for _, tag := range append(receipt.Tags, update.AddTags...) {
+		removed := false
+		for _, remove := range update.RemoveTags {
+			removed = removed || tag == remove
+		}
+		if !removed {
+			tags = append(tags, tag)
+		}
+	}
+	receipt.Tags = tags
+	f.receipts[receiptId] = receipt
+	return nil
+}
+
+func (f *fakeRepository) DeleteReceipt(
+	ctx context.Context,
+	userId int64,
+	store blobstore.BlobStore,
+	receiptId int64) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	receipt, err := f.owned(userId, receiptId)
+	if err != nil {
+		return "", err
+	}
+	delete(f.receipts, receiptId)
+	delete(f.receiptShares, receiptId)
+	for _, other := range f.receipts {
+		if other.Filename == receipt.Filename {
+			return "", nil
+		}
+	}
+	store.Delete(ctx, receipt.Filename)
+	return receipt.Filename, nil
+}
+
+func (f *fakeRepository) SearchReceipts(
+	ctx context.Context,
+	userId int64,
+	text string,
+	limit int,
+	offset int) ([]dbengine.SearchResult, error) {
+	return nil, dbengine.ErrSearchUnavailable
+}
+
+func (f *fakeRepository) CountSearchResults(
+	ctx context.Context,
+	userId int64,
+	text string) (int64, error) {
+	return 0, dbengine.ErrSearchUnavailable
+}
+
+func (f *fakeRepository) GetSpending(
+	ctx context.Context,
+	userId int64,
+	groupBy string,
+	filter dbengine.ReceiptFilter) ([]dbengine.SpendingRow, error) {
+	return []dbengine.SpendingRow{}, nil
+}
+
+// addShare shares with the named user unless they are the owner
+func addShare(shares map[int64]bool, ownerId int64, withUser string) error {
+	userId, found := fakeUsers[withUser]
+	if !found {
+		return dbengine.ErrUserNotFound
+	}
+	if userId == ownerId {
+		return dbengine.ErrShareWithOwner
+	}
+	shares[userId] = true
+	return nil
+}
+
+func removeShare(shares map[int64]bool, withUser string) error {
+	userId := fakeUsers[withUser]
+	if !shares[userId] {
+		return dbengine.ErrShareNotFound
+	}
+	delete(shares, userId)
+	return nil
+}
+
+func shareNames(shares map[int64]bool) []string {
+	names := []string{}
+	for name, userId := range fakeUsers {
+		if shares[userId] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *fakeRepository) ShareReceipt(
+	ctx context.Context,
+	userId int64,
+	receiptId int64,
+	withUser string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.owned(userId, receiptId); err != nil {
+		return err
+	}
+	if f.receiptShares[receiptId] == nil {
+		f.receiptShares[receiptId] = map[int64]bool{}
+	}
+	return addShare(f.receiptShares[receiptId], userId, withUser)
+}
+
+func (f *fakeRepository) UnshareReceipt(
+	ctx context.Context,
+	userId int64,
+	receiptId int64,
+	withUser string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.owned(userId, receiptId); err != nil {
+		return err
+	}
+	return removeShare(f.receiptShares[receiptId], withUser)
+}
+
+func (f *fakeRepository) GetReceiptShares(
+	ctx context.Context,
+	userId int64,
+	receiptId int64) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.owned(userId, receiptId); err != nil {
+		return nil, err
+	}
+	return shareNames(f.receiptShares[receiptId]), nil
+}
+
+// tagShare returns the shares of the user's own tag
+func (f *fakeRepository) tagShare(userId int64, tag string) (map[int64]bool, error) {
+	for _, receipt := range f.receipts {
+		for _, t := range receipt.Tags {
+			if receipt.OwnerId != userId || t != tag {
+				continue
+			}
+			key := tagKey{userId, tag}
+			if f.tagShares[key] == nil {
+				f.tagShares[key] = map[int64]bool{}
+			}
+			return f.tagShares[key], nil
+		}
+	}
+	return nil, dbengine.ErrTagNotFound
+}
+
+func (f *fakeRepository) ShareTag(
+	ctx context.Context,
+	userId int64,
+	tag string,
+	withUser string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shares, err := f.tagShare(userId, tag)
+	if err != nil {
+		return err
+	}
+	return addShare(shares, userId, withUser)
+}
+
+func (f *fakeRepository) UnshareTag(
+	ctx context.Context,
+	userId int64,
+	tag string,
+	withUser string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shares, err := f.tagShare(userId, tag)
+	if err != nil {
+		return err
+	}
+	return removeShare(shares, withUser)
+}
+
+func (f *fakeRepository) GetTagShares(
+	ctx context.Context,
+	userId int64,
+	tag string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	shares, err := f.tagShare(userId, tag)
+	if err != nil {
+		return nil, err
+	}
+	return shareNames(shares), nil
+}
+
+// Tokens of the fake token repository by their scopes
+const (
+	readToken  = "rt_read"
+	writeToken = "rt_write"
+	adminToken = "rt_admin"
+	bobToken   = "rt_bob"
+)
+
+// fakeTokens keeps the API tokens in memory by the token itself
+type fakeTokens struct {
+	mu     sync.Mutex
+	tokens map[string]*dbengine.ApiToken
+}
+
+func newFakeTokens() *fakeTokens {
+	f := &fakeTokens{tokens: map[string]*dbengine.ApiToken{}}
+	f.add(aliceId, readToken, dbengine.SCOPE_READ)
+	f.add(aliceId, writeToken, dbengine.SCOPE_READ, dbengine.SCOPE_WRITE)
+	f.add(aliceId, adminToken, dbengine.SCOPE_ADMIN)
+	f.add(bobId, bobToken, dbengine.SCOPE_READ, dbengine.SCOPE_WRITE)
+	return f
+}
+
+func (f *fakeTokens) add(userId int64, token string, scopes ...string) *dbengine.ApiToken {
+	apiToken := &dbengine.ApiToken{
+		Id:        int64(len(f.tokens) + 1),
+		UserId:    userId,
+		Name:      token,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	f.tokens[token] = apiToken
+	return apiToken
+}
+
+func (f *fakeTokens) Authenticate(ctx context.Context, token string) (*dbengine.ApiToken, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	apiToken, found := f.tokens[token]
+	if !found || apiToken.RevokedAt != nil {
+		return nil, dbengine.ErrInvalidToken
+	}
+	return apiToken, nil
+}
+
+func (f *fakeTokens) CreateApiToken(
+	ctx context.Context,
+	userId int64,
+	name string,
+	scopes []string) (string, *dbengine.ApiToken, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	token := "rt_" + strconv.Itoa(len(f.tokens)+1)
+	apiToken := f.add(userId, token, scopes...)
+	apiToken.Name = name
+	return token, apiToken, nil
+}
+
+func (f *fakeTokens) ListApiTokens(ctx context.Context, userId int64) ([]dbengine.ApiToken, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tokens := []dbengine.ApiToken{}
+	for _, apiToken := range f.tokens {
+		if apiToken.UserId == userId {
+			tokens = append(tokens, *apiToken)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Id < tokens[j].Id
+	})
+	return tokens, nil
+}
+
+func (f *fakeTokens) RevokeApiToken(ctx context.Context, userId int64, tokenId int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, apiToken := range f.tokens {
+		if apiToken.Id == tokenId && apiToken.UserId == userId && apiToken.RevokedAt == nil {
+			now := time.Now().UTC()
+			apiToken.RevokedAt = &now
+			return nil
+		}
+	}
+	return dbengine.ErrTokenNotFound
+}
+
+func TestServeDrainsSlowUpload(t *testing.T) {
+	cfg := config.Default()
+	cfg.ThumbnailDir = t.TempDir()
+	cfg.ShutdownTimeout = 5 * time.Second
+	server := NewServer(
+		cfg,
+		newFakeRepository(),
+		newFakeTokens(),
+		blobstore.NewLocalStore(t.TempDir()),
+		nil)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- server.Serve(ctx, listener)
+	}()
+
+	body, contentType := multipartBody(t, "receipt.jpg", encodeImage(t, "jpeg"))
+	upload := body.Bytes()
+	bodyReader, bodyWriter := io.Pipe()
+	statusCh := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("POST",
+			"http://"+listener.Addr().String()+"/receipts/",
+			bodyReader)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer "+writeToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Upload failed: %v", err)
+			statusCh <- 0
+			return
+		}
+		resp.Body.Close()
+		statusCh <- resp.StatusCode
+	}()
+
+	// Half of the upload arrives before the shutdown and the rest after
+	bodyWriter.Write(upload[:len(upload)/2])
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-serveErrCh:
+		t.Fatalf("Serve() returned %v before the upload completed", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	bodyWriter.Write(upload[len(upload)/2:])
+	bodyWriter.Close()
+
+	if status := <-statusCh; status != http.StatusCreated {
+		t.Errorf("Upload during shutdown = %d, want %d",
+			status,
+			http.StatusCreated)
+	}
+	if err := <-serveErrCh; err != nil {
+		t.Errorf("Serve() error = %v", err)
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/"); err == nil {
+		t.Errorf("Server still accepts requests after Serve() returned")
+	}
+}
@@ -0,0 +1,119 @@
+package httpserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"receiptstracker-api/dbengine"
+)
+
+type shareList struct {
+	Users []string `json:"users"`
+}
+
+// sharing shares one receipt or tag of the user, the user who wants to
+// share it being the first argument.
+type sharing struct {
+	// kind is either receipt or tag and label tells which one
+	kind    string
+	label   string
+	share   func(ctx context.Context, userId int64, withUser string) error
+	unshare func(ctx context.Context, userId int64, withUser string) error
+	list    func(ctx context.Context, userId int64) ([]string, error)
+}
+
+func receiptSharing(db ReceiptRepository, receiptId int64) sharing {
+	return sharing{
+		kind:  "receipt",
+		label: fmt.Sprintf("receipt %d", receiptId),
+		share: func(ctx context.Context, userId int64, withUser string) error {
+			return db.ShareReceipt(ctx, userId, receiptId, withUser)
+		},
+		unshare: func(ctx context.Context, userId int64, withUser string) error {
+			return db.UnshareReceipt(ctx, userId, receiptId, withUser)
+		},
+		list: func(ctx context.Context, userId int64) ([]string, error) {
+			return db.GetReceiptShares(ctx, userId, receiptId)
+		},
+	}
+}
+
+func tagSharing(db ReceiptRepository, tag string) sharing {
+	return sharing{
+		kind:  "tag",
+		label: fmt.Sprintf("tag %q", tag),
+		share: func(ctx context.Context, userId int64, withUser string) error {
+			return db.ShareTag(ctx, userId, tag, withUser)
+		},
+		unshare: func(ctx context.Context, userId int64, withUser string) error {
+			return db.UnshareTag(ctx, userId, tag, withUser)
+		},
+		list: func(ctx context.Context, userId int64) ([]string, error) {
+			return db.GetTagShares(ctx, userId, tag)
+		},
+	}
+}
+
+// serveShares lists the users a receipt or a tag has been shared with
+// when withUser is empty and otherwise shares it with the user on PUT
+// and stops sharing on DELETE.
+func (s *Server) serveShares(
+	w http.ResponseWriter,
+	r *http.Request,
+	withUser string,
+	sh sharing) {
+	userId := requestUserId(r)
+	if withUser == "" {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			WriteJSONError(w, http.StatusMethodNotAllowed,
+				"Supported methods: GET")
+			return
+		}
+		users, err := sh.list(r.Context(), userId)
+		if err != nil {
+			writeShareError(w, err, "Failed to fetch shares")
+			return
+		}
+		WriteJSON(w, http.StatusOK, shareList{Users: users})
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		if err := sh.share(r.Context(), userId, withUser); err != nil {
+			writeShareError(w, err, "Failed to share "+sh.kind)
+			return
+		}
+		log.Printf("User %d shared %s with %q", userId, sh.label, withUser)
+	case "DELETE":
+		if err := sh.unshare(r.Context(), userId, withUser); err != nil {
+			writeShareError(w, err, "Failed to unshare "+sh.kind)
+			return
+		}
+		log.Printf("User %d stopped sharing %s with %q", userId, sh.label, withUser)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		WriteJSONError(w, http.StatusMethodNotAllowed,
+			"Supported methods: PUT, DELETE")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeShareError(w http.ResponseWriter, err error, failure string) {
+	switch err {
+	case dbengine.ErrReceiptNotFound,
+		dbengine.ErrTagNotFound,
+		dbengine.ErrUserNotFound,
+		dbengine.ErrShareNotFound:
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+	case dbengine.ErrNotOwner:
+		WriteJSONError(w, http.StatusForbidden, err.Error())
+	case dbengine.ErrShareWithOwner:
+		WriteJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		WriteJSONError(w, http.StatusInternalServerError, failure)
+	}
+}
@@ -0,0 +1,80 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"receiptstracker-api/dbengine"
+	"strings"
+	"testing"
+)
+
+func Test_serveShares(t *testing.T) {
+	handler := testServer(t,
+		dbengine.Receipt{Id: 1, Filename: "a.jpg", Tags: []string{"food"}},
+		dbengine.Receipt{Id: 2, Filename: "b.jpg", Tags: []string{"home/garden"}},
+	).Handler()
+	request := func(method string, path string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	bobSees := func(path string) bool {
+		return request("GET", path, bobToken).Code == http.StatusOK
+	}
+
+	if bobSees("/receipts/1") {
+		t.Errorf("Bob sees receipt 1 before it is shared")
+	}
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"PUT", "/receipts/1/shares/bob", bobToken, http.StatusNotFound},
+		{"PUT", "/receipts/1/shares/carol", writeToken, http.StatusNotFound},
+		{"PUT", "/receipts/1/shares/alice", writeToken, http.StatusBadRequest},
+		{"PUT", "/receipts/1/shares/bob", readToken, http.StatusForbidden},
+		{"POST", "/receipts/1/shares/bob", writeToken, http.StatusMethodNotAllowed},
+		{"PUT", "/receipts/1/shares/bob", writeToken, http.StatusNoContent},
+		{"GET", "/receipts/1/shares", bobToken, http.StatusForbidden},
+		{"PATCH", "/receipts/1", bobToken, http.StatusForbidden},
+		{"DELETE", "/receipts/1", bobToken, http.StatusForbidden},
+		{"PUT", "/tags/nope/shares/bob", writeToken, http.StatusNotFound},
+		{"GET", "/tags/home/garden", writeToken, http.StatusNotFound},
+		{"PUT", "/tags/home/garden/shares/bob", writeToken, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		if rec := request(tt.method, tt.path, tt.token); rec.Code != tt.want {
+			t.Errorf("%s %s = %d %s, want %d",
+				tt.method, tt.path, rec.Code, rec.Body.String(), tt.want)
+		}
+	}
+
+	if !bobSees("/receipts/1") || !bobSees("/receipts/2") {
+		t.Errorf("Bob doesn't see the shared receipts")
+	}
+	rec := request("GET", "/receipts/1/shares", readToken)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"bob"`) {
+		t.Errorf("Listing shares = %d %s, want bob", rec.Code, rec.Body.String())
+	}
+	rec = request("GET", "/tags/home/garden/shares", readToken)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"bob"`) {
+		t.Errorf("Listing tag shares = %d %s, want bob", rec.Code, rec.Body.String())
+	}
+
+	if rec := request("DELETE", "/receipts/1/shares/bob", writeToken); rec.Code != http.StatusNoContent {
+		t.Errorf("Unsharing receipt = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := request("DELETE", "/tags/home/garden/shares/bob", writeToken); rec.Code != http.StatusNoContent {
+		t.Errorf("Unsharing tag = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := request("DELETE", "/receipts/1/shares/bob", writeToken); rec.Code != http.StatusNotFound {
+		t.Errorf("Unsharing receipt twice = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if bobSees("/receipts/1") || bobSees("/receipts/2") {
+		t.Errorf("Bob still sees the receipts after unsharing")
+	}
+}
@@ -0,0 +1,33 @@
+package httpserver
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// TagsHandler serves the shares of the user's tags under
+// /tags/{tag}/shares/. Tags are read up to the last "/shares" since they
+// may have slashes of their own.
+func (s *Server) TagsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Incoming %s %s connection from %s",
+		r.Method,
+		r.URL.Path,
+		r.RemoteAddr)
+
+	resource := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tags"), "/")
+	tag, withUser := resource, ""
+	if i := strings.LastIndex(resource, "/shares/"); i > 0 {
+		tag, withUser = resource[:i], resource[i+len("/shares/"):]
+	} else if strings.HasSuffix(resource, "/shares") {
+		tag = strings.TrimSuffix(resource, "/shares")
+	} else {
+		WriteJSONError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if tag == "" || strings.Contains(withUser, "/") {
+		WriteJSONError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	s.serveShares(w, r, withUser, tagSharing(s.db, tag))
+}
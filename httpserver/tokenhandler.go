@@ -0,0 +1,127 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"receiptstracker-api/dbengine"
+	"receiptstracker-api/external"
+	"strconv"
+	"strings"
+)
+
+type tokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// createdToken is the only response in which the token itself is shown
+type createdToken struct {
+	Token string `json:"token"`
+	*dbengine.ApiToken
+}
+
+type tokenList struct {
+	Tokens []dbengine.ApiToken `json:"tokens"`
+}
+
+// TokensHandler serves everything under /tokens/
+func (s *Server) TokensHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Incoming %s %s connection from %s",
+		r.Method,
+		r.URL.Path,
+		r.RemoteAddr)
+
+	resource := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tokens"), "/")
+	if resource == "" {
+		switch r.Method {
+		case "GET":
+			s.listTokens(w, r)
+		case "POST":
+			s.createToken(w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			WriteJSONError(w, http.StatusMethodNotAllowed,
+				"Supported methods: GET, POST")
+		}
+		return
+	}
+
+	tokenId, err := strconv.ParseInt(resource, 10, 64)
+	if err != nil {
+		WriteJSONError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		WriteJSONError(w, http.StatusMethodNotAllowed,
+			"Supported methods: DELETE")
+		return
+	}
+	s.revokeToken(w, r, tokenId)
+}
+
+func (s *Server) listTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := s.tokens.ListApiTokens(r.Context(), requestUserId(r))
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to fetch tokens")
+		return
+	}
+	WriteJSON(w, http.StatusOK, tokenList{Tokens: tokens})
+}
+
+func (s *Server) createToken(w http.ResponseWriter, r *http.Request) {
+	var request tokenRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, external.MAX_JSON_BODY_SIZE))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		WriteJSONError(w, http.StatusBadRequest, "Malformed JSON body")
+		return
+	}
+
+	fieldErrors := map[string]string{}
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		fieldErrors["name"] = "Missing name"
+	}
+	scopes, err := dbengine.ParseScopes(strings.Join(request.Scopes, ","))
+	if err != nil {
+		fieldErrors["scopes"] = err.Error()
+	}
+	if len(fieldErrors) > 0 {
+		WriteValidationErrors(w, fieldErrors)
+		return
+	}
+
+	token, apiToken, err := s.tokens.CreateApiToken(r.Context(), requestUserId(r), name, scopes)
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to create token")
+		return
+	}
+	log.Printf("Created API token %d %q of user %d with scopes %v",
+		apiToken.Id,
+		apiToken.Name,
+		apiToken.UserId,
+		apiToken.Scopes)
+	WriteJSON(w, http.StatusCreated, createdToken{
+		Token:    token,
+		ApiToken: apiToken,
+	})
+}
+
+func (s *Server) revokeToken(w http.ResponseWriter, r *http.Request, tokenId int64) {
+	err := s.tokens.RevokeApiToken(r.Context(), requestUserId(r), tokenId)
+	if err == dbengine.ErrTokenNotFound {
+		WriteJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		WriteJSONError(w, http.StatusInternalServerError,
+			"Failed to revoke token")
+		return
+	}
+	log.Printf("Revoked API token %d", tokenId)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,54 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_tokensHandler(t *testing.T) {
+	handler := testServer(t).Handler()
+	request := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("POST", "/tokens/", adminToken, `{"name": "scanner", "scopes": ["bogus"]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Creating token with unknown scope = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec = request("POST", "/tokens/", adminToken, `{"name": "scanner", "scopes": ["read"]}`)
+	var created createdToken
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("Creating token = %d, %v, want %d", rec.Code, err, http.StatusCreated)
+	}
+	if rec := request("GET", "/receipts/", created.Token, ""); rec.Code != http.StatusOK {
+		t.Errorf("Reading with the new token = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	rec = request("GET", "/tokens/", adminToken, "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"scanner"`) {
+		t.Errorf("Listing tokens = %d %s, want the new token", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), created.Token) {
+		t.Errorf("Listing tokens shows the token itself")
+	}
+
+	path := fmt.Sprintf("/tokens/%d", created.Id)
+	if rec := request("DELETE", path, adminToken, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Revoking token = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := request("DELETE", path, adminToken, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Revoking token twice = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := request("GET", "/receipts/", created.Token, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Reading with revoked token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,243 @@
+// Package imagemeta removes metadata such as GPS coordinates and device
+// details from uploaded images and turns them upright.
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"receiptstracker-api/utils"
+
+	"golang.org/x/image/tiff"
+)
+
+const jpegQuality int = 92
+
+var ErrTruncated = errors.New("Image data is truncated")
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Ancillary PNG chunks holding EXIF, free text and modification time
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// Clean returns the image without its metadata, rotated upright
+// according to its EXIF orientation, together with the metadata worth
+// keeping. Images which are already upright are not re-encoded, only
+// their metadata is dropped. GIFs carry no EXIF and are returned as is.
+// Images larger than maxPixels are refused instead of being re-encoded.
+func Clean(content []byte, mimeType string, maxPixels int64) ([]byte, Metadata, error) {
+	switch mimeType {
+	case "image/jpeg":
+		meta := parseExif(jpegExif(content))
+		if meta.Orientation != 1 {
+			cleaned, err := reencode(content, meta.Orientation, maxPixels, encodeJpeg)
+			return cleaned, meta, err
+		}
+		cleaned, err := stripJpeg(content)
+		return cleaned, meta, err
+	case "image/png":
+		cleaned, exif, err := stripPng(content)
+		meta := parseExif(exif)
+		if err == nil && meta.Orientation != 1 {
+			cleaned, err = reencode(cleaned, meta.Orientation, maxPixels, png.Encode)
+		}
+		return cleaned, meta, err
+	case "image/tiff":
+		// Metadata lives in the same directories as the image layout,
+		// so a TIFF is always written again. Only the first page is
+		// kept since that is all the decoder reads.
+		meta := parseExif(content)
+		cleaned, err := reencode(content, meta.Orientation, maxPixels, encodeTiff)
+		return cleaned, meta, err
+	}
+	return content, Metadata{Orientation: 1}, nil
+}
+
+type encodeFunc func(w io.Writer, img image.Image) error
+
+func encodeJpeg(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+}
+
+func encodeTiff(w io.Writer, img image.Image) error {
+	return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+}
+
+// reencode decodes the image and writes only its pixels back, which
+// leaves all metadata behind.
+func reencode(
+	content []byte,
+	orientation int,
+	maxPixels int64,
+	encode encodeFunc) ([]byte, error) {
+	img, err := utils.DecodeImage(bytes.NewReader(content), maxPixels)
+	if err != nil {
+		return nil, fmt.Errorf("decoding image failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := encode(&buf, orient(img, orientation)); err != nil {
+		return nil, fmt.Errorf("encoding image failed: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// orient turns the image the way the EXIF orientation tells a viewer to
+// display it.
+func orient(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		// Transposing ones swap width and height
+		dstW, dstH = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := x, y
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx = w - 1 - x
+			case 3: // Rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				dy = h - 1 - y
+			case 5: // Transposed
+				dx, dy = y, x
+			case 6: // Rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // Transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotated 90° counterclockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// keepJpegSegment tells whether a marker segment before the end of
+// image is needed to display the image. JFIF and Adobe segments affect
+// how colours are decoded and ICC profiles what they look like. APP2 is
+// also used for multi-picture data pointing at previews after the end.
+func keepJpegSegment(marker byte, payload []byte) bool {
+	switch {
+	case marker == 0xE0 || marker == 0xEE:
+		return true
+	case marker == 0xE2:
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case marker > 0xE0 && marker <= 0xEF, marker == 0xFE:
+		// Other application segments and comments
+		return false
+	}
+	return true
+}
+
+// stripJpeg copies the JPEG without metadata segments and without
+// anything after the end of image marker, where phones put previews
+// with their own EXIF. The compressed image data is copied untouched.
+func stripJpeg(content []byte) ([]byte, error) {
+	if len(content) < 2 || content[0] != 0xFF || content[1] != 0xD8 {
+		return nil, errors.New("Not a JPEG image")
+	}
+	var out bytes.Buffer
+	out.Write(content[:2])
+
+	pos := 2
+	for {
+		if pos+2 > len(content) || content[pos] != 0xFF {
+			return nil, ErrTruncated
+		}
+		marker := content[pos+1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte before a marker
+			pos++
+			continue
+		case marker == 0xD9:
+			out.Write(content[pos : pos+2])
+			return out.Bytes(), nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// Markers without a length
+			out.Write(content[pos : pos+2])
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(content) {
+			return nil, ErrTruncated
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(content[pos+2:pos+4]))
+		if end < pos+4 || end > len(content) {
+			return nil, ErrTruncated
+		}
+		if keepJpegSegment(marker, content[pos+4:end]) {
+			out.Write(content[pos:end])
+		}
+		pos = end
+
+		if marker == 0xDA {
+			// Compressed data runs until a marker other than a stuffed
+			// zero byte or a restart marker
+			start := pos
+			for pos+1 < len(content) {
+				next := content[pos+1]
+				if content[pos] == 0xFF && next != 0x00 && (next < 0xD0 || next > 0xD7) {
+					break
+				}
+				pos++
+			}
+			out.Write(content[start:pos])
+		}
+	}
+}
+
+// stripPng copies the PNG without the metadata chunks and returns the
+// EXIF of the eXIf chunk for reading the orientation.
+func stripPng(content []byte) ([]byte, []byte, error) {
+	if !bytes.HasPrefix(content, pngSignature) {
+		return nil, nil, errors.New("Not a PNG image")
+	}
+	var out bytes.Buffer
+	var exif []byte
+	out.Write(pngSignature)
+
+	pos := len(pngSignature)
+	for {
+		// Length, type, data and CRC
+		if pos+8 > len(content) {
+			return nil, nil, ErrTruncated
+		}
+		length := uint64(binary.BigEndian.Uint32(content[pos : pos+4]))
+		chunkType := string(content[pos+4 : pos+8])
+		end := uint64(pos) + 12 + length
+		if end > uint64(len(content)) {
+			return nil, nil, ErrTruncated
+		}
+		if chunkType == "eXIf" {
+			exif = content[pos+8 : end-4]
+		}
+		if !pngMetadataChunks[chunkType] {
+			out.Write(content[pos:end])
+		}
+		pos = int(end)
+		if chunkType == "IEND" {
+			return out.Bytes(), exif, nil
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// jpegWithExif encodes a w x h JPEG and inserts an APP1 Exif segment,
+// a comment and a trailing preview after the end of image.
+func jpegWithExif(t *testing.T, w, h int, exif []byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatalf("Encoding JPEG failed: %v", err)
+	}
+	encoded := buf.Bytes()
+
+	segment := func(marker byte, payload []byte) []byte {
+		s := []byte{0xFF, marker, 0, 0}
+		binary.BigEndian.PutUint16(s[2:], uint16(len(payload)+2))
+		return append(s, payload...)
+	}
+	out := append([]byte{}, encoded[:2]...)
+	out = append(out, segment(0xE1, append([]byte("Exif\x00\x00"), exif...))...)
+	out = append(out, segment(0xFE, []byte("Taken with a phone"))...)
+	out = append(out, encoded[2:]...)
+	return append(out, []byte("\xFF\xD8preview Exif\xFF\xD9")...)
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+// pngWithMetadata inserts a text chunk and an eXIf chunk right after
+// the header chunk of a w x h PNG.
+func pngWithMetadata(t *testing.T, w, h int, exif []byte) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatalf("Encoding PNG failed: %v", err)
+	}
+	encoded := buf.Bytes()
+	// Signature and the 25 byte IHDR chunk
+	headerEnd := len(pngSignature) + 25
+	out := append([]byte{}, encoded[:headerEnd]...)
+	out = append(out, pngChunk("tEXt", []byte("Author\x00Somebody"))...)
+	out = append(out, pngChunk("eXIf", exif)...)
+	return append(out, encoded[headerEnd:]...)
+}
+
+func TestClean(t *testing.T) {
+	taken := time.Date(2022, 1, 15, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name            string
+		content         []byte
+		mimeType        string
+		wantWidth       int
+		wantHeight      int
+		wantOrientation int
+	}{
+		{"Upright JPEG", jpegWithExif(t, 40, 20, exifTiff(binary.LittleEndian, 1, "2022:01:15 09:30:00")), "image/jpeg", 40, 20, 1},
+		{"Rotated JPEG", jpegWithExif(t, 40, 20, exifTiff(binary.BigEndian, 6, "2022:01:15 09:30:00")), "image/jpeg", 20, 40, 6},
+		{"Upright PNG", pngWithMetadata(t, 30, 10, exifTiff(binary.LittleEndian, 1, "2022:01:15 09:30:00")), "image/png", 30, 10, 1},
+		{"Rotated PNG", pngWithMetadata(t, 30, 10, exifTiff(binary.LittleEndian, 8, "2022:01:15 09:30:00")), "image/png", 10, 30, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, meta, err := Clean(tt.content, tt.mimeType, 1000)
+			if err != nil {
+				t.Fatalf("%s: Clean() error = %v", tt.name, err)
+			}
+			if meta.Orientation != tt.wantOrientation || !meta.CapturedAt.Equal(taken) {
+				t.Errorf("%s: Clean() metadata = %d, %v, want %d, %v",
+					tt.name,
+					meta.Orientation,
+					meta.CapturedAt,
+					tt.wantOrientation,
+					taken)
+			}
+			for _, leftover := range []string{"Exif", "eXIf", "tEXt", "phone", "preview"} {
+				if bytes.Contains(got, []byte(leftover)) {
+					t.Errorf("%s: Clean() left %q in the image", tt.name, leftover)
+				}
+			}
+			config, _, err := image.DecodeConfig(bytes.NewReader(got))
+			if err != nil || config.Width != tt.wantWidth || config.Height != tt.wantHeight {
+				t.Errorf("%s: Clean() image = %dx%d, %v, want %dx%d",
+					tt.name,
+					config.Width,
+					config.Height,
+					err,
+					tt.wantWidth,
+					tt.wantHeight)
+			}
+			if _, _, err := image.Decode(bytes.NewReader(got)); err != nil {
+				t.Errorf("%s: decoding cleaned image failed: %v", tt.name, err)
+			}
+		})
+	}
+}
+
+func TestCleanTruncated(t *testing.T) {
+	content := jpegWithExif(t, 40, 20, exifTiff(binary.LittleEndian, 1, "2022:01:15 09:30:00"))
+	// Cut before the end of image marker
+	if _, _, err := Clean(content[:len(content)-30], "image/jpeg", 1000); err != ErrTruncated {
+		t.Errorf("Clean() of truncated JPEG error = %v, want %v", err, ErrTruncated)
+	}
+	pngContent := pngWithMetadata(t, 30, 10, nil)
+	if _, _, err := Clean(pngContent[:len(pngContent)-6], "image/png", 1000); err != ErrTruncated {
+		t.Errorf("Clean() of truncated PNG error = %v, want %v", err, ErrTruncated)
+	}
+}
+
+func TestCleanTooLarge(t *testing.T) {
+	// Only images which need turning are decoded
+	rotated := jpegWithExif(t, 40, 20, exifTiff(binary.BigEndian, 6, "2022:01:15 09:30:00"))
+	if _, _, err := Clean(rotated, "image/jpeg", 40*20-1); err == nil {
+		t.Errorf("Clean() of a JPEG larger than allowed succeeded")
+	}
+	if _, _, err := Clean(rotated, "image/jpeg", 40*20); err != nil {
+		t.Errorf("Clean() error = %v", err)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 3x2 image with the top left pixel marked, followed by where the
+	// mark ends up and the size once displayed upright
+	tests := []struct {
+		orientation int
+		wantX       int
+		wantY       int
+		wantWidth   int
+	}{
+		{1, 0, 0, 3},
+		{2, 2, 0, 3},
+		{3, 2, 1, 3},
+		{4, 0, 1, 3},
+		{5, 0, 0, 2},
+		{6, 1, 0, 2},
+		{7, 1, 2, 2},
+		{8, 0, 2, 2},
+	}
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	src.SetGray(0, 0, color.Gray{255})
+	for _, tt := range tests {
+		got := orient(src, tt.orientation)
+		r, _, _, _ := got.At(tt.wantX, tt.wantY).RGBA()
+		if r != 0xFFFF || got.Bounds().Dx() != tt.wantWidth {
+			t.Errorf("orient(%d) has mark %d at (%d, %d) in %d wide image, want mark in %d wide",
+				tt.orientation,
+				r,
+				tt.wantX,
+				tt.wantY,
+				got.Bounds().Dx(),
+				tt.wantWidth)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+const (
+	tagOrientation      uint16 = 0x0112
+	tagDateTime         uint16 = 0x0132
+	tagExifIFD          uint16 = 0x8769
+	tagDateTimeOriginal uint16 = 0x9003
+
+	typeShort uint16 = 3
+	typeLong  uint16 = 4
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// Metadata is what is worth keeping from the EXIF before it is removed
+type Metadata struct {
+	// Orientation is the EXIF orientation from 1 to 8, 1 being upright
+	Orientation int
+	// CapturedAt is the local wall clock time the photo was taken,
+	// zero when unknown
+	CapturedAt time.Time
+}
+
+// jpegExif returns the TIFF structure inside the APP1 Exif segment
+func jpegExif(content []byte) []byte {
+	if len(content) < 4 || content[0] != 0xFF || content[1] != 0xD8 {
+		return nil
+	}
+	pos := 2
+	for pos+4 <= len(content) {
+		if content[pos] != 0xFF {
+			return nil
+		}
+		marker := content[pos+1]
+		// Start of scan or end of image, no more metadata
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(content[pos+2 : pos+4]))
+		if length < 2 || pos+2+length > len(content) {
+			return nil
+		}
+		segment := content[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, exifHeader) {
+			return segment[len(exifHeader):]
+		}
+		pos += 2 + length
+	}
+	return nil
+}
+
+// tiffReader reads IFD entries without ever indexing past the data
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTiffReader(data []byte) *tiffReader {
+	if len(data) < 8 {
+		return nil
+	}
+	switch string(data[:4]) {
+	case "II*\x00":
+		return &tiffReader{data, binary.LittleEndian}
+	case "MM\x00*":
+		return &tiffReader{data, binary.BigEndian}
+	}
+	return nil
+}
+
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // the 4 byte value or offset field
+}
+
+func (r *tiffReader) ifd(offset uint32) []ifdEntry {
+	if uint64(offset)+2 > uint64(len(r.data)) {
+		return nil
+	}
+	count := int(r.order.Uint16(r.data[offset:]))
+	entries := []ifdEntry{}
+	for i := 0; i < count; i++ {
+		start := uint64(offset) + 2 + uint64(i)*12
+		if start+12 > uint64(len(r.data)) {
+			break
+		}
+		e := r.data[start : start+12]
+		entries = append(entries, ifdEntry{
+			tag:   r.order.Uint16(e[0:]),
+			typ:   r.order.Uint16(e[2:]),
+			count: r.order.Uint32(e[4:]),
+			value: e[8:12],
+		})
+	}
+	return entries
+}
+
+func (r *tiffReader) uint(e ifdEntry) uint32 {
+	switch e.typ {
+	case typeShort:
+		return uint32(r.order.Uint16(e.value))
+	case typeLong:
+		return r.order.Uint32(e.value)
+	}
+	return 0
+}
+
+func (r *tiffReader) ascii(e ifdEntry) string {
+	var raw []byte
+	if e.count <= 4 {
+		raw = e.value[:e.count]
+	} else {
+		offset := uint64(r.order.Uint32(e.value))
+		if offset+uint64(e.count) > uint64(len(r.data)) {
+			return ""
+		}
+		raw = r.data[offset : offset+uint64(e.count)]
+	}
+	return strings.TrimRight(string(raw), "\x00 ")
+}
+
+// parseExif reads the orientation and capture time from a TIFF
+// structure, which is what EXIF data is.
+func parseExif(data []byte) Metadata {
+	meta := Metadata{Orientation: 1}
+	r := newTiffReader(data)
+	if r == nil {
+		return meta
+	}
+
+	var dateTime string
+	for _, e := range r.ifd(r.order.Uint32(data[4:])) {
+		switch e.tag {
+		case tagOrientation:
+			if o := int(r.uint(e)); o >= 1 && o <= 8 {
+				meta.Orientation = o
+			}
+		case tagDateTime:
+			dateTime = r.ascii(e)
+		case tagExifIFD:
+			for _, sub := range r.ifd(r.uint(e)) {
+				if sub.tag == tagDateTimeOriginal {
+					// Time of taking the photo beats the time of editing it
+					if original := r.ascii(sub); original != "" {
+						dateTime = original
+					}
+				}
+			}
+		}
+	}
+	if t, err := time.Parse("2006:01:02 15:04:05", dateTime); err == nil {
+		meta.CapturedAt = t
+	}
+	return meta
+}
@@ -0,0 +1,100 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // inline value or data stored after the directories
+}
+
+// exifTiff builds an EXIF structure with the given orientation in IFD0,
+// dateTimeOriginal in the Exif IFD and a GPS IFD with a latitude.
+func exifTiff(order binary.ByteOrder, orientation uint16, dateTimeOriginal string) []byte {
+	short := make([]byte, 4)
+	order.PutUint16(short, orientation)
+	ifds := [][]testEntry{
+		{
+			{tagOrientation, typeShort, 1, short},
+			{tagExifIFD, typeLong, 1, nil},
+			{0x8825, typeLong, 1, nil}, // GPS IFD
+		},
+		{{tagDateTimeOriginal, 2, uint32(len(dateTimeOriginal) + 1), []byte(dateTimeOriginal + "\x00")}},
+		{{0x0001, 2, 2, []byte("N\x00\x00\x00")}},
+	}
+
+	// Directories one after another followed by the data of the strings
+	offsets := []uint32{8}
+	for _, ifd := range ifds {
+		offsets = append(offsets, offsets[len(offsets)-1]+uint32(2+12*len(ifd)+4))
+	}
+	dataOffset := offsets[len(ifds)]
+
+	var buf, data bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	binary.Write(&buf, order, offsets[0])
+	for i, ifd := range ifds {
+		binary.Write(&buf, order, uint16(len(ifd)))
+		for _, e := range ifd {
+			binary.Write(&buf, order, e.tag)
+			binary.Write(&buf, order, e.typ)
+			binary.Write(&buf, order, e.count)
+			switch {
+			case i == 0 && e.tag == tagExifIFD:
+				binary.Write(&buf, order, offsets[1])
+			case i == 0 && e.tag == 0x8825:
+				binary.Write(&buf, order, offsets[2])
+			case len(e.value) > 4:
+				binary.Write(&buf, order, dataOffset+uint32(data.Len()))
+				data.Write(e.value)
+			default:
+				buf.Write(e.value)
+			}
+		}
+		binary.Write(&buf, order, uint32(0))
+	}
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+func TestParseExif(t *testing.T) {
+	taken := time.Date(2021, 6, 30, 18, 45, 2, 0, time.UTC)
+	valid := exifTiff(binary.LittleEndian, 6, "2021:06:30 18:45:02")
+	tests := []struct {
+		name            string
+		data            []byte
+		wantOrientation int
+		wantCapturedAt  time.Time
+	}{
+		{"Little endian", valid, 6, taken},
+		{"Big endian", exifTiff(binary.BigEndian, 8, "2021:06:30 18:45:02"), 8, taken},
+		{"Orientation out of range", exifTiff(binary.LittleEndian, 9, "2021:06:30 18:45:02"), 1, taken},
+		{"Unset date", exifTiff(binary.LittleEndian, 3, "0000:00:00 00:00:00"), 3, time.Time{}},
+		{"No EXIF", nil, 1, time.Time{}},
+		{"Not TIFF", []byte("JFIF\x00\x01\x02\x03\x04"), 1, time.Time{}},
+		{"Truncated", valid[:40], 6, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseExif(tt.data)
+			if got.Orientation != tt.wantOrientation || !got.CapturedAt.Equal(tt.wantCapturedAt) {
+				t.Errorf("%s: parseExif() = %d, %v, want %d, %v",
+					tt.name,
+					got.Orientation,
+					got.CapturedAt,
+					tt.wantOrientation,
+					tt.wantCapturedAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/smtp"
+	"receiptstracker-api/dbengine"
+	"strings"
+	"time"
+)
+
+// Reminder tells the owner of a receipt that its warranty is about to
+// expire.
+type Reminder struct {
+	User     dbengine.User
+	Receipt  dbengine.Receipt
+	DaysLeft int
+	LeadDays int
+}
+
+func (r Reminder) Subject() string {
+	return fmt.Sprintf("Receipt %d expires in %d days",
+		r.Receipt.Id,
+		r.DaysLeft)
+}
+
+func (r Reminder) Body() string {
+	return fmt.Sprintf("Receipt %d (%s) expires on %s.\r\n"+
+		"Purchase date: %s\r\n"+
+		"Tags: %s\r\n",
+		r.Receipt.Id,
+		r.Receipt.Filename,
+		r.Receipt.ExpiryDate,
+		r.Receipt.PurchaseDate,
+		strings.Join(r.Receipt.Tags, ", "))
+}
+
+// Notifier delivers reminders. Returning an error leaves the reminder
+// unsent so that it's retried on the next round. Reminders of users the
+// notifier doesn't reach are left unsent without trying.
+type Notifier interface {
+	Reaches(user dbengine.User) bool
+	Notify(ctx context.Context, reminder Reminder) error
+}
+
+// LogNotifier writes reminders as log lines, e.g. into a file.
+type LogNotifier struct {
+	logger *log.Logger
+}
+
+func NewLogNotifier(w io.Writer) *LogNotifier {
+	return &LogNotifier{
+		logger: log.New(w, "", log.Ldate|log.Ltime),
+	}
+}
+
+func (n *LogNotifier) Reaches(user dbengine.User) bool {
+	return true
+}
+
+func (n *LogNotifier) Notify(ctx context.Context, reminder Reminder) error {
+	n.logger.Printf("REMINDER for %s: %s: %s",
+		reminder.User.Name,
+		reminder.Subject(),
+		strings.Replace(reminder.Body(), "\r\n", "; ", -1))
+	return nil
+}
+
+// SMTPNotifier sends reminders as plain text e-mails to the e-mail
+// address of the owner.
+type SMTPNotifier struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+// Reaches tells whether the user has set an e-mail address
+func (n *SMTPNotifier) Reaches(user dbengine.User) bool {
+	return user.Email != ""
+}
+
+func (n *SMTPNotifier) Notify(ctx context.Context, reminder Reminder) error {
+	to := reminder.User.Email
+	if to == "" {
+		return fmt.Errorf("user %q has no e-mail address", reminder.User.Name)
+	}
+	msg := fmt.Sprintf("From: %s\r\n"+
+		"To: %s\r\n"+
+		"Subject: %s\r\n"+
+		"Date: %s\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n"+
+		"\r\n%s",
+		n.From,
+		to,
+		reminder.Subject(),
+		time.Now().Format(time.RFC1123Z),
+		reminder.Body())
+
+	err := smtp.SendMail(n.Addr, n.Auth, n.From, []string{to}, []byte(msg))
+	if err != nil {
+		return fmt.Errorf("sending reminder mail via %s failed: %v",
+			n.Addr,
+			err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package notification
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/textproto"
+	"receiptstracker-api/dbengine"
+	"strings"
+	"testing"
+)
+
+// fakeSMTPServer accepts a single mail and hands its data to the channel.
+func fakeSMTPServer(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	mails := make(chan string, 1)
+
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost fake ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.Fields(line + " ")[0])
+			switch cmd {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 localhost")
+			case "MAIL", "RCPT", "RSET", "NOOP":
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 Go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				mails <- string(data)
+				tp.PrintfLine("250 Queued")
+			case "QUIT":
+				tp.PrintfLine("221 Bye")
+				return
+			default:
+				tp.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), mails
+}
+
+func testReminder() Reminder {
+	return Reminder{
+		User: dbengine.User{Id: 1, Name: "alice", Email: "alice@example.com"},
+		Receipt: dbengine.Receipt{
+			Id:           3,
+			Filename:     "abc.jpg",
+			PurchaseDate: "2018-01-01",
+			ExpiryDate:   "2020-01-08",
+			Tags:         []string{"laptop", "computershop"},
+		},
+		DaysLeft: 7,
+		LeadDays: 7,
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	addr, mails := fakeSMTPServer(t)
+	notifier := &SMTPNotifier{
+		Addr: addr,
+		From: "receipts@example.com",
+	}
+
+	if err := notifier.Notify(context.Background(), testReminder()); err != nil {
+		t.Fatalf("SMTPNotifier.Notify() error = %v", err)
+	}
+
+	mail := <-mails
+	for _, want := range []string{
+		"To: alice@example.com",
+		"Subject: Receipt 3 expires in 7 days",
+		"Receipt 3 (abc.jpg) expires on 2020-01-08.",
+		"Tags: laptop, computershop",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("SMTPNotifier.Notify() mail is missing %q:\n%s",
+				want,
+				mail)
+		}
+	}
+}
+
+func TestSMTPNotifierWithoutAddress(t *testing.T) {
+	notifier := &SMTPNotifier{
+		Addr: "127.0.0.1:0",
+		From: "receipts@example.com",
+	}
+	reminder := testReminder()
+	reminder.User.Email = ""
+
+	if err := notifier.Notify(context.Background(), reminder); err == nil {
+		t.Errorf("SMTPNotifier.Notify() to a user without address succeeded")
+	}
+}
+
+func TestLogNotifier(t *testing.T) {
+	buf := &bytes.Buffer{}
+	notifier := NewLogNotifier(buf)
+
+	if err := notifier.Notify(context.Background(), testReminder()); err != nil {
+		t.Fatalf("LogNotifier.Notify() error = %v", err)
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		lines++
+		if !strings.Contains(scanner.Text(), "REMINDER for alice: Receipt 3 expires in 7 days") {
+			t.Errorf("LogNotifier.Notify() unexpected line: %s", scanner.Text())
+		}
+	}
+	if lines != 1 {
+		t.Errorf("LogNotifier.Notify() wrote %d lines, want 1", lines)
+	}
+}
@@ -0,0 +1,137 @@
+package notification
+
+import (
+	"context"
+	"log"
+	"receiptstracker-api/dbengine"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scheduler periodically looks for receipts about to expire and sends
+// a reminder for each configured lead time once.
+type Scheduler struct {
+	db       *dbengine.Store
+	notifier Notifier
+	interval time.Duration
+	leadDays []int
+}
+
+func NewScheduler(
+	db *dbengine.Store,
+	notifier Notifier,
+	interval time.Duration,
+	leadDays []int) *Scheduler {
+	sortedLeadDays := append([]int{}, leadDays...)
+	// Shortest lead time first so that the most urgent reminder wins
+	sort.Ints(sortedLeadDays)
+
+	return &Scheduler{
+		db:       db,
+		notifier: notifier,
+		interval: interval,
+		leadDays: sortedLeadDays,
+	}
+}
+
+// Run checks expiries right away and then on every interval until
+// the context is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.CheckExpiries(ctx, time.Now()); err != nil {
+			log.Printf("ERROR: checking expiring receipts failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckExpiries sends reminders due on the given day to the owners of
+// the receipts and returns the number of reminders sent. Reminders of
+// users the notifier doesn't reach stay due and are logged once.
+func (s *Scheduler) CheckExpiries(ctx context.Context, now time.Time) (int, error) {
+	users, err := s.db.ListUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	unreached := []string{}
+	for _, user := range users {
+		reached := s.notifier.Reaches(user)
+		userSent, due, err := s.checkUserExpiries(ctx, user, now, reached)
+		sent += userSent
+		if err != nil {
+			return sent, err
+		}
+		if !reached && due > 0 {
+			unreached = append(unreached, user.Name)
+		}
+	}
+	if len(unreached) > 0 {
+		log.Printf("WARNING: Expiry reminders not sent to users without an e-mail address: %s",
+			strings.Join(unreached, ", "))
+	}
+	return sent, nil
+}
+
+// checkUserExpiries returns the number of reminders sent and the number
+// of them due, of which none are sent unless send is true.
+func (s *Scheduler) checkUserExpiries(
+	ctx context.Context,
+	user dbengine.User,
+	now time.Time,
+	send bool) (int, int, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	sent := 0
+	due := 0
+
+	for _, leadDays := range s.leadDays {
+		receipts, err := s.db.GetExpiringReceipts(ctx, user.Id, today, leadDays)
+		if err != nil {
+			return sent, due, err
+		}
+		due += len(receipts)
+		if !send {
+			continue
+		}
+
+		for _, receipt := range receipts {
+			expiryDate, err := time.Parse("2006-01-02", receipt.ExpiryDate)
+			if err != nil {
+				log.Printf("ERROR: malformed expiry date %q in receipt %d",
+					receipt.ExpiryDate,
+					receipt.Id)
+				continue
+			}
+			reminder := Reminder{
+				User:     user,
+				Receipt:  receipt,
+				DaysLeft: int(expiryDate.Sub(today).Hours() / 24),
+				LeadDays: leadDays,
+			}
+			if err := s.notifier.Notify(ctx, reminder); err != nil {
+				log.Printf("ERROR: sending reminder for receipt %d failed: %v",
+					receipt.Id,
+					err)
+				continue
+			}
+			err = s.db.MarkNotificationSent(ctx, receipt.Id, leadDays, now)
+			if err != nil {
+				return sent, due, err
+			}
+			sent++
+			log.Printf("Sent %d day expiry reminder for receipt %d to %s",
+				leadDays,
+				receipt.Id,
+				user.Name)
+		}
+	}
+	return sent, due, nil
+}
@@ -0,0 +1,153 @@
+package notification
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"receiptstracker-api/dbengine"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type fakeNotifier struct {
+	reminders []Reminder
+}
+
+func (n *fakeNotifier) Reaches(user dbengine.User) bool {
+	return true
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, reminder Reminder) error {
+	n.reminders = append(n.reminders, reminder)
+	return nil
+}
+
+type sentReminder struct {
+	user      string
+	receiptId int64
+	daysLeft  int
+	leadDays  int
+}
+
+func TestCheckExpiries(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	dbengine.CreateSchema(memDb)
+
+	_, err := memDb.Exec(`
+INSERT INTO user (id, name, created_at) VALUES
+	(1, 'alice', '2018-01-01T00:00:00Z'),
+	(2, 'bob', '2018-01-01T00:00:00Z');
+INSERT INTO receipt (owner_id, filename, purchase_date, expiry_date) VALUES
+	(1, 'a.jpg', '2018-01-01', '2020-01-25'),
+	(1, 'b.jpg', '2018-01-01', '2020-01-05'),
+	(1, 'c.jpg', '2018-01-01', '2019-12-31'),
+	(1, 'd.jpg', '2018-01-01', '2020-06-01'),
+	(1, 'e.jpg', '', ''),
+	(2, 'f.jpg', '2018-01-01', '2020-01-03');`)
+	if err != nil {
+		log.Fatalf("Unexpected error on SQL INSERT: %v", err)
+	}
+
+	notifier := &fakeNotifier{}
+	scheduler := NewScheduler(dbengine.NewStore(memDb), notifier, time.Hour, []int{30, 7})
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want []sentReminder
+	}{
+		{
+			"Most urgent reminder only",
+			time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+			[]sentReminder{
+				{"alice", 2, 4, 7},
+				{"alice", 1, 24, 30},
+				{"bob", 6, 2, 7},
+			},
+		},
+		{
+			"Nothing is sent twice",
+			time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC),
+			[]sentReminder{},
+		},
+		{
+			"Shorter lead time after the longer one",
+			time.Date(2020, 1, 18, 12, 0, 0, 0, time.UTC),
+			[]sentReminder{
+				{"alice", 1, 7, 7},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier.reminders = nil
+			sent, err := scheduler.CheckExpiries(ctx, tt.now)
+			if err != nil {
+				t.Errorf("%s: CheckExpiries() error = %v", tt.name, err)
+				return
+			}
+			got := make([]sentReminder, 0)
+			for _, r := range notifier.reminders {
+				got = append(got, sentReminder{r.User.Name, r.Receipt.Id, r.DaysLeft, r.LeadDays})
+			}
+			if sent != len(tt.want) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: CheckExpiries() = %d %v, want %v",
+					tt.name,
+					sent,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckExpiriesWithoutEmail(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(5)*time.Second)
+	defer cancel()
+
+	dbengine.CreateSchema(memDb)
+	db := dbengine.NewStore(memDb)
+
+	_, err := memDb.Exec(`
+INSERT INTO user (id, name, email, created_at) VALUES
+	(1, 'alice', 'alice@example.com', '2018-01-01T00:00:00Z'),
+	(2, 'bob', '', '2018-01-01T00:00:00Z');
+INSERT INTO receipt (owner_id, filename, purchase_date, expiry_date) VALUES
+	(1, 'a.jpg', '2018-01-01', '2020-01-05'),
+	(2, 'b.jpg', '2018-01-01', '2020-01-05'),
+	(2, 'c.jpg', '2018-01-01', '2020-01-06');`)
+	if err != nil {
+		log.Fatalf("Unexpected error on SQL INSERT: %v", err)
+	}
+
+	// Accepts a single mail, a reminder to bob would fail
+	addr, mails := fakeSMTPServer(t)
+	scheduler := NewScheduler(db, &SMTPNotifier{Addr: addr, From: "receipts@example.com"},
+		time.Hour, []int{7})
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	sent, err := scheduler.CheckExpiries(ctx, now)
+	if sent != 1 || err != nil {
+		t.Errorf("CheckExpiries() = %d, %v, want 1 reminder to alice", sent, err)
+	}
+	if mail := <-mails; !strings.Contains(mail, "To: alice@example.com") {
+		t.Errorf("Reminder sent as %q, want it to alice", mail)
+	}
+	// Still due once bob sets an address
+	due, err := db.GetExpiringReceipts(ctx, 2, now, 7)
+	if len(due) != 2 || err != nil {
+		t.Errorf("GetExpiringReceipts() of bob = %v, %v, want both unsent", due, err)
+	}
+}
@@ -0,0 +1,51 @@
+package ocr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// OCREngine recognises text from an image file
+type OCREngine interface {
+	Recognize(ctx context.Context, imagePath string) (string, error)
+}
+
+// TesseractEngine shells out to a locally installed tesseract binary
+type TesseractEngine struct {
+	Binary string
+	// Languages in tesseract's format, e.g. "eng+fin"
+	Languages string
+}
+
+func NewTesseractEngine(binary string, languages string) (*TesseractEngine, error) {
+	binaryPath, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("tesseract not found: %v", err)
+	}
+	return &TesseractEngine{
+		Binary:    binaryPath,
+		Languages: languages,
+	}, nil
+}
+
+func (e *TesseractEngine) Recognize(ctx context.Context, imagePath string) (string, error) {
+	args := []string{imagePath, "stdout"}
+	if e.Languages != "" {
+		args = append(args, "-l", e.Languages)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.Binary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("tesseract failed on %s: %v: %s",
+			imagePath,
+			err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
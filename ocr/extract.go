@@ -0,0 +1,320 @@
+package ocr
+
+import (
+	"receiptstracker-api/dbengine"
+	"receiptstracker-api/utils"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Field is a value found from the OCR text and how confident the
+// extractor is about it, from 0 to 1.
+type Field struct {
+	Value      string
+	Confidence float64
+}
+
+// Extraction holds what could be read from a receipt. Fields not found
+// are left empty. PurchaseDate is formatted as YYYY-MM-DD and Total as
+// a decimal with a dot, e.g. "1299.00".
+type Extraction struct {
+	PurchaseDate Field
+	Total        Field
+	Currency     Field
+	Vendor       Field
+}
+
+const (
+	maxVendorLength   int = 60
+	vendorHeaderLines int = 5
+	// Lowers the confidence when the receipt has several dates
+	ambiguousDatePenalty float64 = 0.2
+)
+
+var (
+	isoDatePat    = regexp.MustCompile(`(?:^|\D)(\d{4})-(\d{1,2})-(\d{1,2})(?:\D|$)`)
+	dottedDatePat = regexp.MustCompile(`(?:^|\D)(\d{1,2})\.(\d{1,2})\.(\d{4}|\d{2})(?:\D|$)`)
+	slashDatePat  = regexp.MustCompile(`(?:^|\D)(\d{1,2})/(\d{1,2})/(\d{4}|\d{2})(?:\D|$)`)
+	dateWordPat   = regexp.MustCompile(`(?i)(date|pvm|päiväys|päivämäärä|datum)`)
+
+	totalWordPat = regexp.MustCompile(`(?i)(?:^|[^\pL])(total|summa|yhteensä|yhteensa)(?:[^\pL]|$)`)
+	amountPat    = regexp.MustCompile(`(?:^|[^\d.,])(\d{1,3}(?:[ .,]\d{3})+|\d+)[.,](\d{2})(?:[^\d.,]|$)`)
+
+	currencyCodePat   = regexp.MustCompile(`(?:^|[^A-Z])([A-Z]{3})(?:[^A-Z]|$)`)
+	currencySymbols   = map[string]string{"€": "EUR", "$": "USD", "£": "GBP"}
+	receiptCurrencies = []string{"EUR", "USD", "GBP", "SEK", "NOK", "DKK", "CHF"}
+
+	companySuffixPat  = regexp.MustCompile(`(?i)(?:^|[^\pL])(oy|oyj|ab|ky|ltd|inc|llc|gmbh)(?:[^\pL]|$)`)
+	nonVendorWordsPat = regexp.MustCompile(`(?i)(receipt|kuitti|kvitto|invoice|tel\.?|puh\.?|www\.|http)`)
+)
+
+// Extract reads the purchase date, total, currency and vendor from the
+// OCR text of a receipt.
+func Extract(text string) Extraction {
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	total, totalLine := extractTotal(lines)
+	return Extraction{
+		PurchaseDate: extractDate(lines),
+		Total:        total,
+		Currency:     extractCurrency(lines, totalLine),
+		Vendor:       extractVendor(lines),
+	}
+}
+
+// Fields turns the extraction into receipt fields leaving out the ones
+// less confident than minConfidence. The total is converted into minor
+// units of currency, the receipt's own currency if the user gave one.
+func (e Extraction) Fields(currency string, minConfidence float64) []dbengine.ExtractedField {
+	fields := []dbengine.ExtractedField{}
+	add := func(name string, f Field) {
+		if f.Value != "" && f.Confidence >= minConfidence {
+			fields = append(fields, dbengine.ExtractedField{
+				Field:      name,
+				Value:      f.Value,
+				Confidence: f.Confidence,
+			})
+		}
+	}
+
+	add("purchase_date", e.PurchaseDate)
+	add("vendor", e.Vendor)
+	if currency == "" {
+		add("currency", e.Currency)
+		if e.Currency.Confidence >= minConfidence {
+			currency = e.Currency.Value
+		}
+	}
+	if e.Total.Value != "" {
+		amount, err := utils.ParseAmount(e.Total.Value, currency)
+		if err == nil {
+			add("amount", Field{
+				strconv.FormatInt(amount, 10),
+				e.Total.Confidence,
+			})
+		}
+	}
+	return fields
+}
+
+type dateCandidate struct {
+	date       string
+	confidence float64
+}
+
+// extractDate understands YYYY-MM-DD, DD.MM.YYYY and the US style
+// MM/DD/YY. A date on a line labelled as one is trusted the most.
+func extractDate(lines []string) Field {
+	candidates := []dateCandidate{}
+	distinct := map[string]bool{}
+	for _, line := range lines {
+		bonus := 0.0
+		if dateWordPat.MatchString(line) {
+			bonus = 0.3
+		}
+		for _, m := range isoDatePat.FindAllStringSubmatch(line, -1) {
+			if date, ok := validDate(m[1], m[2], m[3]); ok {
+				candidates = append(candidates, dateCandidate{date, 0.6 + bonus})
+				distinct[date] = true
+			}
+		}
+		for _, m := range dottedDatePat.FindAllStringSubmatch(line, -1) {
+			if date, ok := validDate(m[3], m[2], m[1]); ok {
+				candidates = append(candidates, dateCandidate{date, 0.6 + bonus})
+				distinct[date] = true
+			}
+		}
+		for _, m := range slashDatePat.FindAllStringSubmatch(line, -1) {
+			// Could also be DD/MM/YY, hence the lower confidence
+			if date, ok := validDate(m[3], m[1], m[2]); ok {
+				candidates = append(candidates, dateCandidate{date, 0.5 + bonus})
+				distinct[date] = true
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return Field{}
+	}
+
+	// Stable sort keeps the first one of equally confident dates
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].confidence > candidates[j].confidence
+	})
+	best := candidates[0]
+	if len(distinct) > 1 {
+		best.confidence -= ambiguousDatePenalty
+	}
+	return Field{best.date, roundConfidence(best.confidence)}
+}
+
+func validDate(year, month, day string) (string, bool) {
+	if len(year) == 2 {
+		year = "20" + year
+	}
+	date := year + "-" + leftPad(month) + "-" + leftPad(day)
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return "", false
+	}
+	return date, true
+}
+
+func leftPad(s string) string {
+	if len(s) == 1 {
+		return "0" + s
+	}
+	return s
+}
+
+// extractTotal looks for the amount on a line starting with a total
+// keyword or the line after it, e.g. "YHTEENSÄ 12,50". The index of
+// the line is returned so that the currency can be looked up next to
+// it.
+func extractTotal(lines []string) (Field, int) {
+	var found []Field
+	totalLine := -1
+	for i, line := range lines {
+		if !totalWordPat.MatchString(line) {
+			continue
+		}
+		if amount := lastAmount(line); amount != "" {
+			found = append(found, Field{amount, 0.9})
+		} else if i+1 < len(lines) {
+			if amount := lastAmount(lines[i+1]); amount != "" {
+				found = append(found, Field{amount, 0.7})
+			}
+		}
+		if totalLine < 0 && len(found) > 0 {
+			totalLine = i
+		}
+	}
+	if len(found) == 0 {
+		return Field{}, -1
+	}
+
+	// Tax totals are smaller than the total of the whole receipt
+	best := found[0]
+	for _, f := range found[1:] {
+		if f.Value != best.Value {
+			best.Confidence = 0.6
+		}
+		if decimalLess(best.Value, f.Value) {
+			best.Value = f.Value
+		}
+	}
+	return best, totalLine
+}
+
+// lastAmount returns the last decimal number on the line normalised
+// into a form utils.ParseAmount accepts.
+func lastAmount(line string) string {
+	matches := amountPat.FindAllStringSubmatch(line, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	m := matches[len(matches)-1]
+	whole := strings.NewReplacer(" ", "", ".", "", ",", "").Replace(m[1])
+	whole = strings.TrimLeft(whole, "0")
+	if whole == "" {
+		whole = "0"
+	}
+	return whole + "." + m[2]
+}
+
+func decimalLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func extractCurrency(lines []string, totalLine int) Field {
+	if totalLine >= 0 {
+		if currency := findCurrency(lines[totalLine], nil); currency != "" {
+			return Field{currency, 0.9}
+		}
+	}
+	for _, line := range lines {
+		if currency := findCurrency(line, receiptCurrencies); currency != "" {
+			return Field{currency, 0.6}
+		}
+	}
+	return Field{}
+}
+
+// findCurrency returns a currency symbol or code on the line. Codes
+// are limited to the given ones unless codes is nil, since words like
+// "ALL" are currency codes too.
+func findCurrency(line string, codes []string) string {
+	for symbol, currency := range currencySymbols {
+		if strings.Contains(line, symbol) {
+			return currency
+		}
+	}
+	for _, m := range currencyCodePat.FindAllStringSubmatch(line, -1) {
+		if codes == nil && utils.IsCurrencyCode(m[1]) {
+			return m[1]
+		}
+		for _, code := range codes {
+			if m[1] == code {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// extractVendor takes the first header line looking like a name. Shops
+// print their name on top, so the first line is trusted the most.
+func extractVendor(lines []string) Field {
+	for i, line := range lines {
+		if i >= vendorHeaderLines {
+			break
+		}
+		line = strings.Join(strings.Fields(line), " ")
+		if !looksLikeName(line) {
+			continue
+		}
+		confidence := 0.5
+		if i == 0 {
+			confidence = 0.7
+		}
+		if companySuffixPat.MatchString(line) {
+			confidence += 0.2
+		}
+		return Field{line, roundConfidence(confidence)}
+	}
+	return Field{}
+}
+
+func looksLikeName(line string) bool {
+	if len(line) > maxVendorLength ||
+		amountPat.MatchString(line) ||
+		nonVendorWordsPat.MatchString(line) ||
+		extractDate([]string{line}).Value != "" {
+		return false
+	}
+	letters, others := 0, 0
+	for _, r := range line {
+		switch {
+		case unicode.IsLetter(r):
+			letters++
+		case !unicode.IsSpace(r):
+			others++
+		}
+	}
+	return letters >= 3 && letters >= others
+}
+
+// roundConfidence hides float artefacts like 0.8999999999999999
+func roundConfidence(c float64) float64 {
+	return float64(int(c*10+0.5)) / 10
+}
@@ -0,0 +1,138 @@
+package ocr
+
+import (
+	"receiptstracker-api/dbengine"
+	"reflect"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want Extraction
+	}{
+		{
+			"Finnish grocery receipt",
+			`K-Market Kamppi
+Urho Kekkosen katu 1
+Y-tunnus 1234567-8
+
+MAITO 1L                 1,25
+KAHVI 500G               5,49
+YHTEENSÄ                 6,74
+ALV 14% YHTEENSÄ         0,83
+KORTTI EUR               6,74
+Pvm 24.12.2019 klo 14.31`,
+			Extraction{
+				PurchaseDate: Field{"2019-12-24", 0.9},
+				Total:        Field{"6.74", 0.6},
+				Currency:     Field{"EUR", 0.6},
+				Vendor:       Field{"K-Market Kamppi", 0.7},
+			},
+		},
+		{
+			"US receipt with total on the next line",
+			`Receipt #1234
+Computer Shop Inc
+03/15/20 10:22
+Laptop          $1,299.00
+TOTAL
+$1,299.00`,
+			Extraction{
+				PurchaseDate: Field{"2020-03-15", 0.5},
+				Total:        Field{"1299.00", 0.7},
+				Currency:     Field{"USD", 0.6},
+				Vendor:       Field{"Computer Shop Inc", 0.7},
+			},
+		},
+		{
+			"Currency on the total line",
+			`Kahvila Oy
+Summa 4,50 EUR
+2020-01-05`,
+			Extraction{
+				PurchaseDate: Field{"2020-01-05", 0.6},
+				Total:        Field{"4.50", 0.9},
+				Currency:     Field{"EUR", 0.9},
+				Vendor:       Field{"Kahvila Oy", 0.9},
+			},
+		},
+		{
+			"Invalid date and subtotal only",
+			`12345
+31.02.2020
+Subtotal 10.00`,
+			Extraction{},
+		},
+		{
+			"Nothing recognised",
+			"",
+			Extraction{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Extract(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: Extract() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractionFields(t *testing.T) {
+	extraction := Extraction{
+		PurchaseDate: Field{"2020-01-05", 0.6},
+		Total:        Field{"1299.00", 0.9},
+		Currency:     Field{"EUR", 0.9},
+		Vendor:       Field{"Computer Shop", 0.4},
+	}
+
+	type args struct {
+		currency      string
+		minConfidence float64
+	}
+	tests := []struct {
+		name string
+		args args
+		want []dbengine.ExtractedField
+	}{
+		{
+			"Unknown currency",
+			args{"", 0.5},
+			[]dbengine.ExtractedField{
+				{Field: "purchase_date", Value: "2020-01-05", Confidence: 0.6},
+				{Field: "currency", Value: "EUR", Confidence: 0.9},
+				{Field: "amount", Value: "129900", Confidence: 0.9},
+			},
+		},
+		{
+			"Currency given by the user",
+			args{"JPY", 0.5},
+			[]dbengine.ExtractedField{
+				{Field: "purchase_date", Value: "2020-01-05", Confidence: 0.6},
+			},
+		},
+		{
+			"Only the confident ones",
+			args{"EUR", 0.8},
+			[]dbengine.ExtractedField{
+				{Field: "amount", Value: "129900", Confidence: 0.9},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := extraction.Fields(tt.args.currency, tt.args.minConfidence)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: Fields() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
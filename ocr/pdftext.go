@@ -0,0 +1,73 @@
+package ocr
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"receiptstracker-api/utils"
+	"strings"
+
+	"rsc.io/pdf"
+)
+
+// PdfTextEngine reads the text layer of PDF receipts. E-receipts are
+// generated with their text intact, so there is nothing to recognise.
+type PdfTextEngine struct{}
+
+func (e PdfTextEngine) Recognize(ctx context.Context, pdfPath string) (text string, err error) {
+	f, err := os.Open(pdfPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	reader, err := utils.OpenPdf(f, stat.Size())
+	if err != nil {
+		return "", err
+	}
+
+	// Content parsing panics on malformed streams
+	defer func() {
+		if r := recover(); r != nil {
+			text = ""
+			err = fmt.Errorf("reading text of %s failed: %v", pdfPath, r)
+		}
+	}()
+	pages := []string{}
+	for i := 1; i <= reader.NumPage(); i++ {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		pages = append(pages, pageText(page.Content().Text))
+	}
+	return strings.TrimSpace(strings.Join(pages, "\n")), nil
+}
+
+// pageText joins the glyphs in the order they are drawn, starting a new
+// line whenever the baseline moves and adding a space for wide gaps.
+func pageText(glyphs []pdf.Text) string {
+	var b strings.Builder
+	var prev *pdf.Text
+	for i := range glyphs {
+		g := &glyphs[i]
+		if prev != nil {
+			switch {
+			case math.Abs(g.Y-prev.Y) > prev.FontSize/2:
+				b.WriteString("\n")
+			case prev.W > 0 && g.X-(prev.X+prev.W) > prev.FontSize/4:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString(g.S)
+		prev = g
+	}
+	return b.String()
+}
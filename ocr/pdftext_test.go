@@ -0,0 +1,106 @@
+package ocr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// textPdf builds a single page PDF drawing the lines of text
+func textPdf(lines []string) []byte {
+	content := "BT /F1 12 Tf 72 700 Td 14 TL"
+	for _, line := range lines {
+		content += fmt.Sprintf(" (%s) Tj T*", line)
+	}
+	content += " ET"
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] " +
+			"/Resources << /Font << /F1 5 0 R >> >> /Contents 4 0 R >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream",
+			len(content),
+			content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier " +
+			"/FirstChar 32 /LastChar 126 /Widths [" +
+			strings.Repeat("600 ", 95) + "] >>",
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, obj := range objects {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(objects)+1,
+		xref)
+	return buf.Bytes()
+}
+
+func TestPdfTextEngine(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "pdftext")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			"E-receipt",
+			textPdf([]string{"Coffee Shop Oy", "TOTAL 4,50 EUR"}),
+			"Coffee Shop Oy\nTOTAL 4,50 EUR",
+			false,
+		},
+		{
+			"No text layer",
+			textPdf([]string{}),
+			"",
+			false,
+		},
+		{
+			"Not a PDF",
+			[]byte("%PDF-1.4\nbroken"),
+			"",
+			true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pdfPath := filepath.Join(storeDir, fmt.Sprintf("%d.pdf", i))
+			if err := ioutil.WriteFile(pdfPath, tt.content, 0600); err != nil {
+				t.Fatalf("Writing %s failed: %v", pdfPath, err)
+			}
+			got, err := PdfTextEngine{}.Recognize(context.Background(), pdfPath)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: Recognize() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("%s: Recognize() = %q, want %q",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
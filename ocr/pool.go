@@ -0,0 +1,189 @@
+package ocr
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"receiptstracker-api/blobstore"
+	"receiptstracker-api/dbengine"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pool runs OCR jobs persisted in the database with a fixed number of
+// workers. Jobs are added to the database together with the receipt,
+// Enqueue only wakes the pool up so that a full queue never loses work.
+// Text of PDFs is read without the engine, so without one the pool runs
+// the jobs of PDFs only and leaves the ones of images pending.
+type Pool struct {
+	engine       OCREngine
+	db           *dbengine.Store
+	store        blobstore.BlobStore
+	workers      int
+	pollInterval time.Duration
+	retryDelay   time.Duration
+	maxAttempts  int
+	// Extracted details less confident than this are not filled in
+	minConfidence float64
+	wakeCh        chan struct{}
+}
+
+func NewPool(
+	engine OCREngine,
+	db *dbengine.Store,
+	store blobstore.BlobStore,
+	workers int,
+	pollInterval time.Duration,
+	retryDelay time.Duration,
+	maxAttempts int,
+	minConfidence float64) *Pool {
+	return &Pool{
+		engine:        engine,
+		db:            db,
+		store:         store,
+		workers:       workers,
+		pollInterval:  pollInterval,
+		retryDelay:    retryDelay,
+		maxAttempts:   maxAttempts,
+		minConfidence: minConfidence,
+		wakeCh:        make(chan struct{}, 1),
+	}
+}
+
+// Enqueue tells the pool that a new job is waiting in the database
+func (p *Pool) Enqueue(receiptId int64) {
+	select {
+	case p.wakeCh <- struct{}{}:
+	default:
+		// Already woken up, the job is picked up on the same round
+	}
+}
+
+// Run dispatches jobs to the workers until the context is cancelled
+// and returns once all workers have stopped. Jobs interrupted by a
+// previous shutdown are resumed first.
+func (p *Pool) Run(ctx context.Context) {
+	if n, err := p.db.ResetInterruptedOcrJobs(ctx); err != nil {
+		log.Printf("ERROR: resuming OCR jobs failed: %v", err)
+	} else if n > 0 {
+		log.Printf("Resuming %d interrupted OCR jobs", n)
+	}
+
+	var wg sync.WaitGroup
+	jobs := make(chan dbengine.OcrJob)
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				p.process(ctx, job)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(jobs)
+
+	ticker := time.NewTicker(p.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		claimed, err := p.db.ClaimOcrJobs(ctx, time.Now(), p.workers, p.engine == nil)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("ERROR: claiming OCR jobs failed: %v", err)
+		}
+		for _, job := range claimed {
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				// Left as processing and resumed on the next start
+				return
+			}
+		}
+		if len(claimed) > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wakeCh:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) process(ctx context.Context, job dbengine.OcrJob) {
+	engine := p.engine
+	if strings.ToLower(filepath.Ext(job.Filename)) == ".pdf" {
+		engine = PdfTextEngine{}
+	}
+	text, err := p.recognize(ctx, engine, job.Filename)
+	if ctx.Err() != nil {
+		// Shutting down, not the receipt's fault
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: OCR of receipt %d failed on attempt %d: %v",
+			job.ReceiptId,
+			job.Attempts+1,
+			err)
+		retryAt := time.Now().Add(p.retryDelay * time.Duration(job.Attempts+1))
+		p.db.FailOcrJob(ctx, job.ReceiptId, err, retryAt, p.maxAttempts)
+		return
+	}
+
+	currency := ""
+	if receipt, err := p.db.GetReceipt(ctx, job.OwnerId, job.ReceiptId); err == nil {
+		currency = receipt.Currency
+	}
+	fields := Extract(text).Fields(currency, p.minConfidence)
+	if err := p.db.CompleteOcrJob(ctx, job.ReceiptId, text, fields); err != nil {
+		return
+	}
+	log.Printf("OCR of receipt %d done, recognised %d characters and %d details",
+		job.ReceiptId,
+		len(text),
+		len(fields))
+}
+
+// recognize copies the receipt into a temporary directory first since
+// the engines read files and the store may not be on this disk.
+func (p *Pool) recognize(
+	ctx context.Context,
+	engine OCREngine,
+	filename string) (string, error) {
+	blob, err := p.store.Get(ctx, filename)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+	tmpDir, err := ioutil.TempDir("", "ocr")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Same name keeps the extension the engine may look at
+	tmpPath := filepath.Join(tmpDir, filepath.Base(filename))
+	if err := copyToFile(tmpPath, blob); err != nil {
+		return "", err
+	}
+	return engine.Recognize(ctx, tmpPath)
+}
+
+// copyToFile writes the content into a new file
+func copyToFile(path string, content io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,217 @@
+package ocr
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"receiptstracker-api/blobstore"
+	"receiptstracker-api/dbengine"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type fakeEngine struct {
+	mu    sync.Mutex
+	texts map[string]string
+	calls map[string]int
+}
+
+func (e *fakeEngine) Recognize(ctx context.Context, imagePath string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	filename := filepath.Base(imagePath)
+	e.calls[filename]++
+	text, found := e.texts[filename]
+	if !found {
+		return "", errors.New("Unreadable image")
+	}
+	return text, nil
+}
+
+func (e *fakeEngine) callCount(filename string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls[filename]
+}
+
+func waitForStatus(t *testing.T, db *dbengine.Store, receiptId int64, want string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status, err := db.GetOcrJobStatus(context.Background(), receiptId)
+		if err == nil && status == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("OCR job %d never reached status %s", receiptId, want)
+}
+
+func TestPool(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	// Every connection to :memory: would get a database of its own
+	memDb.SetMaxOpenConns(1)
+
+	dbengine.CreateSchema(memDb)
+	db := dbengine.NewStore(memDb)
+
+	_, err := memDb.Exec(`
+INSERT INTO receipt (owner_id, filename, purchase_date, expiry_date) VALUES
+	(1, 'new.jpg', '', ''),
+	(1, 'interrupted.jpg', '', ''),
+	(1, 'broken.jpg', '', '');
+INSERT INTO ocr_job (receipt_id, status, attempts, run_after, updated_at) VALUES
+	(1, 'pending', 0, '2020-01-01 00:00:00', '2020-01-01 00:00:00'),
+	(2, 'processing', 0, '2020-01-01 00:00:00', '2020-01-01 00:00:00'),
+	(3, 'pending', 0, '2020-01-01 00:00:00', '2020-01-01 00:00:00');`)
+	if err != nil {
+		log.Fatalf("Unexpected error on SQL INSERT: %v", err)
+	}
+
+	engine := &fakeEngine{
+		texts: map[string]string{
+			"new.jpg":         "CAFE 4.50 EUR",
+			"interrupted.jpg": "HARDWARE STORE 12.00 EUR",
+		},
+		calls: map[string]int{},
+	}
+	storeDir, err := ioutil.TempDir("", "receipts")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(storeDir)
+	store := blobstore.NewLocalStore(storeDir)
+	for _, filename := range []string{"new.jpg", "interrupted.jpg", "broken.jpg"} {
+		store.Put(context.Background(), filename, []byte{0, 1, 0, 1})
+	}
+	pool := NewPool(engine, db, store, 2, 10*time.Millisecond, 0, 2, 0.5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(stopped)
+	}()
+	pool.Enqueue(1)
+
+	waitForStatus(t, db, 1, dbengine.OCR_DONE)
+	waitForStatus(t, db, 2, dbengine.OCR_DONE)
+	waitForStatus(t, db, 3, dbengine.OCR_FAILED)
+	cancel()
+	<-stopped
+
+	tests := []struct {
+		name      string
+		receiptId int64
+		filename  string
+		wantText  sql.NullString
+		wantCalls int
+	}{
+		{
+			"New job",
+			1,
+			"new.jpg",
+			sql.NullString{String: "CAFE 4.50 EUR", Valid: true},
+			1,
+		},
+		{
+			"Interrupted job resumed",
+			2,
+			"interrupted.jpg",
+			sql.NullString{String: "HARDWARE STORE 12.00 EUR", Valid: true},
+			1,
+		},
+		{
+			"Failing job retried until max attempts",
+			3,
+			"broken.jpg",
+			sql.NullString{},
+			2,
+		},
+	}
+	for _, tt := range tests {
+		var got sql.NullString
+		err := memDb.QueryRow("SELECT ocr_text FROM receipt WHERE id = ?;",
+			tt.receiptId).Scan(&got)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if got != tt.wantText {
+			t.Errorf("%s: ocr_text = %v, want %v", tt.name, got, tt.wantText)
+		}
+		if calls := engine.callCount(tt.filename); calls != tt.wantCalls {
+			t.Errorf("%s: Recognize() called %d times, want %d",
+				tt.name,
+				calls,
+				tt.wantCalls)
+		}
+	}
+
+}
+
+func TestPoolWithoutEngine(t *testing.T) {
+	memDb, _ := sql.Open("sqlite3", ":memory:")
+	defer memDb.Close()
+	memDb.SetMaxOpenConns(1)
+
+	dbengine.CreateSchema(memDb)
+	db := dbengine.NewStore(memDb)
+
+	_, err := memDb.Exec(`
+INSERT INTO receipt (owner_id, filename, purchase_date, expiry_date) VALUES
+	(1, 'photo.jpg', '', ''),
+	(1, 'invoice.PDF', '', '');
+INSERT INTO ocr_job (receipt_id, status, attempts, run_after, updated_at) VALUES
+	(1, 'pending', 0, '2020-01-01 00:00:00', '2020-01-01 00:00:00'),
+	(2, 'pending', 0, '2020-01-01 00:00:00', '2020-01-01 00:00:00');`)
+	if err != nil {
+		log.Fatalf("Unexpected error on SQL INSERT: %v", err)
+	}
+
+	storeDir, err := ioutil.TempDir("", "receipts")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(storeDir)
+	store := blobstore.NewLocalStore(storeDir)
+	store.Put(context.Background(), "photo.jpg", []byte{0, 1, 0, 1})
+	store.Put(context.Background(), "invoice.PDF", textPdf([]string{"TOTAL 9,90 EUR"}))
+	pool := NewPool(nil, db, store, 2, 10*time.Millisecond, 0, 2, 0.5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(stopped)
+	}()
+	pool.Enqueue(1)
+	pool.Enqueue(2)
+
+	waitForStatus(t, db, 2, dbengine.OCR_DONE)
+	// A few more rounds of claiming must leave the image alone. Checked
+	// before stopping, a cancelled query may drop the in-memory database.
+	time.Sleep(50 * time.Millisecond)
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	status, err := db.GetOcrJobStatus(context.Background(), 1)
+	if err != nil || status != dbengine.OCR_PENDING {
+		t.Errorf("Image job status = %q, %v, want %q", status, err, dbengine.OCR_PENDING)
+	}
+	var got sql.NullString
+	if err := memDb.QueryRow("SELECT ocr_text FROM receipt WHERE id = 2;").Scan(&got); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got.String != "TOTAL 9,90 EUR" {
+		t.Errorf("PDF ocr_text = %v, want %q", got, "TOTAL 9,90 EUR")
+	}
+}
@@ -1,32 +1,32 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"net"
+	"net/smtp"
 	"os"
 	"os/signal"
-	"path"
+	"receiptstracker-api/blobstore"
+	"receiptstracker-api/config"
 	"receiptstracker-api/dbengine"
 	"receiptstracker-api/external"
 	"receiptstracker-api/httpserver"
-	"receiptstracker-api/utils"
-	"regexp"
+	"receiptstracker-api/notification"
+	"receiptstracker-api/ocr"
+	"strings"
+	"sync"
 	"syscall"
 )
 
 var (
-	fileStoreAbsPath     string
-	loggingFilePath      string
-	reStripTrailingSlash *regexp.Regexp
-	logFile              *os.File
+	loggingFilePath string
+	logFile         *os.File
 )
 
-func init() {
-	reStripTrailingSlash = regexp.MustCompile(`/$`)
-}
-
 func fileLogging() (f *os.File) {
 	log.SetFlags(log.Ldate | log.Ltime)
 	f, err := os.OpenFile(
@@ -40,79 +40,229 @@ func fileLogging() (f *os.File) {
 	return
 }
 
-func signalHandler(signalCh chan os.Signal, doneCh chan struct{}) {
-	for {
-		select {
-		case s := <-signalCh:
-			fmt.Println("Shutting down...")
-			log.Printf("Received signal: %d (%s)", s, s)
-
-			if err := logFile.Sync(); err != nil { // FIXME
-				log.Printf("ERROR: syncing logfile failed: %v", err)
-			}
+// shutdown stops the background workers once the HTTP server has
+// drained and only then closes the database and the log file, which the
+// workers may still be using.
+func shutdown(
+	stopWorkers context.CancelFunc,
+	workers *sync.WaitGroup,
+	db *dbengine.Store) {
+	stopWorkers()
+	workers.Wait()
 
-			dbengine.ShutdownDb()
+	db.Close()
+	log.Printf("Shutdown complete")
 
-			if err := logFile.Close(); err != nil { // FIXME
-				log.Printf("ERROR: Failed to close logfile: %v", err)
-			}
-			os.Exit(0)
-			doneCh <- struct{}{}
-		}
+	if err := logFile.Sync(); err != nil {
+		log.Printf("ERROR: syncing logfile failed: %v", err)
+	}
+	if err := logFile.Close(); err != nil {
+		log.Printf("ERROR: Failed to close logfile: %v", err)
 	}
 }
 
-func connectAndInitDb(dbPath string) *sql.DB {
+// dryRunMigrations prints the migrations which would be applied
+// to the database without changing it.
+func dryRunMigrations(dbPath string) {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if exists, _ := utils.PathExists(dbPath); exists == false {
-		dbengine.CreateSchema(db)
+	defer db.Close()
+
+	version, err := dbengine.SchemaVersion(context.Background(), db)
+	if err != nil {
+		log.Fatalf("ERROR: reading schema version failed: %v", err)
+	}
+	fmt.Printf("Current schema version: %d\n", version)
+
+	pending, err := dbengine.Migrate(context.Background(), db, true)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if len(pending) == 0 {
+		fmt.Println("No pending migrations")
+	}
+	for _, m := range pending {
+		fmt.Printf("Would apply migration %04d_%s\n", m.Version, m.Name)
+	}
+}
+
+// newNotifier sends reminders by e-mail to their owners when an SMTP
+// server is configured and otherwise appends them into the notifications log file.
+func newNotifier(cfg config.NotifyConfig) notification.Notifier {
+	if cfg.SmtpAddr == "" {
+		f, err := os.OpenFile(
+			cfg.LogFile,
+			os.O_RDWR|os.O_CREATE|os.O_APPEND,
+			0600)
+		if err != nil {
+			log.Fatalf("Error opening file %v", err)
+		}
+		return notification.NewLogNotifier(f)
 	}
 
-	return db
+	var auth smtp.Auth
+	if cfg.SmtpUser != "" {
+		host := strings.Split(cfg.SmtpAddr, ":")[0]
+		auth = smtp.PlainAuth("", cfg.SmtpUser, cfg.SmtpPassword, host)
+	}
+	return &notification.SMTPNotifier{
+		Addr: cfg.SmtpAddr,
+		Auth: auth,
+		From: cfg.SmtpFrom,
+	}
+}
+
+// newBlobStore keeps the receipts in uploadDir unless the S3 backend is
+// configured.
+func newBlobStore(cfg config.StorageConfig, uploadDir string) blobstore.BlobStore {
+	if cfg.Backend != "s3" {
+		if err := os.MkdirAll(uploadDir, 0700); err != nil {
+			log.Fatalf("Cannot create upload directory: %v", err)
+		}
+		log.Printf("Using %s directory to store receipts", uploadDir)
+		return blobstore.NewLocalStore(uploadDir)
+	}
+	store, err := blobstore.NewS3Store(
+		cfg.S3.Endpoint,
+		cfg.S3.Region,
+		cfg.S3.Bucket,
+		cfg.S3.AccessKey,
+		cfg.S3.SecretKey)
+	if err != nil {
+		log.Fatalf("Cannot use S3 storage: %v", err)
+	}
+	log.Printf("Using bucket %s at %s to store receipts",
+		store.Bucket,
+		store.Endpoint)
+	return store
+}
+
+// startOcr runs the OCR worker pool until ctx is cancelled and returns
+// it as the queue of new receipts. Without tesseract only the text of
+// PDFs is read.
+func startOcr(
+	ctx context.Context,
+	cfg config.OcrConfig,
+	db *dbengine.Store,
+	store blobstore.BlobStore,
+	workers *sync.WaitGroup) httpserver.OcrQueue {
+	var engine ocr.OCREngine
+	tesseract, err := ocr.NewTesseractEngine(cfg.Tesseract, cfg.Languages)
+	if err != nil {
+		log.Printf("WARNING: OCR of images disabled, reading text of PDFs only: %v", err)
+	} else {
+		engine = tesseract
+		log.Printf("OCR enabled using %s", tesseract.Binary)
+	}
+
+	pool := ocr.NewPool(
+		engine,
+		db,
+		store,
+		cfg.Workers,
+		external.OCR_POLL_INTERVAL,
+		external.OCR_RETRY_DELAY,
+		external.OCR_MAX_ATTEMPTS,
+		cfg.MinConfidence)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		pool.Run(ctx)
+	}()
+	return pool
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("ERROR: absolute file storage path missing")
-		os.Exit(1)
+	if len(os.Args) > 1 && (os.Args[1] == "token" || os.Args[1] == "user") {
+		command := tokenCommand
+		if os.Args[1] == "user" {
+			command = userCommand
+		}
+		if err := command(os.Args[2:]); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
-	doneCh := make(chan struct{})
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
 
-	go signalHandler(signalCh, doneCh)
+	migrateDryRun := flag.Bool("migrate-dry-run", false,
+		"print pending database migrations and exit")
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], os.Getenv)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		os.Exit(1)
+	}
 
-	dirExists, _ := utils.PathExists(os.Args[1])
-	if !dirExists {
-		log.Fatalf("Cannot open directory %s", os.Args[1])
+	if err := os.Chdir(cfg.DataDir); err != nil {
+		log.Fatalf("ERROR: chdir() failed: %v", err)
 	}
-	workingDirectory := reStripTrailingSlash.ReplaceAllString(
-		path.Clean(os.Args[1]), "") + "/"
-	if err := os.Chdir(workingDirectory); err != nil {
-		log.Printf("ERROR: chdir() failed: %v", err)
+	if *migrateDryRun {
+		dryRunMigrations(cfg.Database.Path)
+		return
 	}
-	loggingFilePath = workingDirectory + "receipts-api.log"
-	storeReceiptsDirAbsPath := workingDirectory + external.UPLOAD_DIRECTORY
+	loggingFilePath = cfg.LogFile
 
 	logFile = fileLogging()
 
-	db := connectAndInitDb("receipts.db")
-	dbengine.UpdateDbRef(db)
-	db = nil // Remove reference from the main
+	db, err := dbengine.Open(cfg.Database)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
 	log.Printf("Database ready")
+	warnWithoutTokens(db)
+	if cfg.Notify.SmtpAddr != "" {
+		warnWithoutEmail(db)
+	}
 
-	log.Printf("Using %s directory to store receipts\n",
-		storeReceiptsDirAbsPath)
+	store := newBlobStore(cfg.Storage, cfg.UploadDir)
+	if err := os.MkdirAll(cfg.ThumbnailDir, 0700); err != nil {
+		log.Fatalf("Cannot create thumbnail directory: %v", err)
+	}
+
+	// The workers are stopped only after the requests in flight, which
+	// may still hand them work
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+
+	scheduler := notification.NewScheduler(
+		db,
+		newNotifier(cfg.Notify),
+		external.NOTIFICATION_INTERVAL,
+		cfg.Notify.LeadDays)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		scheduler.Run(workersCtx)
+	}()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", httpserver.ApiHandler)
-	log.Printf("Listening on port %q\n", external.PORT)
-	if err := http.ListenAndServe(external.PORT, mux); err != nil {
-		log.Fatalf("Cannot listen on port %q: %q", external.PORT, err)
+	server := httpserver.NewServer(
+		cfg,
+		db,
+		db,
+		store,
+		startOcr(workersCtx, cfg.Ocr, db, store, &workers))
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		log.Fatalf("Cannot listen on %q: %q", cfg.Listen, err)
 	}
+	log.Printf("Listening on %q\n", cfg.Listen)
 
-	<-doneCh
+	signalCtx, stop := signal.NotifyContext(context.Background(),
+		syscall.SIGINT,
+		syscall.SIGTERM)
+	ctx, stopServing := context.WithCancel(context.Background())
+	go func() {
+		<-signalCtx.Done()
+		// A second signal stops the server without waiting
+		stop()
+		fmt.Println("Shutting down...")
+		log.Printf("Received signal, shutting down")
+		stopServing()
+	}()
+	if err := server.Serve(ctx, listener); err != nil && ctx.Err() == nil {
+		log.Fatalf("Serving on %q failed: %v", cfg.Listen, err)
+	}
+	shutdown(stopWorkers, &workers, db)
 }
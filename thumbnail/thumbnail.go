@@ -0,0 +1,131 @@
+package thumbnail
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"receiptstracker-api/utils"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+)
+
+const jpegQuality int = 80
+
+// Path tells where the thumbnail of the given size is cached. Files are
+// keyed by the content hash so that they never go stale.
+func Path(dir string, fileHash string, size int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s_%d.jpg", fileHash, size))
+}
+
+// Generate decodes the image once and writes thumbnails of all the
+// sizes into dir. Size is the maximum of width and height in pixels.
+// Images larger than maxPixels are not decoded at all.
+func Generate(
+	content io.ReadSeeker,
+	dir string,
+	fileHash string,
+	sizes []int,
+	maxPixels int64) error {
+	src, err := utils.DecodeImage(content, maxPixels)
+	if err != nil {
+		return fmt.Errorf("decoding %s failed: %v", fileHash, err)
+	}
+
+	for _, size := range sizes {
+		if err := write(Path(dir, fileHash, size), Resize(src, size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the path of the cached thumbnail and generates it first
+// if it is missing, e.g. after the sizes were changed. The original
+// image is opened only then and errors of open are returned as is.
+func Get(
+	open func() (io.ReadSeekCloser, error),
+	dir string,
+	fileHash string,
+	size int,
+	maxPixels int64) (string, error) {
+	thumbPath := Path(dir, fileHash, size)
+	if _, err := os.Stat(thumbPath); err == nil {
+		return thumbPath, nil
+	}
+	log.Printf("Generating missing %dpx thumbnail of %s", size, fileHash)
+	content, err := open()
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+	if err := Generate(content, dir, fileHash, []int{size}, maxPixels); err != nil {
+		return "", err
+	}
+	return thumbPath, nil
+}
+
+// Remove deletes the thumbnails of all sizes
+func Remove(dir string, fileHash string) {
+	thumbs, _ := filepath.Glob(filepath.Join(dir, fileHash+"_*.jpg"))
+	for _, thumbPath := range thumbs {
+		if err := os.Remove(thumbPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("ERROR: removing thumbnail %s failed: %v", thumbPath, err)
+		}
+	}
+}
+
+// Resize scales the image to fit into a size x size square keeping its
+// aspect ratio. Smaller images aren't enlarged. Transparent parts become
+// white since JPEG has no alpha channel.
+func Resize(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width >= height {
+			height = max(1, height*size/width)
+			width = size
+		} else {
+			width = max(1, width*size/height)
+			height = size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+// write encodes into a temporary file first so that a request reading
+// the thumbnail at the same time never sees it half written.
+func write(thumbPath string, img image.Image) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(thumbPath), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	err = jpeg.Encode(tmpFile, img, &jpeg.Options{Quality: jpegQuality})
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing thumbnail %s failed: %v", thumbPath, err)
+	}
+	return os.Rename(tmpFile.Name(), thumbPath)
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
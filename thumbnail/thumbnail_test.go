@@ -0,0 +1,104 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name       string
+		width      int
+		height     int
+		size       int
+		wantWidth  int
+		wantHeight int
+	}{
+		{"Landscape", 1000, 500, 200, 200, 100},
+		{"Portrait", 600, 3000, 800, 160, 800},
+		{"Square", 300, 300, 200, 200, 200},
+		{"Smaller is not enlarged", 100, 50, 200, 100, 50},
+		{"Thin strip keeps a pixel", 5000, 2, 200, 200, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewGray(image.Rect(0, 0, tt.width, tt.height))
+			got := Resize(src, tt.size).Bounds()
+			if got.Dx() != tt.wantWidth || got.Dy() != tt.wantHeight {
+				t.Errorf("%s: Resize() = %dx%d, want %dx%d",
+					tt.name,
+					got.Dx(),
+					got.Dy(),
+					tt.wantWidth,
+					tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestGetAndRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnail")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 400, 300)))
+	srcPath := filepath.Join(dir, "abc.png")
+	ioutil.WriteFile(srcPath, buf.Bytes(), 0600)
+	loads := 0
+	load := func() (io.ReadSeekCloser, error) {
+		loads++
+		return os.Open(srcPath)
+	}
+
+	if err := Generate(bytes.NewReader(buf.Bytes()), dir, "big", []int{200}, 400*300-1); err == nil {
+		t.Errorf("Generate() of an image larger than allowed succeeded")
+	}
+	if err := Generate(bytes.NewReader(buf.Bytes()), dir, "abc", []int{200}, 400*300); err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	// 100px wasn't generated beforehand
+	for _, size := range []int{200, 100} {
+		thumbPath, err := Get(load, dir, "abc", size, 400*300)
+		if err != nil || thumbPath != Path(dir, "abc", size) {
+			t.Fatalf("Get(%d) = %s, %v", size, thumbPath, err)
+		}
+		thumbFile, _ := os.Open(thumbPath)
+		config, format, err := image.DecodeConfig(thumbFile)
+		thumbFile.Close()
+		if err != nil || format != "jpeg" || config.Width != size {
+			t.Errorf("Get(%d) wrote %s %dx%d, %v, want jpeg %dpx wide",
+				size,
+				format,
+				config.Width,
+				config.Height,
+				err,
+				size)
+		}
+	}
+
+	if loads != 1 {
+		t.Errorf("Get() loaded the image %d times, want once", loads)
+	}
+
+	errMissing := errors.New("missing")
+	missing := func() (io.ReadSeekCloser, error) { return nil, errMissing }
+	if _, err := Get(missing, dir, "missing", 200, 400*300); err != errMissing {
+		t.Errorf("Get() of missing file error = %v, want %v", err, errMissing)
+	}
+
+	Remove(dir, "abc")
+	thumbs, _ := filepath.Glob(filepath.Join(dir, "*.jpg"))
+	if len(thumbs) != 0 {
+		t.Errorf("Remove() left %v behind", thumbs)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"receiptstracker-api/config"
+	"receiptstracker-api/dbengine"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const tokenUsage = `Usage: receiptstracker-api token <command> [flags] [data directory]
+
+Commands:
+  create -user USER -name NAME -scopes read,write,admin   create a token and print it
+  list                                                    list the tokens of every user
+  revoke -user USER -id ID                                revoke a token
+`
+
+// tokenCommand manages the API tokens in the database of the server
+// configured the same way as when serving.
+func tokenCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, tokenUsage)
+		return fmt.Errorf("Missing token command")
+	}
+	fs := flag.NewFlagSet("token "+args[0], flag.ContinueOnError)
+	var run func(ctx context.Context, db *dbengine.Store) error
+	switch args[0] {
+	case "create":
+		userName := fs.String("user", "", "name of the user the token acts as")
+		name := fs.String("name", "", "what the token is used for")
+		scopes := fs.String("scopes", dbengine.SCOPE_READ,
+			"comma separated scopes: read, write, admin")
+		run = func(ctx context.Context, db *dbengine.Store) error {
+			return createToken(ctx, db, *userName, *name, *scopes)
+		}
+	case "list":
+		run = listTokens
+	case "revoke":
+		userName := fs.String("user", "", "name of the user owning the token")
+		tokenId := fs.Int64("id", 0, "id of the token to revoke")
+		run = func(ctx context.Context, db *dbengine.Store) error {
+			user, err := db.GetUserByName(ctx, *userName)
+			if err != nil {
+				return err
+			}
+			if err := db.RevokeApiToken(ctx, user.Id, *tokenId); err != nil {
+				return err
+			}
+			fmt.Printf("Token %d revoked\n", *tokenId)
+			return nil
+		}
+	default:
+		fmt.Fprint(os.Stderr, tokenUsage)
+		return fmt.Errorf("Unknown token command %q", args[0])
+	}
+	return withStore(fs, args[1:], run)
+}
+
+// withStore opens the database of the server configured the same way as
+// when serving and runs the command on it.
+func withStore(
+	fs *flag.FlagSet,
+	args []string,
+	run func(ctx context.Context, db *dbengine.Store) error) error {
+	cfg, err := config.Load(fs, args, os.Getenv)
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(cfg.DataDir); err != nil {
+		return fmt.Errorf("chdir() failed: %v", err)
+	}
+	db, err := dbengine.Open(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return run(context.Background(), db)
+}
+
+func createToken(
+	ctx context.Context,
+	db *dbengine.Store,
+	userName string,
+	name string,
+	scopes string) error {
+	user, err := db.GetUserByName(ctx, userName)
+	if err != nil {
+		return err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("Missing -name")
+	}
+	parsed, err := dbengine.ParseScopes(scopes)
+	if err != nil {
+		return err
+	}
+	token, apiToken, err := db.CreateApiToken(ctx, user.Id, name, parsed)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created token %d %q for %s with scopes %s\n",
+		apiToken.Id,
+		apiToken.Name,
+		user.Name,
+		strings.Join(apiToken.Scopes, ","))
+	fmt.Println("Store it now, it cannot be shown again:")
+	fmt.Println(token)
+	return nil
+}
+
+func listTokens(ctx context.Context, db *dbengine.Store) error {
+	users, err := db.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tNAME\tSCOPES\tCREATED\tREVOKED")
+	for _, user := range users {
+		tokens, err := db.ListApiTokens(ctx, user.Id)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			revoked := "-"
+			if t.RevokedAt != nil {
+				revoked = t.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n",
+				t.Id,
+				user.Name,
+				t.Name,
+				strings.Join(t.Scopes, ","),
+				t.CreatedAt.Format(time.RFC3339),
+				revoked)
+		}
+	}
+	return w.Flush()
+}
+
+// warnWithoutTokens logs that every request will be refused until a
+// user and a token of theirs are created.
+func warnWithoutTokens(db *dbengine.Store) {
+	ctx := context.Background()
+	users, err := db.ListUsers(ctx)
+	if err != nil {
+		log.Printf("ERROR: listing users failed: %v", err)
+		return
+	}
+	if len(users) == 0 {
+		log.Printf("WARNING: No users, create one with \"user create\" and a token with \"token create\"")
+		return
+	}
+	for _, user := range users {
+		tokens, err := db.ListApiTokens(ctx, user.Id)
+		if err != nil {
+			log.Printf("ERROR: listing API tokens of %q failed: %v", user.Name, err)
+			return
+		}
+		for _, t := range tokens {
+			if t.RevokedAt == nil {
+				return
+			}
+		}
+	}
+	log.Printf("WARNING: No API tokens, create one with \"token create\"")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"receiptstracker-api/dbengine"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const userUsage = `Usage: receiptstracker-api user <command> [flags] [data directory]
+
+Commands:
+  create -name NAME [-email ADDRESS]   create a user
+  set-email -name NAME -email ADDRESS  set the address expiry reminders are sent to
+  list                                 list the users
+`
+
+// userCommand manages the users whose receipts are kept apart from each
+// other unless shared.
+func userCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, userUsage)
+		return fmt.Errorf("Missing user command")
+	}
+	fs := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	var run func(ctx context.Context, db *dbengine.Store) error
+	switch args[0] {
+	case "create":
+		name := fs.String("name", "", "name of the user, used when sharing with them")
+		email := fs.String("email", "", "address expiry reminders are sent to")
+		run = func(ctx context.Context, db *dbengine.Store) error {
+			return createUser(ctx, db, *name, *email)
+		}
+	case "set-email":
+		name := fs.String("name", "", "name of the user")
+		email := fs.String("email", "", "address expiry reminders are sent to, empty to stop them")
+		run = func(ctx context.Context, db *dbengine.Store) error {
+			if err := db.SetUserEmail(ctx, *name, *email); err != nil {
+				return err
+			}
+			fmt.Printf("E-mail of user %q set to %q\n", *name, *email)
+			return nil
+		}
+	case "list":
+		run = listUsers
+	default:
+		fmt.Fprint(os.Stderr, userUsage)
+		return fmt.Errorf("Unknown user command %q", args[0])
+	}
+	return withStore(fs, args[1:], run)
+}
+
+// createUser refuses names that can't be used in the share URLs
+func createUser(ctx context.Context, db *dbengine.Store, name string, email string) error {
+	if name == "" {
+		return fmt.Errorf("Missing -name")
+	}
+	if strings.ContainsAny(name, "/ \t\n") {
+		return fmt.Errorf("User name cannot contain slashes or spaces")
+	}
+	user, err := db.CreateUser(ctx, name)
+	if err != nil {
+		return err
+	}
+	if email != "" {
+		if err := db.SetUserEmail(ctx, name, email); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Created user %d %q\n", user.Id, user.Name)
+	return nil
+}
+
+func listUsers(ctx context.Context, db *dbengine.Store) error {
+	users, err := db.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tEMAIL\tCREATED")
+	for _, user := range users {
+		email := user.Email
+		if email == "" {
+			email = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n",
+			user.Id,
+			user.Name,
+			email,
+			user.CreatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// warnWithoutEmail logs the users whose expiry reminders can't be sent
+// by e-mail.
+func warnWithoutEmail(db *dbengine.Store) {
+	users, err := db.ListUsers(context.Background())
+	if err != nil {
+		log.Printf("ERROR: listing users failed: %v", err)
+		return
+	}
+	for _, user := range users {
+		if user.Email == "" {
+			log.Printf("WARNING: User %q gets no expiry reminders, set an address with \"user set-email\"",
+				user.Name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Active ISO 4217 currency codes
+var currencyCodes = strings.Fields(`
+AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND
+BOB BRL BSD BTN BWP BYN BZD CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF
+DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD
+HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW
+KWD KYD KZT LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR
+MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN
+PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN
+SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX USD UYU UZS VES
+VND VUV WST XAF XCD XCG XOF XPF YER ZAR ZMW ZWG`)
+
+// Currencies not having two decimals
+var currencyMinorUnits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0,
+	"KMF": 0, "KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "VND": 0,
+	"VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3,
+	"TND": 3,
+}
+
+var amountPat = regexp.MustCompile(`^(-?)([0-9]+)(?:[.,]([0-9]+))?$`)
+
+func IsCurrencyCode(code string) bool {
+	for _, c := range currencyCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrencyMinorUnits returns the number of decimals used by the
+// currency. Unknown or missing currency defaults to two decimals.
+func CurrencyMinorUnits(code string) int {
+	if units, found := currencyMinorUnits[code]; found {
+		return units
+	}
+	return 2
+}
+
+// ParseAmount converts a decimal amount like "12.50" or "12,50" into
+// the currency's minor units, e.g. 1250 cents.
+func ParseAmount(amount string, currency string) (int64, error) {
+	matches := amountPat.FindStringSubmatch(strings.TrimSpace(amount))
+	if matches == nil {
+		return 0, errors.New("Amount must be a number like 12.50")
+	}
+	sign, whole, fraction := matches[1], matches[2], matches[3]
+
+	minorUnits := CurrencyMinorUnits(currency)
+	if len(fraction) > minorUnits {
+		return 0, errors.New("Amount has too many decimals for " +
+			"the currency")
+	}
+	fraction += strings.Repeat("0", minorUnits-len(fraction))
+
+	value, err := strconv.ParseInt(sign+whole+fraction, 10, 64)
+	if err != nil {
+		return 0, errors.New("Amount is too large")
+	}
+	return value, nil
+}
+
+// FormatAmount turns minor units back into a decimal string, e.g.
+// 1250 cents into "12.50".
+func FormatAmount(amount int64, currency string) string {
+	minorUnits := CurrencyMinorUnits(currency)
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	digits := strconv.FormatInt(amount, 10)
+	if minorUnits == 0 {
+		return sign + digits
+	}
+	if len(digits) <= minorUnits {
+		digits = strings.Repeat("0", minorUnits-len(digits)+1) + digits
+	}
+	split := len(digits) - minorUnits
+	return sign + digits[:split] + "." + digits[split:]
+}
@@ -0,0 +1,119 @@
+package utils
+
+import "testing"
+
+func Test_parseAmount(t *testing.T) {
+	type args struct {
+		amount   string
+		currency string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    int64
+		wantErr bool
+	}{
+		{
+			"Euros with cents",
+			args{"12.50", "EUR"},
+			1250,
+			false,
+		},
+		{
+			"Decimal comma",
+			args{"12,5", "EUR"},
+			1250,
+			false,
+		},
+		{
+			"Whole number",
+			args{"12", ""},
+			1200,
+			false,
+		},
+		{
+			"Refund",
+			args{"-3.20", "EUR"},
+			-320,
+			false,
+		},
+		{
+			"Zero decimal currency",
+			args{"1200", "JPY"},
+			1200,
+			false,
+		},
+		{
+			"Three decimal currency",
+			args{"1.5", "KWD"},
+			1500,
+			false,
+		},
+		{
+			"Too many decimals",
+			args{"12.505", "EUR"},
+			0,
+			true,
+		},
+		{
+			"Not a number",
+			args{"12e3", "EUR"},
+			0,
+			true,
+		},
+		{
+			"Overflow",
+			args{"99999999999999999999", "EUR"},
+			0,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAmount(tt.args.amount, tt.args.currency)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: ParseAmount() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("%s: ParseAmount() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
+
+func Test_formatAmount(t *testing.T) {
+	type args struct {
+		amount   int64
+		currency string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{"Euros with cents", args{1250, "EUR"}, "12.50"},
+		{"Only cents", args{5, "EUR"}, "0.05"},
+		{"Refund", args{-320, "EUR"}, "-3.20"},
+		{"Zero decimal currency", args{1200, "JPY"}, "1200"},
+		{"Three decimal currency", args{1500, "KWD"}, "1.500"},
+		{"Zero", args{0, ""}, "0.00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FormatAmount(tt.args.amount, tt.args.currency)
+			if got != tt.want {
+				t.Errorf("%s: FormatAmount() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// CheckImageSize rejects images having more than maxPixels pixels. A
+// small, highly compressed file may otherwise decode into gigabytes.
+func CheckImageSize(config image.Config, maxPixels int64) error {
+	if pixels := int64(config.Width) * int64(config.Height); pixels > maxPixels {
+		return fmt.Errorf("Image of %dx%d pixels is larger than %d pixels",
+			config.Width,
+			config.Height,
+			maxPixels)
+	}
+	return nil
+}
+
+// DecodeImage decodes the image only after its header has told that it
+// isn't larger than maxPixels.
+func DecodeImage(content io.ReadSeeker, maxPixels int64) (image.Image, error) {
+	config, _, err := image.DecodeConfig(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckImageSize(config, maxPixels); err != nil {
+		return nil, err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(content)
+	return img, err
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestDecodeImage(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 40, 30)))
+
+	tests := []struct {
+		name      string
+		content   []byte
+		maxPixels int64
+		wantErr   bool
+	}{
+		{"Smaller", buf.Bytes(), 2000, false},
+		{"Exactly the largest", buf.Bytes(), 1200, false},
+		{"Too many pixels", buf.Bytes(), 1199, true},
+		{"Not an image", []byte("GIF89a"), 2000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := DecodeImage(bytes.NewReader(tt.content), tt.maxPixels)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: DecodeImage() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if err == nil && img.Bounds().Dx() != 40 {
+				t.Errorf("%s: DecodeImage() = %v, want 40px wide",
+					tt.name,
+					img.Bounds())
+			}
+		})
+	}
+}
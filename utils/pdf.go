@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"rsc.io/pdf"
+)
+
+// OpenPdf parses the PDF structure. The parser panics on some malformed
+// files, so those are turned into errors too.
+func OpenPdf(f io.ReaderAt, size int64) (reader *pdf.Reader, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			reader = nil
+			err = fmt.Errorf("malformed PDF file: %v", r)
+		}
+	}()
+	return pdf.NewReader(f, size)
+}
+
+// PdfPageCount validates the PDF and returns the number of pages in it
+func PdfPageCount(content []byte) (count int, err error) {
+	reader, err := OpenPdf(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			count = 0
+			err = fmt.Errorf("malformed PDF file: %v", r)
+		}
+	}()
+	count = reader.NumPage()
+	if count < 1 {
+		return 0, errors.New("PDF has no pages")
+	}
+	// Page tree must really have as many pages as it claims
+	if reader.Page(count).V.IsNull() {
+		return 0, fmt.Errorf("PDF claims %d pages but has less", count)
+	}
+	return count, nil
+}
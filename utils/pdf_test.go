@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// minimalPdf builds a PDF with the given number of empty pages
+func minimalPdf(pages int) []byte {
+	kids := []string{}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+	}
+	for i := 0; i < pages; i++ {
+		kids = append(kids, fmt.Sprintf("%d 0 R", i+3))
+		objects = append(objects,
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] >>")
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>",
+		strings.Join(kids, " "),
+		pages)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, obj := range objects {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(objects)+1,
+		xref)
+	return buf.Bytes()
+}
+
+func Test_pdfPageCount(t *testing.T) {
+	claimsTooMany := bytes.Replace(minimalPdf(2), []byte("/Count 2"), []byte("/Count 3"), 1)
+	tests := []struct {
+		name    string
+		content []byte
+		want    int
+		wantErr bool
+	}{
+		{"Single page", minimalPdf(1), 1, false},
+		{"Several pages", minimalPdf(3), 3, false},
+		{"No pages", minimalPdf(0), 0, true},
+		{"Page count not matching", claimsTooMany, 0, true},
+		{"Header only", []byte("%PDF-1.4\n"), 0, true},
+		{"Truncated", minimalPdf(1)[:200], 0, true},
+		{"Not a PDF", []byte("GIF89a"), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PdfPageCount(tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: PdfPageCount() error = %v, wantErr %v",
+					tt.name,
+					err,
+					tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("%s: PdfPageCount() = %v, want %v",
+					tt.name,
+					got,
+					tt.want)
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ package utils
 import (
 	"os"
 	"path/filepath"
-	"receiptstracker-api/external"
 	"strings"
 )
 
@@ -22,7 +21,7 @@ func DeleteFromSlice(a []string, i int) []string {
 	return append(a[:i], a[i+1:]...)
 }
 
-func IsAllowedFileExt(fname string) bool {
+func IsAllowedFileExt(fname string, allowedExtensions []string) bool {
 	if strings.Index(fname, ".") == -1 {
 		return false
 	}
@@ -31,7 +30,7 @@ func IsAllowedFileExt(fname string) bool {
 		strings.ToLower(filepath.Ext(fname)),
 		".",
 	)
-	for _, ext := range external.AllowedExtensions {
+	for _, ext := range allowedExtensions {
 		if ext == fileExt {
 			return true
 		}
@@ -29,7 +29,7 @@ func Test_isAllowedFileExt(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := IsAllowedFileExt(tt.args.fname)
+			got := IsAllowedFileExt(tt.args.fname, []string{"jpg", "png"})
 			if got != tt.want {
 				t.Errorf("%s: IsAllowerFileExt() = %v, want %v",
 					tt.name,